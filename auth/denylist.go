@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Denylist keeps revoked JWTs until they expire. Single tokens are
+// denied by id, all tokens of user by issue time
+type Denylist interface {
+	// DenyToken revokes token with id until it expires
+	DenyToken(tokenId string, expiresAt time.Time) error
+	// DenyUser revokes every token of user issued before time,
+	// compared with millisecond precision. Tokens issued in the
+	// same millisecond are denied too
+	DenyUser(userId int64, before time.Time) error
+	// IsDenied returns true if token was revoked
+	IsDenied(tokenId string, userId int64, issuedAt time.Time) (bool, error)
+}
+
+// MemoryDenylist keeps denylist in process memory
+type MemoryDenylist struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	tokens map[string]time.Time
+	users  map[int64]time.Time
+}
+
+// NewMemoryDenylist returns denylist for tokens
+// that are valid no longer than ttl
+func NewMemoryDenylist(ttl time.Duration) *MemoryDenylist {
+	return &MemoryDenylist{
+		ttl:    ttl,
+		tokens: make(map[string]time.Time),
+		users:  make(map[int64]time.Time),
+	}
+}
+
+// prune drops entries of tokens that have expired anyway
+func (d *MemoryDenylist) prune(now time.Time) {
+	for tokenId, expiresAt := range d.tokens {
+		if now.After(expiresAt) {
+			delete(d.tokens, tokenId)
+		}
+	}
+	for userId, before := range d.users {
+		if now.After(before.Add(d.ttl)) {
+			delete(d.users, userId)
+		}
+	}
+}
+
+func (d *MemoryDenylist) DenyToken(tokenId string, expiresAt time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.prune(time.Now())
+	d.tokens[tokenId] = expiresAt
+	return nil
+}
+
+func (d *MemoryDenylist) DenyUser(userId int64, before time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.prune(time.Now())
+	d.users[userId] = before
+	return nil
+}
+
+func (d *MemoryDenylist) IsDenied(tokenId string, userId int64, issuedAt time.Time) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.tokens[tokenId]; ok {
+		return true, nil
+	}
+	before, ok := d.users[userId]
+	return ok && unixMilli(issuedAt) <= unixMilli(before), nil
+}
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// RedisDenylist keeps denylist in redis, entries expire with tokens
+type RedisDenylist struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+// NewRedisDenylist returns denylist for tokens
+// that are valid no longer than ttl
+func NewRedisDenylist(client *redis.Client, ttl time.Duration) *RedisDenylist {
+	return &RedisDenylist{
+		client: client,
+		ttl:    ttl,
+	}
+}
+
+func deniedTokenKey(tokenId string) string {
+	return "denied_token:" + tokenId
+}
+
+func deniedUserKey(userId int64) string {
+	return fmt.Sprintf("denied_user:%d", userId)
+}
+
+func (d *RedisDenylist) DenyToken(tokenId string, expiresAt time.Time) error {
+	ttl := time.Until(expiresAt)
+	if ttl <= 0 {
+		return nil
+	}
+	return d.client.Set(deniedTokenKey(tokenId), 1, ttl).Err()
+}
+
+func (d *RedisDenylist) DenyUser(userId int64, before time.Time) error {
+	return d.client.Set(deniedUserKey(userId), unixMilli(before), d.ttl).Err()
+}
+
+func (d *RedisDenylist) IsDenied(tokenId string, userId int64, issuedAt time.Time) (bool, error) {
+	results, err := d.client.MGet(deniedTokenKey(tokenId), deniedUserKey(userId)).Result()
+	if err != nil {
+		return false, err
+	}
+	if results[0] != nil {
+		return true, nil
+	}
+	beforeStr, ok := results[1].(string)
+	if ok == false {
+		return false, nil
+	}
+	before, err := strconv.ParseInt(beforeStr, 10, 64)
+	if err != nil {
+		return false, err
+	}
+	if before < maxUnixSeconds {
+		// Entry was written by older version in seconds
+		before = before*1000 + 999
+	}
+	return unixMilli(issuedAt) <= before, nil
+}
+
+// maxUnixSeconds is larger than any time in seconds
+// denylist entries were written in, and less than any in ms
+const maxUnixSeconds = 1e11
@@ -0,0 +1,237 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/revan730/gamedev-backend/types"
+)
+
+// Claims are carried by JWT access tokens
+type Claims struct {
+	// Id of user as decimal string
+	Subject   string `json:"sub"`
+	TokenId   string `json:"jti"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	// Users have a single role, tokens with several roles are refused
+	Roles []string `json:"roles,omitempty"`
+	// Issue time in milliseconds, iat has only second precision
+	IssuedAtMs int64 `json:"iat_ms,omitempty"`
+}
+
+// IssueTime returns time token was issued at, tokens issued by
+// older versions have only iat, so it's rounded down to a second
+func (c *Claims) IssueTime() time.Time {
+	if c.IssuedAtMs != 0 {
+		return time.Unix(0, c.IssuedAtMs*int64(time.Millisecond))
+	}
+	return time.Unix(c.IssuedAt, 0)
+}
+
+// UserId returns id of token's user
+func (c *Claims) UserId() (int64, error) {
+	return strconv.ParseInt(c.Subject, 10, 64)
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// JWTTokenStore issues signed JWTs, which are verified without
+// asking any storage except denylist. Issued tokens can't be
+// listed, so List and RevokeSession aren't supported
+type JWTTokenStore struct {
+	keys     *KeySet
+	denylist Denylist
+	ttl      time.Duration
+}
+
+func NewJWTTokenStore(keys *KeySet, denylist Denylist, ttl time.Duration) *JWTTokenStore {
+	return &JWTTokenStore{
+		keys:     keys,
+		denylist: denylist,
+		ttl:      ttl,
+	}
+}
+
+var b64 = base64.RawURLEncoding
+
+func (j *JWTTokenStore) sign(claims *Claims) (string, error) {
+	key := j.keys.signing
+	header, err := json.Marshal(jwtHeader{Alg: key.Alg, Typ: "JWT", Kid: key.Id})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	var signature []byte
+	if key.Alg == AlgHS256 {
+		mac := hmac.New(sha256.New, key.secret)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	} else {
+		signature = ed25519.Sign(key.private, []byte(signed))
+	}
+	return signed + "." + b64.EncodeToString(signature), nil
+}
+
+func (j *JWTTokenStore) issue(userId int64, roles []string) (string, error) {
+	tokenId, err := newSessionId()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	return j.sign(&Claims{
+		Subject:    strconv.FormatInt(userId, 10),
+		TokenId:    tokenId,
+		IssuedAt:   now.Unix(),
+		ExpiresAt:  now.Add(j.ttl).Unix(),
+		Roles:      roles,
+		IssuedAtMs: unixMilli(now),
+	})
+}
+
+func (j *JWTTokenStore) Issue(user *types.User) (string, error) {
+	var roles []string
+	if user.Role != "" {
+		roles = []string{user.Role}
+	}
+	return j.issue(user.Id, roles)
+}
+
+// verify checks token's signature and expiry, without looking at denylist
+func (j *JWTTokenStore) verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	key, err := j.keys.lookupKey(header.Kid, header.Alg)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	signature, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	var valid bool
+	if key.Alg == AlgHS256 {
+		mac := hmac.New(sha256.New, key.secret)
+		mac.Write(signed)
+		valid = hmac.Equal(signature, mac.Sum(nil))
+	} else {
+		valid = ed25519.Verify(key.public, signed, signature)
+	}
+	if valid == false {
+		return nil, ErrInvalidToken
+	}
+	claims := &Claims{}
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrInvalidToken
+	}
+	if _, err := claims.UserId(); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if len(claims.Roles) > 1 {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := b64.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Claims verifies token and returns its claims
+func (j *JWTTokenStore) Claims(token string) (*Claims, error) {
+	claims, err := j.verify(token)
+	if err != nil {
+		return nil, err
+	}
+	userId, _ := claims.UserId()
+	denied, err := j.denylist.IsDenied(claims.TokenId, userId, claims.IssueTime())
+	if err != nil {
+		return nil, err
+	}
+	if denied {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// Resolve returns user of token, tokens without roles
+// claim have player role. Token is verified before denylist
+// is asked, so invalid ones don't cost a lookup
+func (j *JWTTokenStore) Resolve(token string) (Identity, error) {
+	claims, err := j.Claims(token)
+	if err != nil {
+		return Identity{}, err
+	}
+	userId, _ := claims.UserId()
+	identity := Identity{UserId: userId, Role: types.RolePlayer}
+	if len(claims.Roles) != 0 {
+		identity.Role = claims.Roles[0]
+	}
+	return identity, nil
+}
+
+func (j *JWTTokenStore) Refresh(token string, user *types.User) (string, error) {
+	claims, err := j.Claims(token)
+	if err != nil {
+		return "", err
+	}
+	if userId, _ := claims.UserId(); userId != user.Id {
+		return "", ErrInvalidToken
+	}
+	fresh, err := j.Issue(user)
+	if err != nil {
+		return "", err
+	}
+	return fresh, j.denylist.DenyToken(claims.TokenId, time.Unix(claims.ExpiresAt, 0))
+}
+
+func (j *JWTTokenStore) Revoke(token string) error {
+	claims, err := j.verify(token)
+	if err == ErrInvalidToken {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return j.denylist.DenyToken(claims.TokenId, time.Unix(claims.ExpiresAt, 0))
+}
+
+func (j *JWTTokenStore) RevokeSession(userId int64, sessionId string) (*Session, error) {
+	return nil, ErrNotSupported
+}
+
+func (j *JWTTokenStore) RevokeAll(userId int64) error {
+	return j.denylist.DenyUser(userId, time.Now())
+}
+
+func (j *JWTTokenStore) List(userId int64) ([]Session, error) {
+	return nil, ErrNotSupported
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/revan730/gamedev-backend/types"
+)
+
+func newTestJWTStore(t *testing.T) *JWTTokenStore {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	_, err = GenerateKeyFile(dir, "test", AlgHS256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadKeys(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewJWTTokenStore(keys, NewMemoryDenylist(time.Hour), time.Hour)
+}
+
+func TestRevokeAllKeepsLaterTokens(t *testing.T) {
+	store := newTestJWTStore(t)
+	user := &types.User{Id: 1, Role: types.RolePlayer}
+	revoked, err := store.Issue(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.RevokeAll(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Logging in again takes at least a request
+	time.Sleep(2 * time.Millisecond)
+	fresh, err := store.Issue(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Resolve(revoked); err != ErrInvalidToken {
+		t.Errorf("expected revoked token to be denied, got %v", err)
+	}
+	identity, err := store.Resolve(fresh)
+	if err != nil {
+		t.Fatalf("token issued after revocation was denied: %v", err)
+	}
+	if identity.UserId != user.Id {
+		t.Errorf("expected user %d, got %d", user.Id, identity.UserId)
+	}
+}
+
+func TestClaimsWithoutMillisecondsAreDeniedWholeSecond(t *testing.T) {
+	denylist := NewMemoryDenylist(time.Hour)
+	before := time.Unix(1000, int64(500*time.Millisecond))
+	denylist.DenyUser(1, before)
+	// Issued by older version later in the same second
+	claims := &Claims{IssuedAt: 1000}
+	denied, _ := denylist.IsDenied("old", 1, claims.IssueTime())
+	if denied == false {
+		t.Error("token of older version issued in revocation second wasn't denied")
+	}
+	claims = &Claims{IssuedAt: 1000, IssuedAtMs: 1000501}
+	denied, _ = denylist.IsDenied("new", 1, claims.IssueTime())
+	if denied {
+		t.Error("token issued after revocation was denied")
+	}
+}
+
+func TestTokenWithSeveralRolesIsRefused(t *testing.T) {
+	store := newTestJWTStore(t)
+	token, err := store.issue(1, []string{types.RolePlayer, types.RoleAdmin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Resolve(token); err != ErrInvalidToken {
+		t.Errorf("expected ErrInvalidToken, got %v", err)
+	}
+	token, err = store.issue(1, []string{types.RoleWriter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := store.Resolve(token)
+	if err != nil || identity.Role != types.RoleWriter {
+		t.Errorf("expected writer role, got %+v (%v)", identity, err)
+	}
+}
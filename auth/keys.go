@@ -0,0 +1,191 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Signing algorithms
+const (
+	AlgHS256 = "HS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// Minimal length of HMAC secret
+const minSecretLength = 32
+
+// Key is a single JWT key identified by kid. Keys without private
+// part can only verify tokens, which is how rotated out keys are kept
+type Key struct {
+	Id      string
+	Alg     string
+	secret  []byte
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+// CanSign returns true if key has its private part
+func (k *Key) CanSign() bool {
+	return k.secret != nil || k.private != nil
+}
+
+// KeySet contains every active key and the one new tokens are signed with
+type KeySet struct {
+	keys    map[string]*Key
+	signing *Key
+}
+
+// LoadKeys reads keys from directory, key id is file name without
+// extension. Supported files are:
+//
+//	<kid>.secret - HMAC secret for HS256, at least 32 bytes
+//	<kid>.key    - PEM encoded PKCS#8 Ed25519 private key
+//	<kid>.pub    - PEM encoded PKIX Ed25519 public key, verification only
+//
+// Tokens are signed with signingKid, or with the last key by name
+// that can sign if it's empty
+func LoadKeys(dir, signingKid string) (*KeySet, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	set := &KeySet{keys: make(map[string]*Key)}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		ext := filepath.Ext(file.Name())
+		kid := strings.TrimSuffix(file.Name(), ext)
+		key, err := readKey(filepath.Join(dir, file.Name()), kid, ext)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %s", file.Name(), err)
+		}
+		if key == nil {
+			continue
+		}
+		// Private key file makes public one redundant
+		if existing, ok := set.keys[kid]; ok {
+			if existing.Alg != key.Alg {
+				return nil, fmt.Errorf("key %s: conflicting key files", kid)
+			}
+			if existing.CanSign() {
+				continue
+			}
+		}
+		set.keys[kid] = key
+	}
+	if signingKid == "" {
+		var kids []string
+		for kid, key := range set.keys {
+			if key.CanSign() {
+				kids = append(kids, kid)
+			}
+		}
+		sort.Strings(kids)
+		if len(kids) != 0 {
+			signingKid = kids[len(kids)-1]
+		}
+	}
+	set.signing = set.keys[signingKid]
+	if set.signing == nil || set.signing.CanSign() == false {
+		return nil, errors.New("no signing key found in " + dir)
+	}
+	return set, nil
+}
+
+// readKey returns nil key for files of unknown types
+func readKey(path, kid, ext string) (*Key, error) {
+	switch ext {
+	case ".secret", ".key", ".pub":
+	default:
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if ext == ".secret" {
+		secret := []byte(strings.TrimSpace(string(data)))
+		if len(secret) < minSecretLength {
+			return nil, fmt.Errorf("secret must be at least %d bytes", minSecretLength)
+		}
+		return &Key{Id: kid, Alg: AlgHS256, secret: secret}, nil
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if ext == ".key" {
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		private, ok := parsed.(ed25519.PrivateKey)
+		if ok == false {
+			return nil, errors.New("not an Ed25519 private key")
+		}
+		return &Key{Id: kid, Alg: AlgEdDSA, private: private,
+			public: private.Public().(ed25519.PublicKey)}, nil
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	public, ok := parsed.(ed25519.PublicKey)
+	if ok == false {
+		return nil, errors.New("not an Ed25519 public key")
+	}
+	return &Key{Id: kid, Alg: AlgEdDSA, public: public}, nil
+}
+
+// lookupKey returns key by id, making sure it's used with its algorithm
+func (s *KeySet) lookupKey(kid, alg string) (*Key, error) {
+	key, ok := s.keys[kid]
+	if ok == false {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	if key.Alg != alg {
+		return nil, fmt.Errorf("key %q doesn't use %s", kid, alg)
+	}
+	return key, nil
+}
+
+// GenerateKeyFile writes new key of alg to dir, returning file path
+func GenerateKeyFile(dir, kid, alg string) (string, error) {
+	var data []byte
+	var path string
+	switch alg {
+	case AlgHS256:
+		secret, err := newToken()
+		if err != nil {
+			return "", err
+		}
+		data = []byte(secret + "\n")
+		path = filepath.Join(dir, kid+".secret")
+	case AlgEdDSA:
+		_, private, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			return "", err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(private)
+		if err != nil {
+			return "", err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		path = filepath.Join(dir, kid+".key")
+	default:
+		return "", fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	if _, err := os.Stat(path); err == nil {
+		return "", fmt.Errorf("%s already exists", path)
+	}
+	return path, ioutil.WriteFile(path, data, 0600)
+}
@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/revan730/gamedev-backend/types"
+)
+
+// MemoryTokenStore keeps tokens in process memory,
+// they are lost on restart and not shared between nodes
+type MemoryTokenStore struct {
+	mu  sync.Mutex
+	ttl time.Duration
+	// Sessions by token hash
+	sessions map[string]Session
+}
+
+func NewMemoryTokenStore(ttl time.Duration) *MemoryTokenStore {
+	return &MemoryTokenStore{
+		ttl:      ttl,
+		sessions: make(map[string]Session),
+	}
+}
+
+// issue creates session of user, caller must hold the lock
+func (m *MemoryTokenStore) issue(user *types.User) (string, error) {
+	session, token, err := newSession(user, m.ttl)
+	if err != nil {
+		return "", err
+	}
+	m.sessions[session.TokenHash] = session
+	return token, nil
+}
+
+func (m *MemoryTokenStore) Issue(user *types.User) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.issue(user)
+}
+
+// lookup returns session by token hash, dropping it if it has expired
+func (m *MemoryTokenStore) lookup(tokenHash string) (Session, bool) {
+	session, ok := m.sessions[tokenHash]
+	if ok && session.expired(time.Now()) {
+		delete(m.sessions, tokenHash)
+		return session, false
+	}
+	return session, ok
+}
+
+func (m *MemoryTokenStore) Resolve(token string) (Identity, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, ok := m.lookup(HashToken(token))
+	if ok == false {
+		return Identity{}, ErrInvalidToken
+	}
+	return session.identity(), nil
+}
+
+func (m *MemoryTokenStore) Refresh(token string, user *types.User) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tokenHash := HashToken(token)
+	session, ok := m.lookup(tokenHash)
+	if ok == false || session.UserId != user.Id {
+		return "", ErrInvalidToken
+	}
+	fresh, err := m.issue(user)
+	if err != nil {
+		return "", err
+	}
+	delete(m.sessions, tokenHash)
+	return fresh, nil
+}
+
+func (m *MemoryTokenStore) Revoke(token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, HashToken(token))
+	return nil
+}
+
+func (m *MemoryTokenStore) RevokeSession(userId int64, sessionId string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for tokenHash, session := range m.sessions {
+		if session.UserId == userId && session.Id == sessionId {
+			delete(m.sessions, tokenHash)
+			return &session, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MemoryTokenStore) RevokeAll(userId int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for tokenHash, session := range m.sessions {
+		if session.UserId == userId {
+			delete(m.sessions, tokenHash)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryTokenStore) List(userId int64) ([]Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sessions []Session
+	for tokenHash, session := range m.sessions {
+		if session.UserId != userId {
+			continue
+		}
+		if _, ok := m.lookup(tokenHash); ok {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedAt.Before(sessions[j].CreatedAt) })
+	return sessions, nil
+}
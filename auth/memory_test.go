@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/revan730/gamedev-backend/types"
+)
+
+func issueToken(t *testing.T, store TokenStore, user *types.User) string {
+	token, err := store.Issue(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func expectIdentity(t *testing.T, store TokenStore, token string, user *types.User) {
+	t.Helper()
+	identity, err := store.Resolve(token)
+	if err != nil {
+		t.Fatalf("token wasn't resolved: %v", err)
+	}
+	if identity.UserId != user.Id || identity.Role != user.Role {
+		t.Errorf("expected user %d with role %s, got %+v", user.Id, user.Role, identity)
+	}
+}
+
+func expectInvalid(t *testing.T, store TokenStore, token string) {
+	t.Helper()
+	if _, err := store.Resolve(token); err != ErrInvalidToken {
+		t.Errorf("expected ErrInvalidToken, got %v", err)
+	}
+}
+
+func TestMemoryIssueAndResolve(t *testing.T) {
+	store := NewMemoryTokenStore(time.Hour)
+	player := &types.User{Id: 1, Role: types.RolePlayer}
+	writer := &types.User{Id: 2, Role: types.RoleWriter}
+	first := issueToken(t, store, player)
+	second := issueToken(t, store, player)
+	if first == second {
+		t.Fatal("same token was issued twice")
+	}
+	expectIdentity(t, store, first, player)
+	expectIdentity(t, store, second, player)
+	expectIdentity(t, store, issueToken(t, store, writer), writer)
+	expectInvalid(t, store, "unknown")
+	expectInvalid(t, store, HashToken(first))
+}
+
+func TestMemoryTokenExpires(t *testing.T) {
+	store := NewMemoryTokenStore(time.Millisecond)
+	user := &types.User{Id: 1, Role: types.RolePlayer}
+	token := issueToken(t, store, user)
+	time.Sleep(2 * time.Millisecond)
+	expectInvalid(t, store, token)
+	if sessions, _ := store.List(user.Id); len(sessions) != 0 {
+		t.Errorf("expired session is listed: %+v", sessions)
+	}
+}
+
+func TestMemoryRefresh(t *testing.T) {
+	store := NewMemoryTokenStore(time.Hour)
+	user := &types.User{Id: 1, Role: types.RolePlayer}
+	token := issueToken(t, store, user)
+	if _, err := store.Refresh(token, &types.User{Id: 2}); err != ErrInvalidToken {
+		t.Errorf("token was refreshed for other user: %v", err)
+	}
+	expectIdentity(t, store, token, user)
+	// Role change takes effect on refresh
+	user.Role = types.RoleWriter
+	fresh, err := store.Refresh(token, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectInvalid(t, store, token)
+	expectIdentity(t, store, fresh, user)
+	if _, err := store.Refresh(token, user); err != ErrInvalidToken {
+		t.Errorf("refreshed token was refreshed again: %v", err)
+	}
+}
+
+func TestMemoryRevoke(t *testing.T) {
+	store := NewMemoryTokenStore(time.Hour)
+	user := &types.User{Id: 1, Role: types.RolePlayer}
+	revoked := issueToken(t, store, user)
+	kept := issueToken(t, store, user)
+	if err := store.Revoke(revoked); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Revoke(revoked); err != nil {
+		t.Errorf("revoking token twice failed: %v", err)
+	}
+	expectInvalid(t, store, revoked)
+	expectIdentity(t, store, kept, user)
+}
+
+func TestMemoryRevokeSession(t *testing.T) {
+	store := NewMemoryTokenStore(time.Hour)
+	user := &types.User{Id: 1, Role: types.RolePlayer}
+	revoked := issueToken(t, store, user)
+	time.Sleep(time.Millisecond)
+	kept := issueToken(t, store, user)
+	sessions, err := store.List(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 || sessions[0].TokenHash != HashToken(revoked) {
+		t.Fatalf("expected 2 sessions oldest first, got %+v", sessions)
+	}
+	if session, _ := store.RevokeSession(2, sessions[0].Id); session != nil {
+		t.Error("session was revoked by other user")
+	}
+	session, err := store.RevokeSession(user.Id, sessions[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session == nil || session.Id != sessions[0].Id {
+		t.Errorf("expected session %s, got %+v", sessions[0].Id, session)
+	}
+	expectInvalid(t, store, revoked)
+	expectIdentity(t, store, kept, user)
+	if session, _ := store.RevokeSession(user.Id, sessions[0].Id); session != nil {
+		t.Error("session was revoked twice")
+	}
+}
+
+func TestMemoryRevokeAll(t *testing.T) {
+	store := NewMemoryTokenStore(time.Hour)
+	user := &types.User{Id: 1, Role: types.RolePlayer}
+	other := &types.User{Id: 2, Role: types.RolePlayer}
+	tokens := []string{issueToken(t, store, user), issueToken(t, store, user)}
+	kept := issueToken(t, store, other)
+	if err := store.RevokeAll(user.Id); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range tokens {
+		expectInvalid(t, store, token)
+	}
+	if sessions, _ := store.List(user.Id); len(sessions) != 0 {
+		t.Errorf("revoked sessions are listed: %+v", sessions)
+	}
+	expectIdentity(t, store, kept, other)
+	expectIdentity(t, store, issueToken(t, store, user), user)
+}
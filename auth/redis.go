@@ -0,0 +1,282 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/revan730/gamedev-backend/types"
+)
+
+// legacyTokenLength is length of tokens issued by older builds,
+// 8 random bytes in padded base64
+const legacyTokenLength = 12
+
+// RedisTokenStore keeps tokens in redis. Token key is named after
+// token's hash and holds user's id and role as "<id>:<role>". Sessions of every user are also
+// listed in a hash by token hash, for listing and revocation.
+//
+// Older builds kept raw tokens as keys holding user's id. Such token is
+// moved to a key named after its hash and listed in user's sessions
+// once it's resolved, so it can be revoked like any other. Legacy tokens
+// which weren't resolved before user's sessions were revoked are refused
+type RedisTokenStore struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func NewRedisTokenStore(client *redis.Client, ttl time.Duration) *RedisTokenStore {
+	return &RedisTokenStore{
+		client: client,
+		ttl:    ttl,
+	}
+}
+
+// tokenKey returns key holding id and role of token's user
+func tokenKey(tokenHash string) string {
+	return "token:" + tokenHash
+}
+
+// sessionsKey returns key of hash with user's sessions by token hash
+func sessionsKey(userId int64) string {
+	return fmt.Sprintf("sessions:%d", userId)
+}
+
+// legacyRevokedKey returns key which is set when every session of user is
+// revoked. Legacy tokens were all issued before that, so they are refused
+func legacyRevokedKey(userId int64) string {
+	return fmt.Sprintf("legacy-revoked:%d", userId)
+}
+
+// isLegacyToken checks whether token may be one issued by older builds,
+// so that nothing but such tokens is looked up by raw key
+func isLegacyToken(token string) bool {
+	if len(token) != legacyTokenLength {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(token)
+	return err == nil && len(decoded) == 8
+}
+
+func (r *RedisTokenStore) Issue(user *types.User) (string, error) {
+	session, token, err := newSession(user, r.ttl)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	_, err = r.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(tokenKey(session.TokenHash), fmt.Sprintf("%d:%s", user.Id, user.Role), r.ttl)
+		pipe.HSet(sessionsKey(user.Id), session.TokenHash, data)
+		pipe.Expire(sessionsKey(user.Id), r.ttl)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// getIdentity reads identity from token key
+func (r *RedisTokenStore) getIdentity(key string) (Identity, error) {
+	value, err := r.client.Get(key).Result()
+	if err == redis.Nil {
+		return Identity{}, ErrInvalidToken
+	}
+	if err != nil {
+		return Identity{}, err
+	}
+	return parseIdentity(value)
+}
+
+// parseIdentity parses value of token key, tokens issued
+// by older builds hold only user's id and have player role
+func parseIdentity(value string) (Identity, error) {
+	parts := strings.SplitN(value, ":", 2)
+	userId, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return Identity{}, ErrInvalidToken
+	}
+	identity := Identity{UserId: userId, Role: types.RolePlayer}
+	if len(parts) == 2 {
+		identity.Role = parts[1]
+	}
+	return identity, nil
+}
+
+func (r *RedisTokenStore) Resolve(token string) (Identity, error) {
+	identity, err := r.getIdentity(tokenKey(HashToken(token)))
+	if err == ErrInvalidToken && isLegacyToken(token) {
+		return r.migrateLegacy(token)
+	}
+	return identity, err
+}
+
+// migrateLegacy moves token issued by older build to a key
+// named after its hash and adds it to user's sessions
+func (r *RedisTokenStore) migrateLegacy(token string) (Identity, error) {
+	var value *redis.StringCmd
+	var ttl *redis.DurationCmd
+	_, err := r.client.Pipelined(func(pipe redis.Pipeliner) error {
+		value = pipe.Get(token)
+		ttl = pipe.PTTL(token)
+		return nil
+	})
+	if err == redis.Nil {
+		return Identity{}, ErrInvalidToken
+	}
+	if err != nil {
+		return Identity{}, err
+	}
+	identity, err := parseIdentity(value.Val())
+	if err != nil {
+		return Identity{}, err
+	}
+	revoked, err := r.client.Exists(legacyRevokedKey(identity.UserId)).Result()
+	if err != nil {
+		return Identity{}, err
+	}
+	if revoked != 0 || ttl.Val() <= 0 {
+		r.client.Del(token)
+		return Identity{}, ErrInvalidToken
+	}
+	id, err := newSessionId()
+	if err != nil {
+		return Identity{}, err
+	}
+	now := time.Now()
+	session := Session{
+		Id:        id,
+		TokenHash: HashToken(token),
+		UserId:    identity.UserId,
+		Role:      identity.Role,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl.Val()),
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return Identity{}, err
+	}
+	_, err = r.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(tokenKey(session.TokenHash), value.Val(), ttl.Val())
+		pipe.HSet(sessionsKey(identity.UserId), session.TokenHash, data)
+		pipe.Expire(sessionsKey(identity.UserId), r.ttl)
+		pipe.Del(token)
+		return nil
+	})
+	if err != nil {
+		return Identity{}, err
+	}
+	return identity, nil
+}
+
+func (r *RedisTokenStore) Refresh(token string, user *types.User) (string, error) {
+	identity, err := r.Resolve(token)
+	if err != nil {
+		return "", err
+	}
+	if identity.UserId != user.Id {
+		return "", ErrInvalidToken
+	}
+	fresh, err := r.Issue(user)
+	if err != nil {
+		return "", err
+	}
+	return fresh, r.Revoke(token)
+}
+
+func (r *RedisTokenStore) Revoke(token string) error {
+	identity, err := r.Resolve(token)
+	if err == ErrInvalidToken {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	tokenHash := HashToken(token)
+	_, err = r.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(tokenKey(tokenHash))
+		pipe.HDel(sessionsKey(identity.UserId), tokenHash)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisTokenStore) RevokeSession(userId int64, sessionId string) (*Session, error) {
+	sessions, err := r.List(userId)
+	if err != nil {
+		return nil, err
+	}
+	for _, session := range sessions {
+		if session.Id != sessionId {
+			continue
+		}
+		_, err = r.client.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.Del(tokenKey(session.TokenHash))
+			pipe.HDel(sessionsKey(userId), session.TokenHash)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &session, nil
+	}
+	return nil, nil
+}
+
+func (r *RedisTokenStore) RevokeAll(userId int64) error {
+	hashes, err := r.client.HKeys(sessionsKey(userId)).Result()
+	if err != nil {
+		return err
+	}
+	_, err = r.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		for _, tokenHash := range hashes {
+			pipe.Del(tokenKey(tokenHash))
+		}
+		pipe.Del(sessionsKey(userId))
+		pipe.Set(legacyRevokedKey(userId), 1, TokenTTL)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisTokenStore) List(userId int64) ([]Session, error) {
+	entries, err := r.client.HGetAll(sessionsKey(userId)).Result()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var sessions []Session
+	var stale []string
+	for tokenHash, data := range entries {
+		var session Session
+		if err := json.Unmarshal([]byte(data), &session); err != nil || session.expired(now) {
+			stale = append(stale, tokenHash)
+			continue
+		}
+		// Token key may be gone while hash entry lives on
+		exists, err := r.client.Exists(tokenKey(tokenHash)).Result()
+		if err != nil {
+			return nil, err
+		}
+		if exists == 0 {
+			stale = append(stale, tokenHash)
+			continue
+		}
+		session.TokenHash = tokenHash
+		session.UserId = userId
+		sessions = append(sessions, session)
+	}
+	if len(stale) != 0 {
+		r.client.HDel(sessionsKey(userId), stale...)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedAt.Before(sessions[j].CreatedAt) })
+	return sessions, nil
+}
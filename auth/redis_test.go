@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/revan730/gamedev-backend/types"
+)
+
+func TestIsLegacyToken(t *testing.T) {
+	cases := map[string]bool{
+		"AAECAwQFBgc=":   true,
+		"q+/zLk9Xb1I=":   true,
+		"sessions:123":   false,
+		"token:abcdefg":  false,
+		"AAECAwQFBgcI":   false,
+		"AAECAwQFBg==":   false,
+		"AAECAwQFBgc":    false,
+		"AAECAwQFBgc=\n": false,
+	}
+	for token, legacy := range cases {
+		if isLegacyToken(token) != legacy {
+			t.Errorf("%q: expected legacy %v", token, legacy)
+		}
+	}
+}
+
+// newTestRedisStore returns store on redis set by TEST_REDIS_ADDR,
+// tests use ids of users which don't exist in a real database
+func newTestRedisStore(t *testing.T) (*RedisTokenStore, *redis.Client) {
+	addr := os.Getenv("TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("TEST_REDIS_ADDR isn't set")
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	t.Cleanup(func() { client.Close() })
+	return NewRedisTokenStore(client, time.Hour), client
+}
+
+// setLegacyToken stores token the way older builds did
+func setLegacyToken(t *testing.T, client *redis.Client, userId int64) string {
+	tokenBytes := make([]byte, 8)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		t.Fatal(err)
+	}
+	token := base64.StdEncoding.EncodeToString(tokenBytes)
+	if err := client.Set(token, userId, TokenTTL).Err(); err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestRedisLegacyTokens(t *testing.T) {
+	store, client := newTestRedisStore(t)
+	user := &types.User{Id: -time.Now().UnixNano(), Role: types.RolePlayer}
+	legacy := setLegacyToken(t, client, user.Id)
+	expectIdentity(t, store, legacy, user)
+	if exists, _ := client.Exists(legacy).Result(); exists != 0 {
+		t.Error("legacy token wasn't moved from raw key")
+	}
+	expectIdentity(t, store, legacy, user)
+	sessions, err := store.List(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].TokenHash != HashToken(legacy) {
+		t.Fatalf("legacy token isn't listed: %+v", sessions)
+	}
+	unresolved := setLegacyToken(t, client, user.Id)
+	if err := store.RevokeAll(user.Id); err != nil {
+		t.Fatal(err)
+	}
+	expectInvalid(t, store, legacy)
+	expectInvalid(t, store, unresolved)
+	expectIdentity(t, store, issueToken(t, store, user), user)
+}
+
+func TestRedisRevokeLegacyToken(t *testing.T) {
+	store, client := newTestRedisStore(t)
+	user := &types.User{Id: -time.Now().UnixNano(), Role: types.RolePlayer}
+	legacy := setLegacyToken(t, client, user.Id)
+	if err := store.Revoke(legacy); err != nil {
+		t.Fatal(err)
+	}
+	expectInvalid(t, store, legacy)
+	if sessions, _ := store.List(user.Id); len(sessions) != 0 {
+		t.Errorf("revoked legacy token is listed: %+v", sessions)
+	}
+}
@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/revan730/gamedev-backend/types"
+)
+
+// TokenTTL is how long issued token stays valid
+const TokenTTL = 6 * time.Hour
+
+// tokenSize is number of random bytes in token
+const tokenSize = 32
+
+var (
+	// ErrInvalidToken is returned for unknown, expired or revoked tokens
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrNotSupported is returned by token stores that
+	// can't do requested operation
+	ErrNotSupported = errors.New("not supported by token store")
+)
+
+// Identity is user token was issued to, with role
+// user had at the moment
+type Identity struct {
+	UserId int64
+	Role   string
+}
+
+// Session describes single issued token
+type Session struct {
+	// Id identifies session without revealing its token
+	Id        string    `json:"id"`
+	TokenHash string    `json:"-"`
+	UserId    int64     `json:"-"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func (s Session) identity() Identity {
+	return Identity{UserId: s.UserId, Role: s.Role}
+}
+
+func (s Session) expired(now time.Time) bool {
+	return now.After(s.ExpiresAt)
+}
+
+// TokenStore issues and keeps track of user's auth tokens
+type TokenStore interface {
+	// Issue creates new token for user
+	Issue(user *types.User) (string, error)
+	// Resolve returns user token was issued to
+	Resolve(token string) (Identity, error)
+	// Refresh replaces token with a new one issued to user,
+	// who must be the one token was issued to
+	Refresh(token string, user *types.User) (string, error)
+	// Revoke makes token invalid
+	Revoke(token string) error
+	// RevokeSession makes token of user's session invalid,
+	// returning revoked session or nil if there is no such session
+	RevokeSession(userId int64, sessionId string) (*Session, error)
+	// RevokeAll makes every token of user invalid
+	RevokeAll(userId int64) error
+	// List returns active sessions of user
+	List(userId int64) ([]Session, error)
+}
+
+// HashToken returns hash tokens are stored by,
+// so stored sessions can't be used to log in
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newToken() (string, error) {
+	tokenBytes := make([]byte, tokenSize)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(tokenBytes), nil
+}
+
+func newSessionId() (string, error) {
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(idBytes), nil
+}
+
+// newSession returns session of user along with its token
+func newSession(user *types.User, ttl time.Duration) (Session, string, error) {
+	token, err := newToken()
+	if err != nil {
+		return Session{}, "", err
+	}
+	id, err := newSessionId()
+	if err != nil {
+		return Session{}, "", err
+	}
+	now := time.Now()
+	session := Session{
+		Id:        id,
+		TokenHash: HashToken(token),
+		UserId:    user.Id,
+		Role:      user.Role,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	return session, token, nil
+}
@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/revan730/gamedev-backend/auth"
+	"github.com/spf13/cobra"
+)
+
+var (
+	keysDir string
+	keyAlg  string
+)
+
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Manage JWT keys",
+}
+
+var keysGenerateCmd = &cobra.Command{
+	Use:   "generate <kid>",
+	Short: "Generate new JWT key",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		path, err := auth.GenerateKeyFile(keysDir, args[0], keyAlg)
+		if err != nil {
+			exitWithError("Failed to generate key", err)
+		}
+		fmt.Println("Key written to", path)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(keysCmd)
+	keysCmd.AddCommand(keysGenerateCmd)
+	keysGenerateCmd.Flags().StringVar(&keysDir, "dir", "keys",
+		"Set directory to write key to")
+	keysGenerateCmd.Flags().StringVar(&keyAlg, "alg", auth.AlgEdDSA,
+		"Set key algorithm (HS256 or EdDSA)")
+}
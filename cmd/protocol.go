@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/revan730/gamedev-backend/src"
+	"github.com/spf13/cobra"
+)
+
+var protocolCmd = &cobra.Command{
+	Use:   "protocol",
+	Short: "Websocket protocol tools",
+}
+
+var protocolSchemaCmd = &cobra.Command{
+	Use:   "schema [file]",
+	Short: "Write JSON Schema of websocket messages to file or stdout",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		schema, err := src.ProtocolSchema()
+		if err != nil {
+			exitWithError("Failed to generate schema", err)
+		}
+		if len(args) == 0 {
+			fmt.Println(string(schema))
+			return
+		}
+		err = ioutil.WriteFile(args[0], append(schema, '\n'), 0644)
+		if err != nil {
+			exitWithError("Failed to write schema", err)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(protocolCmd)
+	protocolCmd.AddCommand(protocolSchemaCmd)
+}
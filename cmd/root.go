@@ -3,6 +3,7 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/revan730/gamedev-backend/src"
 	"github.com/spf13/cobra"
@@ -12,11 +13,21 @@ var (
 	logVerbose bool
 	serverPort int
 	dbAddr     string
-	db         string
+	dbName     string
 	dbUser     string
 	dbPass     string
 	redisAddr  string
 	redisPass  string
+	storage    string
+	storyFile  string
+	tokens     string
+	jwtKeys    string
+	jwtKeyId   string
+	denylist   string
+	sessions   string
+	autosave   time.Duration
+	cluster    bool
+	safePage   int64
 )
 
 var RootCmd = &cobra.Command{
@@ -31,15 +42,50 @@ var serveCmd = &cobra.Command{
 		config := &src.Config{
 			Port:          serverPort,
 			DBAddr:        dbAddr,
-			DB:            db,
+			DB:            dbName,
 			DBUser:        dbUser,
 			DBPassword:    dbPass,
 			RedisAddr:     redisAddr,
 			RedisPassword: redisPass,
+			Storage:       storage,
+			StoryFile:     storyFile,
+			Tokens:        tokens,
+			JWTKeysDir:    jwtKeys,
+			JWTKeyId:      jwtKeyId,
+			Denylist:      denylist,
+			SessionMode:   sessions,
+			Autosave:      autosave,
+			Cluster:       cluster,
+			SafePage:      safePage,
+		}
+		if storage != src.StoragePostgres && storage != src.StorageMemory {
+			fmt.Println("Unknown storage:", storage)
+			os.Exit(1)
+		}
+		if tokens != src.TokensRedis && tokens != src.TokensMemory && tokens != src.TokensJWT {
+			fmt.Println("Unknown token store:", tokens)
+			os.Exit(1)
+		}
+		if sessions != src.SessionsTakeover && sessions != src.SessionsShared {
+			fmt.Println("Unknown session mode:", sessions)
+			os.Exit(1)
+		}
+		if cluster && (storage == src.StorageMemory || tokens == src.TokensMemory ||
+			(tokens == src.TokensJWT && denylist == src.TokensMemory)) {
+			fmt.Println("Cluster requires shared storage and token store")
+			os.Exit(1)
+		}
+		if safePage <= 0 {
+			fmt.Println("Safe page id must be positive")
+			os.Exit(1)
 		}
 		logger := src.NewLogger(logVerbose)
-		server := src.NewServer(logger, config).Routes()
-		server.Run()
+		server, err := src.NewServer(logger, config)
+		if err != nil {
+			fmt.Println("Failed to start server:", err)
+			os.Exit(1)
+		}
+		server.Routes().Run()
 	},
 }
 
@@ -54,16 +100,36 @@ func init() {
 	RootCmd.AddCommand(serveCmd)
 	serveCmd.Flags().IntVarP(&serverPort, "port", "p", 8080,
 		"Application TCP port")
-	serveCmd.Flags().StringVarP(&dbAddr, "postgresAddr", "a",
+	RootCmd.PersistentFlags().StringVarP(&dbAddr, "postgresAddr", "a",
 		"postgres:5432", "Set PostsgreSQL address")
-	serveCmd.Flags().StringVarP(&db, "db", "d",
+	RootCmd.PersistentFlags().StringVarP(&dbName, "db", "d",
 		"fict", "Set PostgreSQL database to use")
-	serveCmd.Flags().StringVarP(&dbUser, "user", "u",
+	RootCmd.PersistentFlags().StringVarP(&dbUser, "user", "u",
 		"fict", "Set PostgreSQL user to use")
-	serveCmd.Flags().StringVarP(&dbPass, "pass", "c",
+	RootCmd.PersistentFlags().StringVarP(&dbPass, "pass", "c",
 		"fict", "Set PostgreSQL password to use")
 	serveCmd.Flags().StringVarP(&redisAddr, "redis", "r",
 		"redis:6379", "Set redis address")
 	serveCmd.Flags().StringVarP(&redisPass, "redispass", "b",
 		"", "Set redis password")
+	serveCmd.Flags().StringVarP(&storage, "storage", "s",
+		src.StoragePostgres, "Set storage backend (postgres or memory)")
+	serveCmd.Flags().StringVar(&storyFile, "story", "",
+		"Import story bundle on start")
+	serveCmd.Flags().StringVarP(&tokens, "tokens", "t",
+		src.TokensRedis, "Set token store backend (redis, memory or jwt)")
+	serveCmd.Flags().StringVar(&jwtKeys, "jwt-keys", "keys",
+		"Set directory with JWT keys")
+	serveCmd.Flags().StringVar(&jwtKeyId, "jwt-kid", "",
+		"Set id of JWT signing key, latest by name if empty")
+	serveCmd.Flags().StringVar(&denylist, "denylist", src.TokensRedis,
+		"Set JWT denylist backend (redis or memory)")
+	serveCmd.Flags().StringVar(&sessions, "sessions", src.SessionsTakeover,
+		"Set what happens when user connects again (takeover or shared)")
+	serveCmd.Flags().DurationVar(&autosave, "autosave", time.Minute,
+		"Set interval of saving changed sessions, 0 disables autosave")
+	serveCmd.Flags().BoolVar(&cluster, "cluster", false,
+		"Coordinate with other instances through redis")
+	serveCmd.Flags().Int64Var(&safePage, "safe-page", 1,
+		"Set page runs are moved to when their current page is missing")
 }
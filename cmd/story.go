@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/revan730/gamedev-backend/db"
+	"github.com/revan730/gamedev-backend/story"
+	"github.com/spf13/cobra"
+)
+
+var publishComment string
+
+var storyCmd = &cobra.Command{
+	Use:   "story",
+	Short: "Manage story content",
+}
+
+var storyImportCmd = &cobra.Command{
+	Use:   "import <file>",
+	Short: "Replace story in database with bundle from file",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		bundle, err := story.ReadFile(args[0])
+		if err != nil {
+			exitWithError("Failed to read bundle", err)
+		}
+		dbClient := newDBClient()
+		defer dbClient.Close()
+		err = dbClient.CreateSchema()
+		if err != nil {
+			exitWithError("Failed to create database schema", err)
+		}
+		report, err := story.Import(dbClient, bundle)
+		printReport(report)
+		if err != nil {
+			exitWithError("Failed to import story", err)
+		}
+		fmt.Printf("Imported %d pages\n", len(bundle.Pages))
+	},
+}
+
+var storyExportCmd = &cobra.Command{
+	Use:   "export <file>",
+	Short: "Save story from database to bundle file",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		dbClient := newDBClient()
+		defer dbClient.Close()
+		bundle, err := story.Export(dbClient)
+		if err != nil {
+			exitWithError("Failed to export story", err)
+		}
+		err = story.WriteFile(args[0], bundle)
+		if err != nil {
+			exitWithError("Failed to write bundle", err)
+		}
+		fmt.Printf("Exported %d pages\n", len(bundle.Pages))
+	},
+}
+
+var storyValidateCmd = &cobra.Command{
+	Use:   "validate [file]",
+	Short: "Check story graph from bundle file or database",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var bundle *story.Bundle
+		var err error
+		if len(args) == 1 {
+			bundle, err = story.ReadFile(args[0])
+		} else {
+			dbClient := newDBClient()
+			defer dbClient.Close()
+			bundle, err = story.Export(dbClient)
+		}
+		if err != nil {
+			exitWithError("Failed to load story", err)
+		}
+		report := story.Validate(bundle)
+		printReport(report)
+		if report.HasErrors() {
+			os.Exit(1)
+		}
+		fmt.Println("Story is valid")
+	},
+}
+
+var storyPublishCmd = &cobra.Command{
+	Use:   "publish",
+	Short: "Publish draft story as a new version, played by runs started after it",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		dbClient := newDBClient()
+		defer dbClient.Close()
+		err := dbClient.CreateSchema()
+		if err != nil {
+			exitWithError("Failed to create database schema", err)
+		}
+		version, report, err := story.Publish(dbClient, 0, publishComment)
+		printReport(report)
+		if err != nil {
+			exitWithError("Failed to publish story", err)
+		}
+		fmt.Printf("Published version %d\n", version.Id)
+	},
+}
+
+func printReport(report *story.Report) {
+	if report == nil {
+		return
+	}
+	for _, issue := range report.Issues {
+		fmt.Println(issue)
+	}
+}
+
+func newDBClient() *db.DatabaseClient {
+	return db.NewDBClient(dbAddr, dbName, dbUser, dbPass)
+}
+
+func exitWithError(msg string, err error) {
+	fmt.Printf("%s: %s\n", msg, err)
+	os.Exit(1)
+}
+
+func init() {
+	RootCmd.AddCommand(storyCmd)
+	storyCmd.AddCommand(storyImportCmd)
+	storyCmd.AddCommand(storyExportCmd)
+	storyCmd.AddCommand(storyValidateCmd)
+	storyCmd.AddCommand(storyPublishCmd)
+	storyPublishCmd.Flags().StringVar(&publishComment, "comment", "",
+		"Set comment of published version")
+}
@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/revan730/gamedev-backend/types"
+	"github.com/spf13/cobra"
+)
+
+var userCmd = &cobra.Command{
+	Use:   "user",
+	Short: "Manage users",
+}
+
+var userGrantRoleCmd = &cobra.Command{
+	Use:   "grant-role <login> <role>",
+	Short: "Give role to user, e.g. to bootstrap the first admin",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		login, role := args[0], args[1]
+		if types.IsRole(role) == false {
+			exitWithError("Failed to grant role", errors.New("unknown role "+role))
+		}
+		dbClient := newDBClient()
+		defer dbClient.Close()
+		user, err := dbClient.FindUser(login)
+		if err != nil {
+			exitWithError("Failed to find user", err)
+		}
+		err = dbClient.SetUserRole(user.Id, role)
+		if err != nil {
+			exitWithError("Failed to grant role", err)
+		}
+		fmt.Printf("User %s is now %s\n", login, role)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(userCmd)
+	userCmd.AddCommand(userGrantRoleCmd)
+}
@@ -0,0 +1,18 @@
+package db
+
+import (
+	"github.com/revan730/gamedev-backend/types"
+)
+
+func (d *DatabaseClient) CreateAuditEntry(entry *types.AuditEntry) error {
+	return d.pg.Insert(entry)
+}
+
+func (d *DatabaseClient) FindAuditLog(limit int) ([]types.AuditEntry, error) {
+	var entries []types.AuditEntry
+	err := d.pg.Model(&entries).
+		Order("id DESC").
+		Limit(limit).
+		Select()
+	return entries, err
+}
@@ -34,7 +34,12 @@ func (d *DatabaseClient) CreateSchema() error {
 		(*types.Page)(nil),
 		(*types.Answer)(nil),
 		(*types.Department)(nil),
-		(*types.Speciality)(nil)} {
+		(*types.Speciality)(nil),
+		(*types.SaveSlot)(nil),
+		(*types.HistoryEntry)(nil),
+		(*types.StoryEvent)(nil),
+		(*types.AuditEntry)(nil),
+		(*types.StoryVersion)(nil)} {
 		err := d.pg.CreateTable(model, &orm.CreateTableOptions{
 			IfNotExists: true,
 		})
@@ -42,9 +47,28 @@ func (d *DatabaseClient) CreateSchema() error {
 			return err
 		}
 	}
+	for _, query := range migrations {
+		_, err := d.pg.Exec(query)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// migrations bring tables created by older versions up to date,
+// every statement must be safe to run more than once
+var migrations = []string{
+	"CREATE UNIQUE INDEX IF NOT EXISTS save_slots_user_id_name_idx ON save_slots (user_id, name)",
+	"ALTER TABLE history_entries ADD COLUMN IF NOT EXISTS flags_removed text DEFAULT ''",
+	"ALTER TABLE answers ADD COLUMN IF NOT EXISTS condition text",
+	"ALTER TABLE users ADD COLUMN IF NOT EXISTS role text DEFAULT 'player'",
+	"ALTER TABLE users ADD COLUMN IF NOT EXISTS version bigint NOT NULL DEFAULT 0",
+	"ALTER TABLE users ADD COLUMN IF NOT EXISTS story_version bigint NOT NULL DEFAULT 0",
+	"ALTER TABLE save_slots ADD COLUMN IF NOT EXISTS story_version bigint NOT NULL DEFAULT 0",
+	"ALTER TABLE story_events ADD COLUMN IF NOT EXISTS story_version bigint NOT NULL DEFAULT 0",
+}
+
 func HashPassword(password string) (string, error) {
 	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 10)
 	return string(bytes), err
@@ -58,13 +82,52 @@ func (d *DatabaseClient) CreateUser(login, pass string) error {
 	user := &types.User{
 		Login:    login,
 		Password: hash,
+		Role:     types.RolePlayer,
+	}
+
+	err = d.pg.Insert(user)
+	if pgErr, ok := err.(pg.Error); ok && pgErr.IntegrityViolation() {
+		return ErrAlreadyExists
 	}
+	return err
+}
 
-	return d.pg.Insert(user)
+// notFound replaces go-pg's "no rows" error with ErrNotFound
+func notFound(err error) error {
+	if err == pg.ErrNoRows {
+		return ErrNotFound
+	}
+	return err
 }
 
 func (d *DatabaseClient) SaveUser(user *types.User) error {
-	return d.pg.Update(user)
+	version := user.Version
+	user.Version++
+	// Role isn't part of game state and is changed only by SetUserRole
+	res, err := d.pg.Model(user).
+		Column("current_page", "knowledge", "performance", "sober",
+			"prestige", "connections", "praepostor", "flags", "story_version", "version").
+		WherePK().
+		Where("version = ?", version).
+		Update()
+	if err == nil && res.RowsAffected() == 0 {
+		err = ErrConflict
+	}
+	if err != nil {
+		user.Version = version
+	}
+	return err
+}
+
+func (d *DatabaseClient) SetUserRole(userId int64, role string) error {
+	res, err := d.pg.Model((*types.User)(nil)).
+		Set("role = ?", role).
+		Where("id = ?", userId).
+		Update()
+	if err == nil && res.RowsAffected() == 0 {
+		err = ErrNotFound
+	}
+	return err
 }
 
 func (d *DatabaseClient) FindUser(login string) (*types.User, error) {
@@ -76,7 +139,7 @@ func (d *DatabaseClient) FindUser(login string) (*types.User, error) {
 		Where("login = ?", login).
 		Select()
 	if err != nil {
-		return nil, err
+		return nil, notFound(err)
 	} else {
 		return user, nil
 	}
@@ -89,7 +152,7 @@ func (d *DatabaseClient) FindUserById(userId int64) (*types.User, error) {
 
 	err := d.pg.Select(user)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err)
 	} else {
 		return user, nil
 	}
@@ -101,7 +164,7 @@ func (d *DatabaseClient) FindPageById(pageId int64) (*types.Page, error) {
 	}
 	err := d.pg.Select(page)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err)
 	} else {
 		return page, nil
 	}
@@ -113,7 +176,7 @@ func (d *DatabaseClient) FindAnswerById(answerId int64) (*types.Answer, error) {
 	}
 	err := d.pg.Select(answer)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err)
 	} else {
 		return answer, nil
 	}
@@ -0,0 +1,78 @@
+package db
+
+import (
+	"github.com/revan730/gamedev-backend/types"
+)
+
+func (d *DatabaseClient) CreateEvents(events []types.StoryEvent) error {
+	// go-pg refuses to bulk-insert empty slices
+	if len(events) == 0 {
+		return nil
+	}
+	return d.pg.Insert(&events)
+}
+
+// AnswerPickRates counts picks of every answer and
+// its share among answers picked on the same page
+func (d *DatabaseClient) AnswerPickRates() ([]types.AnswerStat, error) {
+	var stats []types.AnswerStat
+	_, err := d.pg.Query(&stats, `SELECT page_id, answer_id, count(*) AS picks
+		FROM story_events
+		WHERE kind IN (?, ?) AND answer_id <> 0
+		GROUP BY page_id, answer_id
+		ORDER BY page_id, answer_id`, types.EventMove, types.EventEnding)
+	if err != nil {
+		return nil, err
+	}
+	totals := make(map[int64]int)
+	for _, stat := range stats {
+		totals[stat.PageId] += stat.Picks
+	}
+	for i := range stats {
+		stats[i].Rate = float64(stats[i].Picks) / float64(totals[stats[i].PageId])
+	}
+	return stats, nil
+}
+
+// PageDropOffs counts how many times players left
+// every page by moving on and by disconnecting
+func (d *DatabaseClient) PageDropOffs() ([]types.PageDropOff, error) {
+	var dropOffs []types.PageDropOff
+	_, err := d.pg.Query(&dropOffs, `SELECT page_id,
+		count(*) FILTER (WHERE kind IN (?, ?)) AS moves,
+		count(*) FILTER (WHERE kind = ?) AS quits
+		FROM story_events
+		GROUP BY page_id
+		ORDER BY page_id`, types.EventMove, types.EventEnding, types.EventDisconnect)
+	if err != nil {
+		return nil, err
+	}
+	for i, dropOff := range dropOffs {
+		if total := dropOff.Moves + dropOff.Quits; total != 0 {
+			dropOffs[i].Rate = float64(dropOff.Quits) / float64(total)
+		}
+	}
+	return dropOffs, nil
+}
+
+// EndingDistribution counts how many runs finished
+// on every ending page
+func (d *DatabaseClient) EndingDistribution() ([]types.EndingStat, error) {
+	var endings []types.EndingStat
+	_, err := d.pg.Query(&endings, `SELECT page_id, count(*) AS count
+		FROM story_events
+		WHERE kind = ?
+		GROUP BY page_id
+		ORDER BY page_id`, types.EventEnding)
+	if err != nil {
+		return nil, err
+	}
+	total := 0
+	for _, ending := range endings {
+		total += ending.Count
+	}
+	for i := range endings {
+		endings[i].Share = float64(endings[i].Count) / float64(total)
+	}
+	return endings, nil
+}
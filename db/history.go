@@ -0,0 +1,38 @@
+package db
+
+import (
+	"github.com/go-pg/pg"
+	"github.com/revan730/gamedev-backend/types"
+)
+
+// SaveHistory replaces user's stored transition history
+func (d *DatabaseClient) SaveHistory(userId int64, history []types.HistoryEntry) error {
+	return d.pg.RunInTransaction(func(tx *pg.Tx) error {
+		_, err := tx.Model((*types.HistoryEntry)(nil)).
+			Where("user_id = ?", userId).
+			Delete()
+		if err != nil {
+			return err
+		}
+		if len(history) == 0 {
+			return nil
+		}
+		entries := make([]types.HistoryEntry, len(history))
+		for i, entry := range history {
+			entry.Id = 0
+			entry.UserId = userId
+			entries[i] = entry
+		}
+		return tx.Insert(&entries)
+	})
+}
+
+// FindUserHistory returns user's transition history, oldest first
+func (d *DatabaseClient) FindUserHistory(userId int64) ([]types.HistoryEntry, error) {
+	var history []types.HistoryEntry
+	err := d.pg.Model(&history).
+		Where("user_id = ?", userId).
+		Order("id ASC").
+		Select()
+	return history, err
+}
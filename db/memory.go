@@ -0,0 +1,522 @@
+package db
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/revan730/gamedev-backend/types"
+)
+
+// MemoryStore is a Store keeping everything in process memory,
+// meant for local development. Records are copied in and out,
+// so callers can't change stored data by accident
+type MemoryStore struct {
+	mu           sync.RWMutex
+	lastId       int64
+	users        map[int64]types.User
+	logins       map[string]int64
+	pages        map[int64]types.Page
+	answers      map[int64]types.Answer
+	departments  map[int64]types.Department
+	specialities map[int64]types.Speciality
+	// Save slots by user id and slot name
+	slots   map[int64]map[string]types.SaveSlot
+	history map[int64][]types.HistoryEntry
+	events  []types.StoryEvent
+	audit   []types.AuditEntry
+	// Published story versions, oldest first
+	versions []types.StoryVersion
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:        make(map[int64]types.User),
+		logins:       make(map[string]int64),
+		pages:        make(map[int64]types.Page),
+		answers:      make(map[int64]types.Answer),
+		departments:  make(map[int64]types.Department),
+		specialities: make(map[int64]types.Speciality),
+		slots:        make(map[int64]map[string]types.SaveSlot),
+		history:      make(map[int64][]types.HistoryEntry),
+	}
+}
+
+// nextId returns new id for record, ids are unique
+// across all records like with postgres serials
+func (m *MemoryStore) nextId() int64 {
+	m.lastId++
+	return m.lastId
+}
+
+func (m *MemoryStore) Close() {}
+
+func (m *MemoryStore) CreateSchema() error {
+	return nil
+}
+
+func (m *MemoryStore) CreateUser(login, pass string) error {
+	hash, err := HashPassword(pass)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.logins[login]; ok {
+		return ErrAlreadyExists
+	}
+	user := types.User{
+		Id:       m.nextId(),
+		Login:    login,
+		Password: hash,
+		Role:     types.RolePlayer,
+	}
+	user.Reset()
+	m.users[user.Id] = user
+	m.logins[login] = user.Id
+	return nil
+}
+
+func (m *MemoryStore) SaveUser(user *types.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.users[user.Id]
+	if ok == false {
+		return ErrNotFound
+	}
+	if stored.Version != user.Version {
+		return ErrConflict
+	}
+	user.Version++
+	saved := *user
+	saved.Login = stored.Login
+	saved.Password = stored.Password
+	saved.Role = stored.Role
+	m.users[user.Id] = saved
+	return nil
+}
+
+func (m *MemoryStore) SetUserRole(userId int64, role string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[userId]
+	if ok == false {
+		return ErrNotFound
+	}
+	user.Role = role
+	m.users[userId] = user
+	return nil
+}
+
+func (m *MemoryStore) FindUser(login string) (*types.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	userId, ok := m.logins[login]
+	if ok == false {
+		return nil, ErrNotFound
+	}
+	user := m.users[userId]
+	return &user, nil
+}
+
+func (m *MemoryStore) FindUserById(userId int64) (*types.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	user, ok := m.users[userId]
+	if ok == false {
+		return nil, ErrNotFound
+	}
+	return &user, nil
+}
+
+func (m *MemoryStore) FindPageById(pageId int64) (*types.Page, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	page, ok := m.pages[pageId]
+	if ok == false {
+		return nil, ErrNotFound
+	}
+	return &page, nil
+}
+
+func (m *MemoryStore) FindAnswerById(answerId int64) (*types.Answer, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	answer, ok := m.answers[answerId]
+	if ok == false {
+		return nil, ErrNotFound
+	}
+	return &answer, nil
+}
+
+func (m *MemoryStore) FindPageAnswers(pageId int64) ([]types.Answer, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var answers []types.Answer
+	for _, answer := range m.answers {
+		if answer.PageId == pageId {
+			answers = append(answers, answer)
+		}
+	}
+	sort.Slice(answers, func(i, j int) bool { return answers[i].Id < answers[j].Id })
+	return answers, nil
+}
+
+func (m *MemoryStore) FindAllPages() ([]types.Page, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var pages []types.Page
+	for _, page := range m.pages {
+		pages = append(pages, page)
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i].Id < pages[j].Id })
+	return pages, nil
+}
+
+func (m *MemoryStore) FindAllAnswers() ([]types.Answer, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var answers []types.Answer
+	for _, answer := range m.answers {
+		answers = append(answers, answer)
+	}
+	sort.Slice(answers, func(i, j int) bool { return answers[i].Id < answers[j].Id })
+	return answers, nil
+}
+
+func (m *MemoryStore) FindAllDepartments() ([]types.Department, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var deps []types.Department
+	for _, dep := range m.departments {
+		deps = append(deps, dep)
+	}
+	sort.Slice(deps, func(i, j int) bool { return deps[i].Id < deps[j].Id })
+	return deps, nil
+}
+
+func (m *MemoryStore) FindAllSpecialities() ([]types.Speciality, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var specs []types.Speciality
+	for _, spec := range m.specialities {
+		specs = append(specs, spec)
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Id < specs[j].Id })
+	return specs, nil
+}
+
+func (m *MemoryStore) ReplaceStory(deps []types.Department, specs []types.Speciality,
+	pages []types.Page, answers []types.Answer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.departments = make(map[int64]types.Department)
+	for _, dep := range deps {
+		m.departments[dep.Id] = dep
+	}
+	m.specialities = make(map[int64]types.Speciality)
+	for _, spec := range specs {
+		m.specialities[spec.Id] = spec
+	}
+	m.pages = make(map[int64]types.Page)
+	for _, page := range pages {
+		m.pages[page.Id] = page
+	}
+	m.answers = make(map[int64]types.Answer)
+	for _, answer := range answers {
+		m.answers[answer.Id] = answer
+	}
+	return nil
+}
+
+func (m *MemoryStore) EditStory(edit func(content *StoryContent) (*StoryChanges, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	content := &StoryContent{}
+	for _, dep := range m.departments {
+		content.Departments = append(content.Departments, dep)
+	}
+	for _, spec := range m.specialities {
+		content.Specialities = append(content.Specialities, spec)
+	}
+	for _, page := range m.pages {
+		content.Pages = append(content.Pages, page)
+	}
+	for _, answer := range m.answers {
+		content.Answers = append(content.Answers, answer)
+	}
+	sort.Slice(content.Departments, func(i, j int) bool {
+		return content.Departments[i].Id < content.Departments[j].Id
+	})
+	sort.Slice(content.Specialities, func(i, j int) bool {
+		return content.Specialities[i].Id < content.Specialities[j].Id
+	})
+	sort.Slice(content.Pages, func(i, j int) bool { return content.Pages[i].Id < content.Pages[j].Id })
+	sort.Slice(content.Answers, func(i, j int) bool { return content.Answers[i].Id < content.Answers[j].Id })
+	changes, err := edit(content)
+	if err != nil {
+		return err
+	}
+	for _, dep := range changes.Removed.Departments {
+		delete(m.departments, dep.Id)
+	}
+	for _, spec := range changes.Removed.Specialities {
+		delete(m.specialities, spec.Id)
+	}
+	for _, page := range changes.Removed.Pages {
+		delete(m.pages, page.Id)
+	}
+	for _, answer := range changes.Removed.Answers {
+		delete(m.answers, answer.Id)
+	}
+	for _, dep := range changes.Saved.Departments {
+		m.departments[dep.Id] = dep
+	}
+	for _, spec := range changes.Saved.Specialities {
+		m.specialities[spec.Id] = spec
+	}
+	for _, page := range changes.Saved.Pages {
+		m.pages[page.Id] = page
+	}
+	for _, answer := range changes.Saved.Answers {
+		m.answers[answer.Id] = answer
+	}
+	m.createAuditEntry(changes.Audit)
+	return nil
+}
+
+func (m *MemoryStore) SaveSlot(slot *types.SaveSlot, limit int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	userSlots, ok := m.slots[slot.UserId]
+	if ok == false {
+		userSlots = make(map[string]types.SaveSlot)
+		m.slots[slot.UserId] = userSlots
+	}
+	saved := *slot
+	if existing, ok := userSlots[slot.Name]; ok {
+		saved.Id = existing.Id
+		saved.CreatedAt = existing.CreatedAt
+	} else if len(userSlots) >= limit {
+		return ErrLimitReached
+	} else {
+		saved.Id = m.nextId()
+	}
+	userSlots[slot.Name] = saved
+	return nil
+}
+
+func (m *MemoryStore) FindUserSlots(userId int64) ([]types.SaveSlot, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var slots []types.SaveSlot
+	for _, slot := range m.slots[userId] {
+		slots = append(slots, slot)
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i].UpdatedAt.After(slots[j].UpdatedAt) })
+	return slots, nil
+}
+
+func (m *MemoryStore) FindSlot(userId int64, name string) (*types.SaveSlot, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	slot, ok := m.slots[userId][name]
+	if ok == false {
+		return nil, ErrNotFound
+	}
+	return &slot, nil
+}
+
+func (m *MemoryStore) DeleteSlot(userId int64, name string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.slots[userId][name]; ok == false {
+		return false, nil
+	}
+	delete(m.slots[userId], name)
+	return true, nil
+}
+
+func (m *MemoryStore) SaveHistory(userId int64, history []types.HistoryEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries := make([]types.HistoryEntry, len(history))
+	for i, entry := range history {
+		entry.Id = m.nextId()
+		entry.UserId = userId
+		entries[i] = entry
+	}
+	m.history[userId] = entries
+	return nil
+}
+
+func (m *MemoryStore) FindUserHistory(userId int64) ([]types.HistoryEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]types.HistoryEntry(nil), m.history[userId]...), nil
+}
+
+func (m *MemoryStore) CreateEvents(events []types.StoryEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, event := range events {
+		event.Id = m.nextId()
+		if event.CreatedAt.IsZero() {
+			event.CreatedAt = time.Now()
+		}
+		m.events = append(m.events, event)
+	}
+	return nil
+}
+
+func (m *MemoryStore) CreateAuditEntry(entry *types.AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.createAuditEntry(entry)
+	return nil
+}
+
+func (m *MemoryStore) createAuditEntry(entry *types.AuditEntry) {
+	entry.Id = m.nextId()
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now()
+	}
+	m.audit = append(m.audit, *entry)
+}
+
+func (m *MemoryStore) FindAuditLog(limit int) ([]types.AuditEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var entries []types.AuditEntry
+	for i := len(m.audit) - 1; i >= 0 && len(entries) < limit; i-- {
+		entries = append(entries, m.audit[i])
+	}
+	return entries, nil
+}
+
+func (m *MemoryStore) CreateStoryVersion(version *types.StoryVersion) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	version.Id = m.nextId()
+	if version.CreatedAt.IsZero() {
+		version.CreatedAt = time.Now()
+	}
+	m.versions = append(m.versions, *version)
+	return nil
+}
+
+func (m *MemoryStore) FindStoryVersion(versionId int64) (*types.StoryVersion, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, version := range m.versions {
+		if version.Id == versionId {
+			return &version, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *MemoryStore) FindStoryVersions() ([]types.StoryVersion, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	versions := make([]types.StoryVersion, 0, len(m.versions))
+	for i := len(m.versions) - 1; i >= 0; i-- {
+		version := m.versions[i]
+		version.Content = ""
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
+
+func (m *MemoryStore) LatestStoryVersion() (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.versions) == 0 {
+		return 0, nil
+	}
+	return m.versions[len(m.versions)-1].Id, nil
+}
+
+func isMove(kind string) bool {
+	return kind == types.EventMove || kind == types.EventEnding
+}
+
+func (m *MemoryStore) AnswerPickRates() ([]types.AnswerStat, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	type key struct{ pageId, answerId int64 }
+	picks := make(map[key]int)
+	totals := make(map[int64]int)
+	for _, event := range m.events {
+		if isMove(event.Kind) && event.AnswerId != 0 {
+			picks[key{event.PageId, event.AnswerId}]++
+			totals[event.PageId]++
+		}
+	}
+	var stats []types.AnswerStat
+	for k, count := range picks {
+		stats = append(stats, types.AnswerStat{
+			PageId:   k.pageId,
+			AnswerId: k.answerId,
+			Picks:    count,
+			Rate:     float64(count) / float64(totals[k.pageId]),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].PageId != stats[j].PageId {
+			return stats[i].PageId < stats[j].PageId
+		}
+		return stats[i].AnswerId < stats[j].AnswerId
+	})
+	return stats, nil
+}
+
+func (m *MemoryStore) PageDropOffs() ([]types.PageDropOff, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	pages := make(map[int64]*types.PageDropOff)
+	for _, event := range m.events {
+		dropOff, ok := pages[event.PageId]
+		if ok == false {
+			dropOff = &types.PageDropOff{PageId: event.PageId}
+			pages[event.PageId] = dropOff
+		}
+		if isMove(event.Kind) {
+			dropOff.Moves++
+		} else if event.Kind == types.EventDisconnect {
+			dropOff.Quits++
+		}
+	}
+	var dropOffs []types.PageDropOff
+	for _, dropOff := range pages {
+		if total := dropOff.Moves + dropOff.Quits; total != 0 {
+			dropOff.Rate = float64(dropOff.Quits) / float64(total)
+		}
+		dropOffs = append(dropOffs, *dropOff)
+	}
+	sort.Slice(dropOffs, func(i, j int) bool { return dropOffs[i].PageId < dropOffs[j].PageId })
+	return dropOffs, nil
+}
+
+func (m *MemoryStore) EndingDistribution() ([]types.EndingStat, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	counts := make(map[int64]int)
+	total := 0
+	for _, event := range m.events {
+		if event.Kind == types.EventEnding {
+			counts[event.PageId]++
+			total++
+		}
+	}
+	var endings []types.EndingStat
+	for pageId, count := range counts {
+		endings = append(endings, types.EndingStat{
+			PageId: pageId,
+			Count:  count,
+			Share:  float64(count) / float64(total),
+		})
+	}
+	sort.Slice(endings, func(i, j int) bool { return endings[i].PageId < endings[j].PageId })
+	return endings, nil
+}
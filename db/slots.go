@@ -0,0 +1,78 @@
+package db
+
+import (
+	"github.com/go-pg/pg"
+	"github.com/revan730/gamedev-backend/types"
+)
+
+// SaveSlot creates save slot or overwrites existing one
+// with the same name, keeping user within limit of slots
+func (d *DatabaseClient) SaveSlot(slot *types.SaveSlot, limit int) error {
+	return d.pg.RunInTransaction(func(tx *pg.Tx) error {
+		// Slots of user are saved one at a time, so that
+		// concurrent saves can't exceed the limit together
+		_, err := tx.Exec("SELECT id FROM users WHERE id = ? FOR UPDATE", slot.UserId)
+		if err != nil {
+			return err
+		}
+		others, err := tx.Model((*types.SaveSlot)(nil)).
+			Where("user_id = ?", slot.UserId).
+			Where("name != ?", slot.Name).
+			Count()
+		if err != nil {
+			return err
+		}
+		if others >= limit {
+			return ErrLimitReached
+		}
+		_, err = tx.Model(slot).
+			OnConflict("(user_id, name) DO UPDATE").
+			Set("current_page = EXCLUDED.current_page").
+			Set("knowledge = EXCLUDED.knowledge").
+			Set("performance = EXCLUDED.performance").
+			Set("sober = EXCLUDED.sober").
+			Set("prestige = EXCLUDED.prestige").
+			Set("connections = EXCLUDED.connections").
+			Set("praepostor = EXCLUDED.praepostor").
+			Set("flags = EXCLUDED.flags").
+			Set("updated_at = EXCLUDED.updated_at").
+			Set("story_version = EXCLUDED.story_version").
+			Insert()
+		return err
+	})
+}
+
+func (d *DatabaseClient) FindUserSlots(userId int64) ([]types.SaveSlot, error) {
+	var slots []types.SaveSlot
+	err := d.pg.Model(&slots).
+		Where("user_id = ?", userId).
+		Order("updated_at DESC").
+		Select()
+	return slots, err
+}
+
+func (d *DatabaseClient) FindSlot(userId int64, name string) (*types.SaveSlot, error) {
+	slot := &types.SaveSlot{}
+	err := d.pg.Model(slot).
+		Where("user_id = ?", userId).
+		Where("name = ?", name).
+		Select()
+	if err != nil {
+		return nil, notFound(err)
+	} else {
+		return slot, nil
+	}
+}
+
+// DeleteSlot removes user's save slot, returning
+// false if there was no such slot
+func (d *DatabaseClient) DeleteSlot(userId int64, name string) (bool, error) {
+	res, err := d.pg.Model((*types.SaveSlot)(nil)).
+		Where("user_id = ?", userId).
+		Where("name = ?", name).
+		Delete()
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() != 0, nil
+}
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/revan730/gamedev-backend/types"
+)
+
+var (
+	// ErrNotFound is returned when requested record doesn't exist
+	ErrNotFound = errors.New("record not found")
+	// ErrAlreadyExists is returned when record violates uniqueness
+	ErrAlreadyExists = errors.New("record already exists")
+	// ErrConflict is returned when record was changed
+	// by someone else since it was loaded
+	ErrConflict = errors.New("record was changed concurrently")
+	// ErrLimitReached is returned when record can't be
+	// created because user already has too many of them
+	ErrLimitReached = errors.New("limit of records reached")
+)
+
+// Store is a storage of users, their progress and story content
+type Store interface {
+	Close()
+	// CreateSchema prepares storage for use
+	CreateSchema() error
+
+	CreateUser(login, pass string) error
+	// SaveUser saves user if its version wasn't changed since
+	// it was loaded, bumping the version. ErrConflict is returned otherwise
+	SaveUser(user *types.User) error
+	FindUser(login string) (*types.User, error)
+	FindUserById(userId int64) (*types.User, error)
+	// SetUserRole changes user's role, ErrNotFound is
+	// returned if there is no such user
+	SetUserRole(userId int64, role string) error
+
+	FindPageById(pageId int64) (*types.Page, error)
+	FindAnswerById(answerId int64) (*types.Answer, error)
+	FindPageAnswers(pageId int64) ([]types.Answer, error)
+	FindAllPages() ([]types.Page, error)
+	FindAllAnswers() ([]types.Answer, error)
+	FindAllDepartments() ([]types.Department, error)
+	FindAllSpecialities() ([]types.Speciality, error)
+	ReplaceStory(deps []types.Department, specs []types.Speciality,
+		pages []types.Page, answers []types.Answer) error
+	// EditStory passes current story to edit and saves changes it returns
+	// along with their audit entry at once. Edits don't overlap, even ones
+	// made by other server instances. Nothing is saved if edit returns
+	// error, which is returned then. Edit must not call the store
+	EditStory(edit func(content *StoryContent) (*StoryChanges, error)) error
+
+	CreateStoryVersion(version *types.StoryVersion) error
+	FindStoryVersion(versionId int64) (*types.StoryVersion, error)
+	// FindStoryVersions lists published versions without
+	// their content, newest first
+	FindStoryVersions() ([]types.StoryVersion, error)
+	// LatestStoryVersion returns id of the newest
+	// version, 0 if nothing is published yet
+	LatestStoryVersion() (int64, error)
+
+	// SaveSlot creates save slot or overwrites existing one with
+	// the same name. New slot isn't created if user already has limit
+	// slots, ErrLimitReached is returned then
+	SaveSlot(slot *types.SaveSlot, limit int) error
+	FindUserSlots(userId int64) ([]types.SaveSlot, error)
+	FindSlot(userId int64, name string) (*types.SaveSlot, error)
+	DeleteSlot(userId int64, name string) (bool, error)
+
+	SaveHistory(userId int64, history []types.HistoryEntry) error
+	FindUserHistory(userId int64) ([]types.HistoryEntry, error)
+
+	// CreateEvents appends events to playthrough log at once
+	CreateEvents(events []types.StoryEvent) error
+	AnswerPickRates() ([]types.AnswerStat, error)
+	PageDropOffs() ([]types.PageDropOff, error)
+	EndingDistribution() ([]types.EndingStat, error)
+
+	CreateAuditEntry(entry *types.AuditEntry) error
+	// FindAuditLog returns up to limit latest entries, newest first
+	FindAuditLog(limit int) ([]types.AuditEntry, error)
+}
+
+var _ Store = (*DatabaseClient)(nil)
+var _ Store = (*MemoryStore)(nil)
@@ -0,0 +1,536 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/revan730/gamedev-backend/types"
+)
+
+// storeTests are run against every Store implementation,
+// tests mustn't depend on records created by other tests
+var storeTests = []struct {
+	name string
+	test func(t *testing.T, s Store)
+}{
+	{"users", testUsers},
+	{"save user", testSaveUser},
+	{"save conflict", testSaveConflict},
+	{"story", testStory},
+	{"edit story", testEditStory},
+	{"slots", testSlots},
+	{"slot limit", testSlotLimit},
+	{"history", testHistory},
+	{"versions", testVersions},
+	{"audit log", testAuditLog},
+	{"events", testEvents},
+}
+
+func testStore(t *testing.T, s Store) {
+	err := s.CreateSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range storeTests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.test(t, s)
+		})
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+// TestDatabaseClient runs the suite against postgres database set by
+// TEST_PG_ADDR, TEST_PG_DB, TEST_PG_USER and TEST_PG_PASS. Story in
+// the database is replaced, so don't point it to a real one
+func TestDatabaseClient(t *testing.T) {
+	addr := os.Getenv("TEST_PG_ADDR")
+	if addr == "" {
+		t.Skip("TEST_PG_ADDR isn't set")
+	}
+	d := NewDBClient(addr, os.Getenv("TEST_PG_DB"), os.Getenv("TEST_PG_USER"), os.Getenv("TEST_PG_PASS"))
+	defer d.Close()
+	testStore(t, d)
+}
+
+// newTestUser creates user with unique login and returns it
+func newTestUser(t *testing.T, s Store) *types.User {
+	login := fmt.Sprintf("player-%d", time.Now().UnixNano())
+	err := s.CreateUser(login, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := s.FindUser(login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func testUsers(t *testing.T, s Store) {
+	user := newTestUser(t, s)
+	if user.Password == "secret" {
+		t.Error("password is stored in plain text")
+	}
+	if user.Role != types.RolePlayer {
+		t.Errorf("expected role %s, got %s", types.RolePlayer, user.Role)
+	}
+	if err := s.CreateUser(user.Login, "other"); err != ErrAlreadyExists {
+		t.Errorf("expected ErrAlreadyExists on duplicate login, got %v", err)
+	}
+	byId, err := s.FindUserById(user.Id)
+	if err != nil || byId.Login != user.Login {
+		t.Errorf("user not found by id: %v", err)
+	}
+	if _, err := s.FindUser("missing-" + user.Login); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for missing login, got %v", err)
+	}
+	if _, err := s.FindUserById(-1); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for missing id, got %v", err)
+	}
+	if err := s.SetUserRole(-1, types.RoleAdmin); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound setting role of missing user, got %v", err)
+	}
+}
+
+func testSaveUser(t *testing.T, s Store) {
+	user := newTestUser(t, s)
+	version := user.Version
+	user.CurrentPage = 7
+	user.Knowledge = 3
+	user.Flags = "skipper"
+	// Only SetUserRole changes role
+	user.Role = types.RoleAdmin
+	err := s.SaveUser(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Version != version+1 {
+		t.Errorf("expected version %d, got %d", version+1, user.Version)
+	}
+	saved, err := s.FindUserById(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.CurrentPage != 7 || saved.Knowledge != 3 || saved.Flags != "skipper" {
+		t.Errorf("game state wasn't saved: %+v", saved)
+	}
+	if saved.Version != user.Version {
+		t.Errorf("expected stored version %d, got %d", user.Version, saved.Version)
+	}
+	if saved.Role != types.RolePlayer {
+		t.Errorf("SaveUser changed role to %s", saved.Role)
+	}
+	err = s.SetUserRole(user.Id, types.RoleWriter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, _ = s.FindUserById(user.Id)
+	if saved.Role != types.RoleWriter {
+		t.Errorf("expected role %s, got %s", types.RoleWriter, saved.Role)
+	}
+}
+
+// testSaveConflict saves user loaded by two sessions,
+// save of the one that loaded it earlier must fail
+func testSaveConflict(t *testing.T, s Store) {
+	user := newTestUser(t, s)
+	first, _ := s.FindUserById(user.Id)
+	second, _ := s.FindUserById(user.Id)
+	first.Knowledge = 5
+	err := s.SaveUser(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.Knowledge = 9
+	version := second.Version
+	err = s.SaveUser(second)
+	if err != ErrConflict {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+	if second.Version != version {
+		t.Errorf("failed save changed version from %d to %d", version, second.Version)
+	}
+	saved, _ := s.FindUserById(user.Id)
+	if saved.Knowledge != 5 || saved.Version != first.Version {
+		t.Errorf("stale save overwrote user: knowledge %d, version %d", saved.Knowledge, saved.Version)
+	}
+}
+
+func testStory(t *testing.T, s Store) {
+	deps := []types.Department{{Id: 1, Title: "FICT"}}
+	specs := []types.Speciality{{Id: 1, Title: "Software engineering"}}
+	pages := []types.Page{
+		{Id: 1, NextPage: 2, Text: "First day"},
+		{Id: 2, IsQuestion: true, Dep: 1, Spec: 1, Text: "Go to the lecture?"},
+	}
+	answers := []types.Answer{
+		{Id: 1, PageId: 2, Text: "Sure", Knowledge: 1},
+		{Id: 2, PageId: 2, Text: "Nah", Sober: -1, Flags: "skipper", Condition: "true"},
+	}
+	err := s.ReplaceStory(deps, specs, pages, answers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := s.FindPageById(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *page != pages[1] {
+		t.Errorf("expected page %+v, got %+v", pages[1], *page)
+	}
+	if _, err := s.FindPageById(3); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for missing page, got %v", err)
+	}
+	answer, err := s.FindAnswerById(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *answer != answers[1] {
+		t.Errorf("expected answer %+v, got %+v", answers[1], *answer)
+	}
+	if _, err := s.FindAnswerById(3); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for missing answer, got %v", err)
+	}
+	pageAnswers, err := s.FindPageAnswers(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(pageAnswers, func(i, j int) bool { return pageAnswers[i].Id < pageAnswers[j].Id })
+	if len(pageAnswers) != 2 || pageAnswers[0] != answers[0] || pageAnswers[1] != answers[1] {
+		t.Errorf("expected answers %+v, got %+v", answers, pageAnswers)
+	}
+	allPages, _ := s.FindAllPages()
+	allAnswers, _ := s.FindAllAnswers()
+	allDeps, _ := s.FindAllDepartments()
+	allSpecs, _ := s.FindAllSpecialities()
+	if len(allPages) != 2 || len(allAnswers) != 2 || len(allDeps) != 1 || len(allSpecs) != 1 {
+		t.Errorf("expected 2 pages, 2 answers, 1 department and 1 speciality, got %d, %d, %d and %d",
+			len(allPages), len(allAnswers), len(allDeps), len(allSpecs))
+	}
+	// Story is replaced as a whole
+	err = s.ReplaceStory(nil, nil, pages[:1], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.FindPageById(2); err != ErrNotFound {
+		t.Errorf("page of replaced story is still there: %v", err)
+	}
+	if _, err := s.FindAnswerById(1); err != ErrNotFound {
+		t.Errorf("answer of replaced story is still there: %v", err)
+	}
+}
+
+func testEditStory(t *testing.T, s Store) {
+	pages := []types.Page{{Id: 1, NextPage: 2, Text: "First day"}, {Id: 2, Text: "Last day"}}
+	answers := []types.Answer{{Id: 1, PageId: 1, Text: "Sure"}}
+	err := s.ReplaceStory([]types.Department{{Id: 1, Title: "FICT"}}, nil, pages, answers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := newTestUser(t, s)
+	failed := errors.New("edit failed")
+	err = s.EditStory(func(content *StoryContent) (*StoryChanges, error) {
+		if len(content.Pages) != 2 || content.Pages[1] != pages[1] || len(content.Answers) != 1 {
+			t.Errorf("unexpected story content: %+v", content)
+		}
+		return nil, failed
+	})
+	if err != failed {
+		t.Errorf("expected error of edit, got %v", err)
+	}
+	changed := types.Page{Id: 2, Text: "Graduation"}
+	created := types.Page{Id: 3, Text: "Expelled"}
+	entry := &types.AuditEntry{UserId: user.Id, Login: user.Login, Action: "update", Kind: "page", RecordId: 2}
+	err = s.EditStory(func(content *StoryContent) (*StoryChanges, error) {
+		return &StoryChanges{
+			Saved:   StoryContent{Pages: []types.Page{changed, created}},
+			Removed: StoryContent{Departments: content.Departments, Answers: content.Answers},
+			Audit:   entry,
+		}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	allPages, _ := s.FindAllPages()
+	if len(allPages) != 3 || allPages[0] != pages[0] || allPages[1] != changed || allPages[2] != created {
+		t.Errorf("expected pages %+v, %+v and %+v, got %+v", pages[0], changed, created, allPages)
+	}
+	if allAnswers, _ := s.FindAllAnswers(); len(allAnswers) != 0 {
+		t.Errorf("removed answers are still there: %+v", allAnswers)
+	}
+	if allDeps, _ := s.FindAllDepartments(); len(allDeps) != 0 {
+		t.Errorf("removed departments are still there: %+v", allDeps)
+	}
+	entries, err := s.FindAuditLog(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Id != entry.Id || entries[0].UserId != user.Id {
+		t.Errorf("expected audit entry of edit, got %+v", entries)
+	}
+}
+
+func testSlots(t *testing.T, s Store) {
+	user := newTestUser(t, s)
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	for i, name := range []string{"before exam", "after party"} {
+		err := s.SaveSlot(&types.SaveSlot{UserId: user.Id, Name: name, CurrentPage: 2,
+			CreatedAt: now, UpdatedAt: now.Add(time.Duration(i) * time.Second)}, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Saving to existing slot overwrites it
+	err := s.SaveSlot(&types.SaveSlot{UserId: user.Id, Name: "before exam", CurrentPage: 5,
+		Knowledge: 2, CreatedAt: now, UpdatedAt: now.Add(2 * time.Second)}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slots, err := s.FindUserSlots(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slots) != 2 || slots[0].Name != "before exam" || slots[1].Name != "after party" {
+		t.Fatalf("expected 2 slots, most recently updated first, got %+v", slots)
+	}
+	slot, err := s.FindSlot(user.Id, "before exam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slot.CurrentPage != 5 || slot.Knowledge != 2 {
+		t.Errorf("slot wasn't overwritten: %+v", slot)
+	}
+	if _, err := s.FindSlot(user.Id, "missing"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for missing slot, got %v", err)
+	}
+	deleted, err := s.DeleteSlot(user.Id, "before exam")
+	if err != nil || deleted == false {
+		t.Errorf("slot wasn't deleted: %v", err)
+	}
+	deleted, err = s.DeleteSlot(user.Id, "before exam")
+	if err != nil || deleted {
+		t.Errorf("missing slot was deleted: %v", err)
+	}
+}
+
+// testSlotLimit saves slots concurrently, as several
+// tabs or nodes do, they mustn't exceed the limit together
+func testSlotLimit(t *testing.T, s Store) {
+	user := newTestUser(t, s)
+	const limit = 3
+	errs := make(chan error)
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			errs <- s.SaveSlot(&types.SaveSlot{UserId: user.Id, Name: fmt.Sprintf("slot %d", i),
+				CreatedAt: time.Now(), UpdatedAt: time.Now()}, limit)
+		}(i)
+	}
+	saved := 0
+	for i := 0; i < 8; i++ {
+		err := <-errs
+		if err == nil {
+			saved++
+		} else if err != ErrLimitReached {
+			t.Errorf("expected ErrLimitReached, got %v", err)
+		}
+	}
+	slots, err := s.FindUserSlots(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved != limit || len(slots) != limit {
+		t.Errorf("expected %d slots, %d were saved and %d are stored", limit, saved, len(slots))
+	}
+	// Existing slot is still overwritten at the limit
+	err = s.SaveSlot(&types.SaveSlot{UserId: user.Id, Name: slots[0].Name, CurrentPage: 4,
+		CreatedAt: time.Now(), UpdatedAt: time.Now()}, limit)
+	if err != nil {
+		t.Errorf("slot wasn't overwritten at the limit: %v", err)
+	}
+}
+
+func testHistory(t *testing.T, s Store) {
+	user := newTestUser(t, s)
+	history := []types.HistoryEntry{
+		{FromPage: 1, ToPage: 2},
+		{FromPage: 2, ToPage: 3, AnswerId: 1, Delta: types.Stats{Knowledge: 1}, FlagsAdded: "skipper"},
+	}
+	err := s.SaveHistory(user.Id, history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SaveHistory(user.Id, history[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := s.FindUserHistory(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0].ToPage != 3 || saved[0].FlagsAdded != "skipper" ||
+		saved[0].Delta.Knowledge != 1 {
+		t.Errorf("history wasn't replaced: %+v", saved)
+	}
+	err = s.SaveHistory(user.Id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, _ = s.FindUserHistory(user.Id)
+	if len(saved) != 0 {
+		t.Errorf("history wasn't cleared: %+v", saved)
+	}
+}
+
+func testVersions(t *testing.T, s Store) {
+	before, err := s.LatestStoryVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := &types.StoryVersion{Comment: "first", Content: `{"version":1}`}
+	second := &types.StoryVersion{Comment: "second", PublishedBy: 1, Content: `{"version":1,"pages":[]}`}
+	for _, version := range []*types.StoryVersion{first, second} {
+		err := s.CreateStoryVersion(version)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if first.Id <= before || second.Id <= first.Id {
+		t.Errorf("version ids don't grow: %d, %d after %d", first.Id, second.Id, before)
+	}
+	latest, err := s.LatestStoryVersion()
+	if err != nil || latest != second.Id {
+		t.Errorf("expected latest version %d, got %d (%v)", second.Id, latest, err)
+	}
+	found, err := s.FindStoryVersion(first.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Comment != "first" || found.Content != first.Content {
+		t.Errorf("expected version %+v, got %+v", first, found)
+	}
+	if _, err := s.FindStoryVersion(second.Id + 1000); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for missing version, got %v", err)
+	}
+	versions, err := s.FindStoryVersions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) < 2 || versions[0].Id != second.Id || versions[1].Id != first.Id {
+		t.Fatalf("expected versions newest first, got %+v", versions)
+	}
+	if versions[0].Content != "" {
+		t.Error("versions are listed with content")
+	}
+}
+
+func testAuditLog(t *testing.T, s Store) {
+	user := newTestUser(t, s)
+	for i, action := range []string{"create", "update"} {
+		err := s.CreateAuditEntry(&types.AuditEntry{UserId: user.Id, Login: user.Login,
+			Action: action, Kind: "page", RecordId: 1,
+			After:     map[string]interface{}{"text": fmt.Sprintf("text %d", i)},
+			CreatedAt: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := s.FindAuditLog(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Action != "update" || entries[0].After["text"] != "text 1" {
+		t.Errorf("expected the latest entry, got %+v", entries)
+	}
+}
+
+func testEvents(t *testing.T, s Store) {
+	user := newTestUser(t, s)
+	// Aggregates span every event, so pages are unique to the run
+	question := time.Now().UnixNano()
+	ending, lost := question+1, question+2
+	events := []types.StoryEvent{
+		{Kind: types.EventMove, PageId: question, AnswerId: 1},
+		{Kind: types.EventMove, PageId: question, AnswerId: 1},
+		{Kind: types.EventEnding, PageId: question, AnswerId: 2},
+		{Kind: types.EventDisconnect, PageId: question},
+		{Kind: types.EventEnding, PageId: ending},
+		{Kind: types.EventEnding, PageId: ending},
+		{Kind: types.EventDisconnect, PageId: lost},
+	}
+	for i := range events {
+		events[i].UserId = user.Id
+		events[i].SessionId = "session"
+	}
+	if err := s.CreateEvents(nil); err != nil {
+		t.Fatalf("empty batch: %v", err)
+	}
+	if err := s.CreateEvents(events); err != nil {
+		t.Fatal(err)
+	}
+
+	rates, err := s.AnswerPickRates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var picks []types.AnswerStat
+	for _, rate := range rates {
+		if rate.PageId == question {
+			picks = append(picks, rate)
+		}
+	}
+	if len(picks) != 2 || picks[0].AnswerId != 1 || picks[0].Picks != 2 || picks[1].Picks != 1 ||
+		closeTo(picks[0].Rate, 2.0/3) == false || closeTo(picks[1].Rate, 1.0/3) == false {
+		t.Errorf("unexpected pick rates %+v", picks)
+	}
+
+	dropOffs, err := s.PageDropOffs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[int64]types.PageDropOff)
+	for _, dropOff := range dropOffs {
+		found[dropOff.PageId] = dropOff
+	}
+	expected := map[int64]types.PageDropOff{
+		question: {PageId: question, Moves: 3, Quits: 1, Rate: 0.25},
+		ending:   {PageId: ending, Moves: 2, Quits: 0, Rate: 0},
+		lost:     {PageId: lost, Moves: 0, Quits: 1, Rate: 1},
+	}
+	for pageId, dropOff := range expected {
+		got := found[pageId]
+		if got.Moves != dropOff.Moves || got.Quits != dropOff.Quits || closeTo(got.Rate, dropOff.Rate) == false {
+			t.Errorf("expected drop-off %+v, got %+v", dropOff, got)
+		}
+	}
+
+	endings, err := s.EndingDistribution()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[int64]int)
+	total := 0
+	for _, stat := range endings {
+		counts[stat.PageId] = stat.Count
+		total += stat.Count
+	}
+	if counts[question] != 1 || counts[ending] != 2 || counts[lost] != 0 {
+		t.Errorf("unexpected ending counts %+v", endings)
+	}
+	for _, stat := range endings {
+		if closeTo(stat.Share, float64(stat.Count)/float64(total)) == false {
+			t.Errorf("ending %d has share %v of %d runs", stat.PageId, stat.Share, total)
+		}
+	}
+}
+
+func closeTo(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
@@ -0,0 +1,185 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/go-pg/pg"
+	"github.com/revan730/gamedev-backend/types"
+)
+
+// storyTables lists tables holding story content, in order
+// they are safe to be cleared
+var storyTables = []string{"answers", "pages", "departments", "specialities"}
+
+// storyLockKey is key of postgres advisory lock
+// held by story edits until they are committed
+const storyLockKey = 7301
+
+// StoryContent is the whole story graph as it's stored
+type StoryContent struct {
+	Departments  []types.Department
+	Specialities []types.Speciality
+	Pages        []types.Page
+	Answers      []types.Answer
+}
+
+// StoryChanges describes story edit: new and changed records to save,
+// records to remove (only their ids are used) and audit log entry
+type StoryChanges struct {
+	Saved   StoryContent
+	Removed StoryContent
+	Audit   *types.AuditEntry
+}
+
+// removedIds returns ids of removed records by table
+func (c *StoryChanges) removedIds() map[string][]int64 {
+	ids := make(map[string][]int64)
+	for _, answer := range c.Removed.Answers {
+		ids["answers"] = append(ids["answers"], answer.Id)
+	}
+	for _, page := range c.Removed.Pages {
+		ids["pages"] = append(ids["pages"], page.Id)
+	}
+	for _, dep := range c.Removed.Departments {
+		ids["departments"] = append(ids["departments"], dep.Id)
+	}
+	for _, spec := range c.Removed.Specialities {
+		ids["specialities"] = append(ids["specialities"], spec.Id)
+	}
+	return ids
+}
+
+func (d *DatabaseClient) FindAllPages() ([]types.Page, error) {
+	var pages []types.Page
+	err := d.pg.Model(&pages).Order("id ASC").Select()
+	return pages, err
+}
+
+func (d *DatabaseClient) FindAllAnswers() ([]types.Answer, error) {
+	var answers []types.Answer
+	err := d.pg.Model(&answers).Order("id ASC").Select()
+	return answers, err
+}
+
+func (d *DatabaseClient) FindAllDepartments() ([]types.Department, error) {
+	var deps []types.Department
+	err := d.pg.Model(&deps).Order("id ASC").Select()
+	return deps, err
+}
+
+func (d *DatabaseClient) FindAllSpecialities() ([]types.Speciality, error) {
+	var specs []types.Speciality
+	err := d.pg.Model(&specs).Order("id ASC").Select()
+	return specs, err
+}
+
+// ReplaceStory removes all story content (pages, answers, departments
+// and specialities) and inserts provided one in a single transaction,
+// keeping ids as they are
+func (d *DatabaseClient) ReplaceStory(deps []types.Department, specs []types.Speciality,
+	pages []types.Page, answers []types.Answer) error {
+	return d.pg.RunInTransaction(func(tx *pg.Tx) error {
+		for _, table := range storyTables {
+			_, err := tx.Exec(fmt.Sprintf("DELETE FROM %s", table))
+			if err != nil {
+				return err
+			}
+		}
+		// go-pg refuses to bulk-insert empty slices
+		if len(deps) != 0 {
+			if err := tx.Insert(&deps); err != nil {
+				return err
+			}
+		}
+		if len(specs) != 0 {
+			if err := tx.Insert(&specs); err != nil {
+				return err
+			}
+		}
+		if len(pages) != 0 {
+			if err := tx.Insert(&pages); err != nil {
+				return err
+			}
+		}
+		if len(answers) != 0 {
+			if err := tx.Insert(&answers); err != nil {
+				return err
+			}
+		}
+		return moveSequences(tx)
+	})
+}
+
+// moveSequences moves id sequences of story tables
+// past ids which were set explicitly
+func moveSequences(tx *pg.Tx) error {
+	for _, table := range storyTables {
+		_, err := tx.Exec(fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%[1]s', 'id'), "+
+			"COALESCE(MAX(id), 0) + 1, false) FROM %[1]s", table))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upsert inserts records of model, updating ones which already exist
+func upsert(tx *pg.Tx, model interface{}, count int) error {
+	// go-pg refuses to bulk-insert empty slices
+	if count == 0 {
+		return nil
+	}
+	_, err := tx.Model(model).OnConflict("(id) DO UPDATE").Insert()
+	return err
+}
+
+// EditStory reads story and applies changes made by edit in a single
+// transaction, holding advisory lock so edits made at the same time
+// by all server instances are applied one after another
+func (d *DatabaseClient) EditStory(edit func(content *StoryContent) (*StoryChanges, error)) error {
+	return d.pg.RunInTransaction(func(tx *pg.Tx) error {
+		_, err := tx.Exec("SELECT pg_advisory_xact_lock(?)", storyLockKey)
+		if err != nil {
+			return err
+		}
+		content := &StoryContent{}
+		for _, model := range []interface{}{&content.Departments, &content.Specialities,
+			&content.Pages, &content.Answers} {
+			err := tx.Model(model).Order("id ASC").Select()
+			if err != nil {
+				return err
+			}
+		}
+		changes, err := edit(content)
+		if err != nil {
+			return err
+		}
+		removed := changes.removedIds()
+		for _, table := range storyTables {
+			if len(removed[table]) == 0 {
+				continue
+			}
+			_, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE id IN (?)", table), pg.In(removed[table]))
+			if err != nil {
+				return err
+			}
+		}
+		saved := &changes.Saved
+		if err := upsert(tx, &saved.Departments, len(saved.Departments)); err != nil {
+			return err
+		}
+		if err := upsert(tx, &saved.Specialities, len(saved.Specialities)); err != nil {
+			return err
+		}
+		if err := upsert(tx, &saved.Pages, len(saved.Pages)); err != nil {
+			return err
+		}
+		if err := upsert(tx, &saved.Answers, len(saved.Answers)); err != nil {
+			return err
+		}
+		if err := moveSequences(tx); err != nil {
+			return err
+		}
+		return tx.Insert(changes.Audit)
+	})
+}
@@ -0,0 +1,38 @@
+package db
+
+import (
+	"github.com/go-pg/pg"
+	"github.com/revan730/gamedev-backend/types"
+)
+
+func (d *DatabaseClient) CreateStoryVersion(version *types.StoryVersion) error {
+	return d.pg.Insert(version)
+}
+
+func (d *DatabaseClient) FindStoryVersion(versionId int64) (*types.StoryVersion, error) {
+	version := &types.StoryVersion{
+		Id: versionId,
+	}
+	err := d.pg.Select(version)
+	if err != nil {
+		return nil, notFound(err)
+	} else {
+		return version, nil
+	}
+}
+
+func (d *DatabaseClient) FindStoryVersions() ([]types.StoryVersion, error) {
+	var versions []types.StoryVersion
+	err := d.pg.Model(&versions).
+		Column("id", "comment", "published_by", "created_at").
+		Order("id DESC").
+		Select()
+	return versions, err
+}
+
+func (d *DatabaseClient) LatestStoryVersion() (int64, error) {
+	var versionId int64
+	_, err := d.pg.QueryOne(pg.Scan(&versionId),
+		"SELECT COALESCE(MAX(id), 0) FROM story_versions")
+	return versionId, err
+}
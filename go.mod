@@ -22,4 +22,5 @@ require (
 	golang.org/x/crypto v0.0.0-20181015023909-0c41d7ab0a0e
 	golang.org/x/net v0.0.0-20181023162649-9b4f9f5ad519 // indirect
 	golang.org/x/text v0.3.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
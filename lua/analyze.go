@@ -0,0 +1,182 @@
+package lua
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/ast"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// Compile parses and compiles jumper script without running it
+func Compile(luaStr string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(strings.NewReader(luaStr), "<jumper>")
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(chunk, "<jumper>")
+}
+
+// errNotExpression is returned for conditions
+// which aren't a single expression
+var errNotExpression = errors.New("condition must be a single expression")
+
+// CompileCondition compiles answer visibility condition,
+// which is a single Lua expression
+func CompileCondition(condition string) (*lua.FunctionProto, error) {
+	// Newlines keep trailing comment from swallowing the parenthesis
+	chunk, err := parse.Parse(strings.NewReader("return (\n"+condition+"\n)"), "<condition>")
+	if err != nil {
+		return nil, err
+	}
+	// Parentheses can be closed and reopened by condition itself
+	if len(chunk) != 1 {
+		return nil, errNotExpression
+	}
+	if ret, ok := chunk[0].(*ast.ReturnStmt); ok == false || len(ret.Exprs) != 1 {
+		return nil, errNotExpression
+	}
+	return lua.Compile(chunk, "<condition>")
+}
+
+// JumpTargets compiles jumper script and collects page ids passed
+// to jump() as number literals. dynamic is true if jump() is also called
+// with something that can't be resolved without running the script
+func JumpTargets(luaStr string) (targets []int64, dynamic bool, err error) {
+	chunk, err := parse.Parse(strings.NewReader(luaStr), "<jumper>")
+	if err != nil {
+		return nil, false, err
+	}
+	if _, err = lua.Compile(chunk, "<jumper>"); err != nil {
+		return nil, false, err
+	}
+	w := &jumpWalker{}
+	w.stmts(chunk)
+	return w.targets, w.dynamic, nil
+}
+
+type jumpWalker struct {
+	targets []int64
+	dynamic bool
+}
+
+func (w *jumpWalker) stmts(stmts []ast.Stmt) {
+	for _, stmt := range stmts {
+		w.stmt(stmt)
+	}
+}
+
+func (w *jumpWalker) exprs(exprs []ast.Expr) {
+	for _, expr := range exprs {
+		w.expr(expr)
+	}
+}
+
+func (w *jumpWalker) stmt(stmt ast.Stmt) {
+	switch s := stmt.(type) {
+	case *ast.AssignStmt:
+		w.exprs(s.Lhs)
+		w.exprs(s.Rhs)
+	case *ast.LocalAssignStmt:
+		w.exprs(s.Exprs)
+	case *ast.FuncCallStmt:
+		w.expr(s.Expr)
+	case *ast.DoBlockStmt:
+		w.stmts(s.Stmts)
+	case *ast.WhileStmt:
+		w.expr(s.Condition)
+		w.stmts(s.Stmts)
+	case *ast.RepeatStmt:
+		w.expr(s.Condition)
+		w.stmts(s.Stmts)
+	case *ast.IfStmt:
+		w.expr(s.Condition)
+		w.stmts(s.Then)
+		w.stmts(s.Else)
+	case *ast.NumberForStmt:
+		w.expr(s.Init)
+		w.expr(s.Limit)
+		w.expr(s.Step)
+		w.stmts(s.Stmts)
+	case *ast.GenericForStmt:
+		w.exprs(s.Exprs)
+		w.stmts(s.Stmts)
+	case *ast.FuncDefStmt:
+		w.expr(s.Func)
+	case *ast.ReturnStmt:
+		w.exprs(s.Exprs)
+	}
+}
+
+func (w *jumpWalker) expr(expr ast.Expr) {
+	switch e := expr.(type) {
+	case *ast.FuncCallExpr:
+		if isJump(e.Func) {
+			w.jump(e.Args)
+		}
+		w.expr(e.Func)
+		w.expr(e.Receiver)
+		w.exprs(e.Args)
+	case *ast.AttrGetExpr:
+		w.expr(e.Object)
+		w.expr(e.Key)
+	case *ast.TableExpr:
+		for _, field := range e.Fields {
+			w.expr(field.Key)
+			w.expr(field.Value)
+		}
+	case *ast.LogicalOpExpr:
+		w.expr(e.Lhs)
+		w.expr(e.Rhs)
+	case *ast.RelationalOpExpr:
+		w.expr(e.Lhs)
+		w.expr(e.Rhs)
+	case *ast.StringConcatOpExpr:
+		w.expr(e.Lhs)
+		w.expr(e.Rhs)
+	case *ast.ArithmeticOpExpr:
+		w.expr(e.Lhs)
+		w.expr(e.Rhs)
+	case *ast.UnaryMinusOpExpr:
+		w.expr(e.Expr)
+	case *ast.UnaryNotOpExpr:
+		w.expr(e.Expr)
+	case *ast.UnaryLenOpExpr:
+		w.expr(e.Expr)
+	case *ast.FunctionExpr:
+		w.stmts(e.Stmts)
+	}
+}
+
+// isJump returns true if expression is either jump or game.jump
+func isJump(fn ast.Expr) bool {
+	switch f := fn.(type) {
+	case *ast.IdentExpr:
+		return f.Value == "jump"
+	case *ast.AttrGetExpr:
+		obj, ok := f.Object.(*ast.IdentExpr)
+		key, isStr := f.Key.(*ast.StringExpr)
+		return ok && isStr && obj.Value == APIModule && key.Value == "jump"
+	}
+	return false
+}
+
+func (w *jumpWalker) jump(args []ast.Expr) {
+	if len(args) == 0 {
+		w.dynamic = true
+		return
+	}
+	num, ok := args[0].(*ast.NumberExpr)
+	if ok == false {
+		w.dynamic = true
+		return
+	}
+	value, err := strconv.ParseFloat(num.Value, 64)
+	if err != nil {
+		w.dynamic = true
+		return
+	}
+	w.targets = append(w.targets, int64(value))
+}
@@ -0,0 +1,72 @@
+package lua
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestJumpTargets(tt *testing.T) {
+	cases := []struct {
+		name    string
+		script  string
+		targets []int64
+		dynamic bool
+	}{
+		{"literal", `jump(2)`, []int64{2}, false},
+		{"module function", `game.jump(2)`, []int64{2}, false},
+		{"branches", `if knowledge() > 2 then jump(2) else game.jump(3) end`, []int64{2, 3}, false},
+		{"loops", `while true do jump(2) end for i = 1, 2 do jump(3) end`, []int64{2, 3}, false},
+		{"function", `local f = function() jump(4) end f()`, []int64{4}, false},
+		{"argument of call", `print(jump(5))`, []int64{5}, false},
+		{"expression", `jump(2 + 1)`, nil, true},
+		{"variable", `local page = 2 jump(page)`, nil, true},
+		{"no arguments", `jump()`, nil, true},
+		{"mixed", `jump(2) jump(knowledge())`, []int64{2}, true},
+		{"other module", `other.jump(2)`, nil, false},
+		{"no jump", `addKnowledge(1)`, nil, false},
+	}
+	for _, tc := range cases {
+		tt.Run(tc.name, func(tt *testing.T) {
+			targets, dynamic, err := JumpTargets(tc.script)
+			if err != nil {
+				tt.Fatal(err)
+			}
+			if reflect.DeepEqual(targets, tc.targets) == false || dynamic != tc.dynamic {
+				tt.Errorf("expected %v dynamic %v, got %v dynamic %v",
+					tc.targets, tc.dynamic, targets, dynamic)
+			}
+		})
+	}
+}
+
+func TestJumpTargetsCompileError(tt *testing.T) {
+	for _, script := range []string{`jump(2`, `local = 1`, `jump(2) end`} {
+		if _, _, err := JumpTargets(script); err == nil {
+			tt.Errorf("%q compiled", script)
+		}
+	}
+}
+
+func TestCompileCondition(tt *testing.T) {
+	cases := []struct {
+		condition string
+		valid     bool
+	}{
+		{`flagCheck("skipper")`, true},
+		{`knowledge() > 2 and not flagCheck("lazy")`, true},
+		{`random(1, 2) == 1 -- half of the time`, true},
+		{"knowledge() >\n2", true},
+		{`1) while true do end return (1`, false},
+		{`1), (2`, false},
+		{`1) jump(2) return (1`, false},
+		{`jump(2)`, true},
+		{`knowledge() >`, false},
+		{``, false},
+	}
+	for _, tc := range cases {
+		_, err := CompileCondition(tc.condition)
+		if (err == nil) != tc.valid {
+			tt.Errorf("%q: expected valid %v, got %v", tc.condition, tc.valid, err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package lua
+
+import (
+	"strings"
+
+	t "github.com/revan730/gamedev-backend/types"
+	"github.com/yuin/gopher-lua"
+)
+
+// APIVersion is the version of jumper API, available
+// to scripts as game.version. It's bumped on breaking changes
+const APIVersion = 1
+
+// APIModule is the name of global table holding jumper API
+const APIModule = "game"
+
+// statGetter returns API function pushing user's stat
+func (s *jumperState) statGetter(stat func(u *t.User) *int) lua.LGFunction {
+	return func(L *lua.LState) int {
+		L.Push(lua.LNumber(*stat(s.env.User)))
+		return 1
+	}
+}
+
+// statAdder returns API function adding its argument to user's stat
+func (s *jumperState) statAdder(stat func(u *t.User) *int) lua.LGFunction {
+	return func(L *lua.LState) int {
+		diff := L.ToInt(1)
+		*stat(s.env.User) += diff
+		return 0
+	}
+}
+
+// register exposes jumper API as fields of APIModule table. Every
+// function is also set as a global, as scripts written before the
+// module was introduced call them this way
+func (s *jumperState) register() {
+	stats := map[string]func(u *t.User) *int{
+		"Knowledge":   func(u *t.User) *int { return &u.Knowledge },
+		"Performance": func(u *t.User) *int { return &u.Performance },
+		"Sober":       func(u *t.User) *int { return &u.Sober },
+		"Prestige":    func(u *t.User) *int { return &u.Prestige },
+		"Connections": func(u *t.User) *int { return &u.Connections },
+		"Praepostor":  func(u *t.User) *int { return &u.Praepostor },
+	}
+	funcs := map[string]lua.LGFunction{
+		"jump": func(L *lua.LState) int {
+			page := L.ToInt(1)
+			s.env.User.CurrentPage = int64(page)
+			return 0
+		},
+		"flagCheck": func(L *lua.LState) int {
+			flag := L.ToString(1)
+			L.Push(lua.LBool(s.env.User.IsFlagSet(flag)))
+			return 1
+		},
+		"setFlag": func(L *lua.LState) int {
+			flag := L.ToString(1)
+			s.env.User.SetFlag(flag)
+			return 0
+		},
+		"clearFlag": func(L *lua.LState) int {
+			flag := L.ToString(1)
+			s.env.User.RemoveFlag(flag)
+			return 0
+		},
+		"random": s.random,
+		"lastAnswer": func(L *lua.LState) int {
+			L.Push(lua.LNumber(s.env.LastAnswer))
+			return 1
+		},
+		"page": func(L *lua.LState) int {
+			page := L.NewTable()
+			if s.env.Page != nil {
+				L.SetField(page, "id", lua.LNumber(s.env.Page.Id))
+				L.SetField(page, "year", lua.LNumber(s.env.Page.Year))
+				L.SetField(page, "dep", lua.LNumber(s.env.Page.Dep))
+				L.SetField(page, "spec", lua.LNumber(s.env.Page.Spec))
+			}
+			L.Push(page)
+			return 1
+		},
+		"say": func(L *lua.LState) int {
+			text := L.ToString(1)
+			s.env.Output = append(s.env.Output, text)
+			return 0
+		},
+	}
+	for name, stat := range stats {
+		funcs[strings.ToLower(name)] = s.statGetter(stat)
+		funcs["add"+name] = s.statAdder(stat)
+	}
+
+	L := s.L
+	module := L.NewTable()
+	L.SetField(module, "version", lua.LNumber(APIVersion))
+	for name, fn := range funcs {
+		lfn := L.NewFunction(fn)
+		L.SetField(module, name, lfn)
+		L.SetGlobal(name, lfn)
+	}
+	L.SetGlobal(APIModule, module)
+	// Scripts get seeded random instead of the process wide one
+	if mathLib, ok := L.GetGlobal(lua.MathLibName).(*lua.LTable); ok {
+		L.SetField(mathLib, "random", L.NewFunction(s.random))
+		L.SetField(mathLib, "randomseed", lua.LNil)
+	}
+}
+
+// random works as math.random: without arguments it returns
+// number in [0, 1), with m in [1, m] and with m, n in [m, n]
+func (s *jumperState) random(L *lua.LState) int {
+	rnd := s.env.Rand
+	switch L.GetTop() {
+	case 0:
+		L.Push(lua.LNumber(rnd.Float64()))
+	case 1:
+		m := L.CheckInt(1)
+		if m < 1 {
+			L.ArgError(1, "interval is empty")
+		}
+		L.Push(lua.LNumber(rnd.Intn(m) + 1))
+	default:
+		m := L.CheckInt(1)
+		n := L.CheckInt(2)
+		if n < m {
+			L.ArgError(2, "interval is empty")
+		}
+		L.Push(lua.LNumber(m + rnd.Intn(n-m+1)))
+	}
+	return 1
+}
@@ -0,0 +1,77 @@
+package lua
+
+import (
+	"sync"
+
+	"github.com/yuin/gopher-lua"
+)
+
+type cachedProto struct {
+	source string
+	proto  *lua.FunctionProto
+}
+
+// scriptCache keeps compiled scripts by id of their owner
+type scriptCache struct {
+	sync.RWMutex
+	protos map[int64]cachedProto
+}
+
+func newScriptCache() *scriptCache {
+	return &scriptCache{protos: make(map[int64]cachedProto)}
+}
+
+// get returns compiled source, compiling it only if it's
+// not cached yet or source has changed since
+func (c *scriptCache) get(id int64, source string,
+	compile func(string) (*lua.FunctionProto, error)) (*lua.FunctionProto, error) {
+	c.RLock()
+	cached, ok := c.protos[id]
+	c.RUnlock()
+	if ok && cached.source == source {
+		return cached.proto, nil
+	}
+	proto, err := compile(source)
+	if err != nil {
+		return nil, err
+	}
+	c.Lock()
+	c.protos[id] = cachedProto{source: source, proto: proto}
+	c.Unlock()
+	return proto, nil
+}
+
+func (c *scriptCache) drop(id int64) {
+	c.Lock()
+	delete(c.protos, id)
+	c.Unlock()
+}
+
+var (
+	// Jumper scripts by page id
+	pageScripts = newScriptCache()
+	// Answer conditions by answer id
+	conditionScripts = newScriptCache()
+)
+
+// CompilePage returns compiled jumper script of page, compiling it only
+// if it's not cached yet or page's script has changed since
+func CompilePage(pageId int64, luaStr string) (*lua.FunctionProto, error) {
+	return pageScripts.get(pageId, luaStr, Compile)
+}
+
+// CompileAnswerCondition returns compiled visibility condition of answer,
+// cached the same way as in CompilePage
+func CompileAnswerCondition(answerId int64, condition string) (*lua.FunctionProto, error) {
+	return conditionScripts.get(answerId, condition, CompileCondition)
+}
+
+// Invalidate drops compiled script of page from cache
+func Invalidate(pageId int64) {
+	pageScripts.drop(pageId)
+}
+
+// InvalidateAnswer drops compiled condition of answer from cache
+func InvalidateAnswer(answerId int64) {
+	conditionScripts.drop(answerId)
+}
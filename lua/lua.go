@@ -1,109 +1,327 @@
 package lua
 
 import (
+	"context"
 	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
 
 	t "github.com/revan730/gamedev-backend/types"
 	"github.com/yuin/gopher-lua"
 )
 
+const (
+	// Time jumper script is allowed to run.
+	scriptTimeout = 100 * time.Millisecond
+
+	// Maximum depth of Lua calls.
+	callStackSize = 64
+
+	// Size of Lua value stack, it doesn't grow.
+	registrySize = 16 * 1024
+
+	// Maximum length of string produced by string.rep.
+	maxRepLength = 64 * 1024
+
+	// Maximum number of digits of width and precision in string.format.
+	maxFormatDigits = 2
+)
+
+// Kinds of jumper script failures
+const (
+	ErrSyntax  = "syntax"
+	ErrRuntime = "runtime"
+	ErrTimeout = "timeout"
+)
+
+// ScriptError is returned when jumper script
+// fails to compile or run
+type ScriptError struct {
+	Kind string
+	Err  error
+}
+
+func (e *ScriptError) Error() string {
+	return fmt.Sprintf("jumper script %s error: %s", e.Kind, strings.TrimSpace(e.Err.Error()))
+}
+
+// unsafeBaseFuncs are removed from base library as they give
+// access to file system or allow loading arbitrary code
+var unsafeBaseFuncs = []string{
+	"collectgarbage",
+	"dofile",
+	"getfenv",
+	"load",
+	"loadfile",
+	"loadstring",
+	"module",
+	"print",
+	"require",
+	"setfenv",
+}
+
+// Env is everything jumper script can see and change
+type Env struct {
+	User *t.User
+	Page *t.Page
+	// Id of the last answer picked in current run, 0 if there is none
+	LastAnswer int64
+	// Source of randomness, seeded per session so runs can be replayed
+	Rand *rand.Rand
+	// Text emitted by script, to be shown after the next page text
+	Output []string
+}
+
 type JumperInterpreter struct {
-	userData *t.User
+	env *Env
 }
 
-func NewInterpreter(userData *t.User) JumperInterpreter {
+func NewInterpreter(env *Env) JumperInterpreter {
 	return JumperInterpreter{
-		userData: userData,
+		env: env,
 	}
 }
 
-// DoString interpretes provided Lua script, returning
-// false in case of any errors
-func (i JumperInterpreter) DoString(luaStr string) bool {
-	knowledge := func(L *lua.LState) int {
-		L.Push(lua.LNumber(i.userData.Knowledge))
-		return 1
+// newSandbox returns Lua state with only safe parts of base, table,
+// string and math libraries opened. Memory of Lua states isn't
+// accounted, so it's not capped. Library functions which could make
+// a huge string in one call are limited, anything else has to loop
+// and is bounded by scriptTimeout
+func newSandbox() *lua.LState {
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:  true,
+		CallStackSize: callStackSize,
+		RegistrySize:  registrySize,
+	})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
 	}
-	addKnowledge := func(L *lua.LState) int {
-		diff := L.ToInt(1)
-		i.userData.Knowledge += diff
-		return 0
+	for _, name := range unsafeBaseFuncs {
+		L.SetGlobal(name, lua.LNil)
+	}
+	if strLib, ok := L.GetGlobal(lua.StringLibName).(*lua.LTable); ok {
+		L.SetField(strLib, "rep", L.NewFunction(limitedRep))
+		L.SetField(strLib, "format", L.NewFunction(limitedFormat))
 	}
-	performance := func(L *lua.LState) int {
-		L.Push(lua.LNumber(i.userData.Performance))
+	return L
+}
+
+// limitedRep is string.rep which refuses to
+// produce huge strings
+func limitedRep(L *lua.LState) int {
+	str := L.CheckString(1)
+	n := L.CheckInt(2)
+	if n < 0 {
+		L.Push(lua.LString(""))
 		return 1
 	}
-	addPerformance := func(L *lua.LState) int {
-		diff := L.ToInt(1)
-		i.userData.Performance += diff
+	if len(str) != 0 && n > maxRepLength/len(str) {
+		L.RaiseError("string.rep result is too long")
 		return 0
 	}
-	sober := func(L *lua.LState) int {
-		L.Push(lua.LNumber(i.userData.Sober))
-		return 1
+	L.Push(lua.LString(strings.Repeat(str, n)))
+	return 1
+}
+
+// limitedFormat is string.format which, like the one of Lua 5.1,
+// refuses widths and precisions over two digits
+func limitedFormat(L *lua.LState) int {
+	format := L.CheckString(1)
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		i++
+		for i < len(format) && strings.IndexByte("-+ #0", format[i]) != -1 {
+			i++
+		}
+		for _, part := range []string{"width", "precision"} {
+			if part == "precision" {
+				if i >= len(format) || format[i] != '.' {
+					break
+				}
+				i++
+			}
+			digits := 0
+			for i < len(format) && format[i] >= '0' && format[i] <= '9' {
+				digits++
+				i++
+			}
+			if digits > maxFormatDigits {
+				L.RaiseError("invalid format (%s too long)", part)
+				return 0
+			}
+		}
 	}
-	addSober := func(L *lua.LState) int {
-		diff := L.ToInt(1)
-		i.userData.Sober += diff
-		return 0
+	args := make([]interface{}, L.GetTop()-1)
+	for i := range args {
+		args[i] = L.Get(i + 2)
 	}
-	prestige := func(L *lua.LState) int {
-		L.Push(lua.LNumber(i.userData.Prestige))
-		return 1
+	specs := strings.Count(format, "%") - 2*strings.Count(format, "%%")
+	if specs < len(args) {
+		args = args[:specs]
 	}
-	addPrestige := func(L *lua.LState) int {
-		diff := L.ToInt(1)
-		i.userData.Prestige += diff
-		return 0
+	L.Push(lua.LString(fmt.Sprintf(format, args...)))
+	return 1
+}
+
+// jumperState is a sandbox with jumper API registered. API functions
+// work on env set for the duration of a single run
+type jumperState struct {
+	L *lua.LState
+	// Metatable of per-run environments, falls back to globals
+	envMeta *lua.LTable
+	// Metatables of read-only views of sharedTables
+	views map[string]*lua.LTable
+	env   *Env
+}
+
+// sharedTables are globals holding tables every run on the state
+// uses, scripts get read-only views of them, so that they can't
+// change API or libraries for later runs
+var sharedTables = []string{lua.StringLibName, lua.TabLibName, lua.MathLibName, APIModule}
+
+// protectedMeta returns metatable which scripts can neither get nor replace
+func protectedMeta(L *lua.LState, index lua.LValue) *lua.LTable {
+	meta := L.NewTable()
+	L.SetField(meta, "__index", index)
+	L.SetField(meta, "__metatable", lua.LFalse)
+	return meta
+}
+
+func readOnlyError(L *lua.LState) int {
+	L.RaiseError("attempt to change read-only table")
+	return 0
+}
+
+// statePool keeps initialised jumper states for reuse
+var statePool = sync.Pool{
+	New: func() interface{} {
+		return newJumperState()
+	},
+}
+
+func newJumperState() *jumperState {
+	s := &jumperState{L: newSandbox(), views: make(map[string]*lua.LTable)}
+	L := s.L
+	s.register()
+	s.envMeta = protectedMeta(L, L.G.Global)
+	for _, name := range sharedTables {
+		meta := protectedMeta(L, L.GetGlobal(name))
+		L.SetField(meta, "__newindex", L.NewFunction(readOnlyError))
+		s.views[name] = meta
 	}
-	connections := func(L *lua.LState) int {
-		L.Push(lua.LNumber(i.userData.Connections))
-		return 1
+	// Methods of strings are looked up in the string library
+	if strMeta, ok := L.GetMetatable(lua.LString("")).(*lua.LTable); ok {
+		L.SetField(strMeta, "__metatable", lua.LFalse)
 	}
-	praepostor := func(L *lua.LState) int {
-		L.Push(lua.LNumber(i.userData.Praepostor))
-		return 1
+	return s
+}
+
+// run executes compiled script against env. Globals set by script
+// go to a fresh environment, so they don't leak into the next run,
+// shared tables are seen through read-only views
+func (s *jumperState) run(proto *lua.FunctionProto, env *Env) (lua.LValue, error) {
+	if env.Rand == nil {
+		env.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
 	}
-	addConnections := func(L *lua.LState) int {
-		diff := L.ToInt(1)
-		i.userData.Connections += diff
-		return 0
+	s.env = env
+	defer func() {
+		s.env = nil
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), scriptTimeout)
+	defer cancel()
+	s.L.SetContext(ctx)
+	defer s.L.RemoveContext()
+	globals := s.L.NewTable()
+	s.L.SetMetatable(globals, s.envMeta)
+	s.L.SetField(globals, "_G", globals)
+	for name, meta := range s.views {
+		view := s.L.NewTable()
+		s.L.SetMetatable(view, meta)
+		s.L.SetField(globals, name, view)
 	}
-	jump := func(L *lua.LState) int {
-		page := L.ToInt(1)
-		i.userData.CurrentPage = int64(page)
-		return 0
+	fn := s.L.NewFunctionFromProto(proto)
+	fn.Env = globals
+	s.L.Push(fn)
+	if err := s.L.PCall(0, 1, nil); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, &ScriptError{Kind: ErrTimeout, Err: ctx.Err()}
+		}
+		return nil, &ScriptError{Kind: ErrRuntime, Err: err}
 	}
-	flagCheck := func(L *lua.LState) int {
-		flag := L.ToString(1)
-		checked := i.userData.IsFlagSet(flag)
-		L.Push(lua.LBool(checked))
-		return 1
+	ret := s.L.Get(-1)
+	s.L.Pop(1)
+	return ret, nil
+}
+
+// runProto executes compiled script on a pooled state, returning its
+// first return value. State is thrown away if script fails, as it
+// may be left inconsistent
+func (i JumperInterpreter) runProto(proto *lua.FunctionProto) (lua.LValue, error) {
+	s := statePool.Get().(*jumperState)
+	ret, err := s.run(proto, i.env)
+	if err != nil {
+		s.L.Close()
+		return nil, err
 	}
-	setFlag := func(L *lua.LState) int {
-		flag := L.ToString(1)
-		i.userData.SetFlag(flag)
-		return 0
+	statePool.Put(s)
+	return ret, nil
+}
+
+// DoString interpretes provided Lua script in a sandbox,
+// returning *ScriptError in case of any errors
+func (i JumperInterpreter) DoString(luaStr string) error {
+	proto, err := Compile(luaStr)
+	if err != nil {
+		return &ScriptError{Kind: ErrSyntax, Err: err}
+	}
+	_, err = i.runProto(proto)
+	return err
+}
+
+// DoPage runs jumper script of env's page, like DoString, but
+// reuses script compiled on previous runs
+func (i JumperInterpreter) DoPage() error {
+	page := i.env.Page
+	proto, err := CompilePage(page.Id, page.JumperLogic)
+	if err != nil {
+		return &ScriptError{Kind: ErrSyntax, Err: err}
+	}
+	_, err = i.runProto(proto)
+	return err
+}
+
+// IsAnswerVisible evaluates visibility condition of answer. Condition
+// can't change env's user as it's run against a copy. Answers without
+// condition are always visible
+func (i JumperInterpreter) IsAnswerVisible(answer *t.Answer) (bool, error) {
+	if answer.Condition == "" {
+		return true, nil
+	}
+	proto, err := CompileAnswerCondition(answer.Id, answer.Condition)
+	if err != nil {
+		return false, &ScriptError{Kind: ErrSyntax, Err: err}
+	}
+	user := *i.env.User
+	env := *i.env
+	env.User = &user
+	env.Output = nil
+	ret, err := NewInterpreter(&env).runProto(proto)
+	if err != nil {
+		return false, err
 	}
-	L := lua.NewState()
-	defer L.Close()
-	L.SetGlobal("knowledge", L.NewFunction(knowledge))
-	L.SetGlobal("performance", L.NewFunction(performance))
-	L.SetGlobal("sober", L.NewFunction(sober))
-	L.SetGlobal("prestige", L.NewFunction(prestige))
-	L.SetGlobal("connections", L.NewFunction(connections))
-	L.SetGlobal("praepostor", L.NewFunction(praepostor))
-	L.SetGlobal("addKnowledge", L.NewFunction(addKnowledge))
-	L.SetGlobal("addPerformance", L.NewFunction(addPerformance))
-	L.SetGlobal("addSober", L.NewFunction(addSober))
-	L.SetGlobal("addPrestige", L.NewFunction(addPrestige))
-	L.SetGlobal("addConnections", L.NewFunction(addConnections))
-	L.SetGlobal("jump", L.NewFunction(jump))
-	L.SetGlobal("flagCheck", L.NewFunction(flagCheck))
-	L.SetGlobal("setFlag", L.NewFunction(setFlag))
-	if err := L.DoString(luaStr); err != nil {
-		fmt.Println(err)
-		return false
-	}
-	return true
+	return lua.LVAsBool(ret), nil
 }
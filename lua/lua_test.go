@@ -0,0 +1,250 @@
+package lua
+
+import (
+	"math/rand"
+	"testing"
+
+	t "github.com/revan730/gamedev-backend/types"
+	"github.com/yuin/gopher-lua"
+)
+
+// benchScript sticks to globals of the API, which
+// DoString had before the game module
+const benchScript = `
+if flagCheck("skipper") and knowledge() < 10 then
+  addPrestige(-1)
+  jump(3)
+else
+  addKnowledge(1)
+  jump(2)
+end
+`
+
+func newEnv() *Env {
+	return &Env{
+		User: &t.User{},
+		Page: &t.Page{Id: 1, JumperLogic: benchScript},
+		Rand: rand.New(rand.NewSource(1)),
+	}
+}
+
+func runScript(tt *testing.T, s *jumperState, env *Env, script string) lua.LValue {
+	proto, err := Compile(script)
+	if err != nil {
+		tt.Fatalf("compile: %v", err)
+	}
+	ret, err := s.run(proto, env)
+	if err != nil {
+		tt.Fatalf("run: %v", err)
+	}
+	return ret
+}
+
+func TestSharedTablesAreReadOnly(tt *testing.T) {
+	s := newJumperState()
+	defer s.L.Close()
+	runScript(tt, s, newEnv(), `
+		pcall(function() string.rep = nil end)
+		pcall(function() table.insert = nil end)
+		pcall(function() math.floor = nil end)
+		pcall(function() game.addKnowledge = nil end)
+		pcall(function() getmetatable(_G).__index.jump = nil end)
+		pcall(function() getmetatable("").__index.rep = nil end)
+		pcall(function() setmetatable(_G, nil) end)
+		rawset(string, "upper", nil)
+		_G.jump = nil
+		addKnowledge = nil
+	`)
+	env := newEnv()
+	ret := runScript(tt, s, env, `
+		addKnowledge(1)
+		game.addKnowledge(1)
+		jump(math.floor(5.5))
+		return string.rep("a", 2) == "aa" and ("b"):rep(2) == "bb" and string.upper("c") == "C"
+	`)
+	if lua.LVAsBool(ret) == false {
+		tt.Error("libraries were changed by previous run")
+	}
+	if env.User.Knowledge != 2 || env.User.CurrentPage != 5 {
+		tt.Errorf("API was changed by previous run: knowledge %d, page %d",
+			env.User.Knowledge, env.User.CurrentPage)
+	}
+}
+
+func TestSharedTableAssignmentFails(tt *testing.T) {
+	s := newJumperState()
+	defer s.L.Close()
+	proto, err := Compile(`game.jump = nil`)
+	if err != nil {
+		tt.Fatal(err)
+	}
+	_, err = s.run(proto, newEnv())
+	if scriptErr, ok := err.(*ScriptError); ok == false || scriptErr.Kind != ErrRuntime {
+		tt.Errorf("expected runtime error, got %v", err)
+	}
+}
+
+// baselineDoString is DoString as it was before sandboxing, caching
+// and pooling: a new state with every library open and API
+// closures registered on each call
+func baselineDoString(userData *t.User, luaStr string) error {
+	knowledge := func(L *lua.LState) int {
+		L.Push(lua.LNumber(userData.Knowledge))
+		return 1
+	}
+	addKnowledge := func(L *lua.LState) int {
+		diff := L.ToInt(1)
+		userData.Knowledge += diff
+		return 0
+	}
+	performance := func(L *lua.LState) int {
+		L.Push(lua.LNumber(userData.Performance))
+		return 1
+	}
+	addPerformance := func(L *lua.LState) int {
+		diff := L.ToInt(1)
+		userData.Performance += diff
+		return 0
+	}
+	sober := func(L *lua.LState) int {
+		L.Push(lua.LNumber(userData.Sober))
+		return 1
+	}
+	addSober := func(L *lua.LState) int {
+		diff := L.ToInt(1)
+		userData.Sober += diff
+		return 0
+	}
+	prestige := func(L *lua.LState) int {
+		L.Push(lua.LNumber(userData.Prestige))
+		return 1
+	}
+	addPrestige := func(L *lua.LState) int {
+		diff := L.ToInt(1)
+		userData.Prestige += diff
+		return 0
+	}
+	connections := func(L *lua.LState) int {
+		L.Push(lua.LNumber(userData.Connections))
+		return 1
+	}
+	praepostor := func(L *lua.LState) int {
+		L.Push(lua.LNumber(userData.Praepostor))
+		return 1
+	}
+	addConnections := func(L *lua.LState) int {
+		diff := L.ToInt(1)
+		userData.Connections += diff
+		return 0
+	}
+	jump := func(L *lua.LState) int {
+		page := L.ToInt(1)
+		userData.CurrentPage = int64(page)
+		return 0
+	}
+	flagCheck := func(L *lua.LState) int {
+		flag := L.ToString(1)
+		checked := userData.IsFlagSet(flag)
+		L.Push(lua.LBool(checked))
+		return 1
+	}
+	setFlag := func(L *lua.LState) int {
+		flag := L.ToString(1)
+		userData.SetFlag(flag)
+		return 0
+	}
+	L := lua.NewState()
+	defer L.Close()
+	L.SetGlobal("knowledge", L.NewFunction(knowledge))
+	L.SetGlobal("performance", L.NewFunction(performance))
+	L.SetGlobal("sober", L.NewFunction(sober))
+	L.SetGlobal("prestige", L.NewFunction(prestige))
+	L.SetGlobal("connections", L.NewFunction(connections))
+	L.SetGlobal("praepostor", L.NewFunction(praepostor))
+	L.SetGlobal("addKnowledge", L.NewFunction(addKnowledge))
+	L.SetGlobal("addPerformance", L.NewFunction(addPerformance))
+	L.SetGlobal("addSober", L.NewFunction(addSober))
+	L.SetGlobal("addPrestige", L.NewFunction(addPrestige))
+	L.SetGlobal("addConnections", L.NewFunction(addConnections))
+	L.SetGlobal("jump", L.NewFunction(jump))
+	L.SetGlobal("flagCheck", L.NewFunction(flagCheck))
+	L.SetGlobal("setFlag", L.NewFunction(setFlag))
+	return L.DoString(luaStr)
+}
+
+// BenchmarkDoString runs jumper script the way DoString did
+// before caching and pooling
+func BenchmarkDoString(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		env := newEnv()
+		if err := baselineDoString(env.User, env.Page.JumperLogic); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkPrecompiledPooled runs jumper script of page with
+// cached compiled script on pooled states
+func BenchmarkPrecompiledPooled(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if err := NewInterpreter(newEnv()).DoPage(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSandbox(tt *testing.T) {
+	cases := []struct {
+		name   string
+		script string
+		// Expected kind of error, "" if script must succeed
+		kind string
+	}{
+		{"endless loop", `while true do end`, ErrTimeout},
+		{"deep recursion", `local function f() return 1 + f() end jump(f())`, ErrRuntime},
+		{"os", `os.exit(1)`, ErrRuntime},
+		{"io", `io.open("/etc/passwd")`, ErrRuntime},
+		{"debug", `debug.getinfo(1)`, ErrRuntime},
+		{"require", `require("os")`, ErrRuntime},
+		{"dofile", `dofile("/etc/passwd")`, ErrRuntime},
+		{"loadstring", `loadstring("return 1")()`, ErrRuntime},
+		{"load", `load(function() return nil end)`, ErrRuntime},
+		{"collectgarbage", `collectgarbage()`, ErrRuntime},
+		{"setfenv", `setfenv(1, {})`, ErrRuntime},
+		{"huge string.rep", `local s = string.rep("ab", 40000)`, ErrRuntime},
+		{"string.rep", `jump(#("ab"):rep(100))`, ""},
+		{"wide string.format", `local s = string.format("%100d", 1)`, ErrRuntime},
+		{"precise string.format", `local s = string.format("%.100f", 1)`, ErrRuntime},
+		{"string.format", `jump(#string.format("%-5s|%05.2f|%x%%", "a", 1.5, 255))`, ""},
+	}
+	for _, tc := range cases {
+		tt.Run(tc.name, func(tt *testing.T) {
+			s := newJumperState()
+			defer s.L.Close()
+			proto, err := Compile(tc.script)
+			if err != nil {
+				tt.Fatal(err)
+			}
+			_, err = s.run(proto, newEnv())
+			if tc.kind == "" {
+				if err != nil {
+					tt.Errorf("script failed: %v", err)
+				}
+				return
+			}
+			if scriptErr, ok := err.(*ScriptError); ok == false || scriptErr.Kind != tc.kind {
+				tt.Errorf("expected %s error, got %v", tc.kind, err)
+			}
+		})
+	}
+}
+
+func TestStringFormat(tt *testing.T) {
+	env := newEnv()
+	s := newJumperState()
+	defer s.L.Close()
+	ret := runScript(tt, s, env, `return string.format("%-5s|%05.2f|%x%%|%d", "a", 1.5, 255, 3, 4)`)
+	if ret.String() != "a    |01.50|ff%|3" {
+		tt.Errorf("unexpected result %q", ret.String())
+	}
+}
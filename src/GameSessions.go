@@ -1,11 +1,19 @@
 package src
 
 import (
-	"fmt"
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/fnv"
+	"math/rand"
 	"net/http"
-	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/go-redis/redis"
+	"github.com/gorilla/websocket"
+	"github.com/revan730/gamedev-backend/auth"
 	"github.com/revan730/gamedev-backend/db"
 	"github.com/revan730/gamedev-backend/types"
 	"go.uber.org/zap"
@@ -17,57 +25,566 @@ type GameHub struct {
 	clients          map[*Client]bool
 	newConnection    chan *Client
 	closedConnection chan *Client
-	databaseClient   *db.DatabaseClient
-	redisClient      *redis.Client
-	logger           *zap.Logger
+	tokenChanges     chan tokenChange
+	joins            chan joinRequest
+	reauths          chan reauthRequest
+	shutdown         chan chan struct{}
+	// Playthrough events waiting to be written by writeEvents
+	events     chan types.StoryEvent
+	stopEvents chan chan struct{}
+	// Kicks, broadcasts and session releases, sent locally or by other nodes
+	commands chan clusterMessage
+	// Running client writers, waited for on shutdown
+	writers sync.WaitGroup
+	// Interval of saving changed sessions, 0 disables autosave
+	autosave time.Duration
+	// Sessions of connected users by user id
+	sessions       map[int64]*Session
+	sessionMode    string
+	databaseClient db.Store
+	tokens         auth.TokenStore
+	logger         *zap.Logger
+	// Published story versions loaded so far, by id
+	versions   map[int64]*storyVersion
+	versionsMu sync.RWMutex
+	// Connection to other nodes, nil if server runs alone
+	cluster *Cluster
+	// Numbers of clients and sessions, updated by Run
+	onlineClients int64
+	onlineUsers   int64
+	// Page runs are moved to when their current page is missing
+	safePage  int64
+	incidents Incidents
 }
 
-func NewGameHub(dbCl *db.DatabaseClient, rCl *redis.Client, logger *zap.Logger) *GameHub {
+// Incidents counts failures clients were recovered
+// from instead of being disconnected
+type Incidents struct {
+	// Current pages which couldn't be loaded
+	MissingPages int64 `json:"missingPages"`
+	// Panics while handling client messages
+	Panics int64 `json:"panics"`
+	// Playthrough events which weren't written to storage
+	DroppedEvents int64 `json:"droppedEvents"`
+}
+
+func NewGameHub(dbCl db.Store, tokens auth.TokenStore, sessionMode string,
+	autosave time.Duration, safePage int64, logger *zap.Logger) *GameHub {
 	return &GameHub{
 		clients:          make(map[*Client]bool),
 		newConnection:    make(chan *Client),
 		closedConnection: make(chan *Client),
+		tokenChanges:     make(chan tokenChange),
+		joins:            make(chan joinRequest),
+		reauths:          make(chan reauthRequest),
+		commands:         make(chan clusterMessage),
+		shutdown:         make(chan chan struct{}),
+		events:           make(chan types.StoryEvent, eventQueueSize),
+		stopEvents:       make(chan chan struct{}),
+		autosave:         autosave,
+		safePage:         safePage,
+		sessions:         make(map[int64]*Session),
+		sessionMode:      sessionMode,
+		versions:         make(map[int64]*storyVersion),
 		databaseClient:   dbCl,
 		logger:           logger,
-		redisClient:      rCl,
+		tokens:           tokens,
 	}
 }
 
 func (g *GameHub) Run() {
+	go g.writeEvents()
+	var autosave <-chan time.Time
+	if g.autosave > 0 {
+		ticker := time.NewTicker(g.autosave)
+		defer ticker.Stop()
+		autosave = ticker.C
+	}
 	for {
 		select {
 		case client := <-g.newConnection:
 			g.clients[client] = false
-			fmt.Println("Client connected")
+			g.logDebug("Client connected")
 		case client := <-g.closedConnection:
-			fmt.Println("Client disconnected")
-			if client.userData != nil {
-				g.SaveUserSession(client.userData)
+			g.logDebug("Client disconnected")
+			if client.session != nil {
+				g.leave(client)
 			}
 			delete(g.clients, client)
+		case join := <-g.joins:
+			join.session <- g.join(join)
+		case reauth := <-g.reauths:
+			reauth.client.tokenHash = reauth.tokenHash
+			reauth.client.role = reauth.role
+			close(reauth.done)
+		case change := <-g.tokenChanges:
+			g.applyTokenChange(change)
+		case command := <-g.commands:
+			g.handleCommand(command)
+		case <-autosave:
+			g.saveSessions()
+		case done := <-g.shutdown:
+			for client := range g.clients {
+				client.trySendJSON(closeMessage{code: websocket.CloseGoingAway, reason: "server shutting down"})
+			}
+			g.closeSessions()
+			g.flushEvents()
+			close(done)
+		}
+		atomic.StoreInt64(&g.onlineClients, int64(len(g.clients)))
+		atomic.StoreInt64(&g.onlineUsers, int64(len(g.sessions)))
+	}
+}
+
+// Stats returns numbers of clients and users connected to this node
+func (g *GameHub) Stats() HubStats {
+	return HubStats{
+		Clients: int(atomic.LoadInt64(&g.onlineClients)),
+		Users:   int(atomic.LoadInt64(&g.onlineUsers)),
+		Nodes:   1,
+	}
+}
+
+// Incidents returns numbers of incidents since start
+func (g *GameHub) Incidents() Incidents {
+	return Incidents{
+		MissingPages:  atomic.LoadInt64(&g.incidents.MissingPages),
+		Panics:        atomic.LoadInt64(&g.incidents.Panics),
+		DroppedEvents: atomic.LoadInt64(&g.incidents.DroppedEvents),
+	}
+}
+
+// ClusterStats returns numbers of clients and users
+// connected to every node of cluster
+func (g *GameHub) ClusterStats() (HubStats, error) {
+	if g.cluster == nil {
+		return g.Stats(), nil
+	}
+	return g.cluster.Stats()
+}
+
+func (g *GameHub) handleCommand(command clusterMessage) {
+	switch command.Type {
+	case msgKick:
+		for client := range g.clients {
+			if client.userData != nil && client.userData.Id == command.UserId {
+				client.Disconnect(closeKicked, "kicked")
+			}
+		}
+	case msgBroadcast:
+		for client := range g.clients {
+			if client.session != nil {
+				client.trySendJSON(command.Payload)
+			}
+		}
+	case msgRelease:
+		g.release(command.UserId)
+		g.cluster.SendTo(command.From, clusterMessage{Type: msgReleased, RequestId: command.RequestId})
+	}
+}
+
+// KickUser disconnects every client of user,
+// on whichever node they're connected to
+func (g *GameHub) KickUser(userId int64) error {
+	kick := clusterMessage{Type: msgKick, UserId: userId}
+	if g.cluster != nil {
+		owner, err := g.cluster.Owner(userId)
+		if err != nil {
+			return err
+		}
+		if owner != "" && owner != g.cluster.nodeId {
+			g.cluster.SendTo(owner, kick)
+			return nil
+		}
+	}
+	g.commands <- kick
+	return nil
+}
+
+// Announce sends message to every authorized client of cluster
+func (g *GameHub) Announce(text string) {
+	announcement := clusterMessage{Type: msgBroadcast,
+		Payload: newPush(ChannelAnnouncement, Announcement{Message: text})}
+	g.commands <- announcement
+	if g.cluster != nil {
+		g.cluster.Broadcast(announcement)
+	}
+}
+
+// saveSessions saves every session changed since last save
+func (g *GameHub) saveSessions() {
+	for _, session := range g.sessions {
+		session.mu.Lock()
+		if session.dirty {
+			g.SaveSession(session)
+		}
+		session.mu.Unlock()
+	}
+}
+
+// closeSessions saves every changed session, making sessions
+// ignore messages which are still coming
+func (g *GameHub) closeSessions() {
+	var userIds []int64
+	for userId, session := range g.sessions {
+		session.mu.Lock()
+		session.closed = true
+		if session.dirty {
+			g.SaveSession(session)
+		}
+		session.mu.Unlock()
+		userIds = append(userIds, userId)
+	}
+	if g.cluster != nil {
+		g.cluster.Leave(userIds)
+	}
+}
+
+// Shutdown closes every client and saves every session,
+// then waits for clients to write what's left. It gives up
+// once ctx is done, even if hub is still busy
+func (g *GameHub) Shutdown(ctx context.Context) {
+	done := make(chan struct{})
+	select {
+	case g.shutdown <- done:
+	case <-ctx.Done():
+		g.logError("Hub didn't start shutdown in time", ctx.Err())
+		return
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		g.logError("Sessions weren't saved in time", ctx.Err())
+		return
+	}
+	written := make(chan struct{})
+	go func() {
+		g.writers.Wait()
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-ctx.Done():
+		g.logError("Clients weren't closed in time", ctx.Err())
+	}
+}
+
+// tokenChange tells hub about revoked or refreshed token, tokens are
+// identified by hash. Empty tokenHash means every token of user, empty
+// replacement means revocation
+type tokenChange struct {
+	tokenHash   string
+	userId      int64
+	replacement string
+}
+
+func (t tokenChange) matches(client *Client) bool {
+	if client.userData == nil {
+		return false
+	}
+	if t.tokenHash == "" {
+		return client.userData.Id == t.userId
+	}
+	return client.tokenHash == t.tokenHash
+}
+
+func (g *GameHub) applyTokenChange(change tokenChange) {
+	for client := range g.clients {
+		if change.matches(client) == false {
+			continue
+		}
+		if change.replacement != "" {
+			client.tokenHash = change.replacement
+		} else {
+			client.Disconnect(closeTokenRevoked, "token revoked")
 		}
 	}
 }
 
-// serveWs handles websocket requests from the peer.
+// changeToken applies token change to clients of every node
+func (g *GameHub) changeToken(change tokenChange) {
+	g.tokenChanges <- change
+	if g.cluster != nil {
+		g.cluster.Broadcast(clusterMessage{
+			Type:        msgTokenChange,
+			UserId:      change.userId,
+			TokenHash:   change.tokenHash,
+			Replacement: change.replacement,
+		})
+	}
+}
+
+// DisconnectToken disconnects clients authorized with token
+func (g *GameHub) DisconnectToken(tokenHash string) {
+	g.changeToken(tokenChange{tokenHash: tokenHash})
+}
+
+// DisconnectUser disconnects every client of user
+func (g *GameHub) DisconnectUser(userId int64) {
+	g.changeToken(tokenChange{userId: userId})
+}
+
+// ReplaceToken makes clients authorized with refreshed
+// token use the new one, so they aren't disconnected on its revocation
+func (g *GameHub) ReplaceToken(tokenHash, replacement string) {
+	g.changeToken(tokenChange{tokenHash: tokenHash, replacement: replacement})
+}
+
+// serveWs handles websocket requests from the peer. Token given
+// at upgrade authorizes client right away, otherwise it has to send
+// "auth" message in time
 func (g *GameHub) ServeWs(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	token, protocol := upgradeToken(r)
+	var identity auth.Identity
+	if token != "" {
+		var ok bool
+		identity, ok = g.ResolveToken(token)
+		if ok == false {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+	}
+	var responseHeader http.Header
+	if protocol != "" {
+		responseHeader = http.Header{"Sec-Websocket-Protocol": {protocol}}
+	}
+	conn, err := upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
 		g.logError("Unable to start WS server", err)
 		return
 	}
-	client := &Client{hub: g, conn: conn, send: make(chan interface{}, 256)}
+	sessionId := newSessionId()
+	client := &Client{hub: g, conn: conn, send: make(chan interface{}, 256),
+		sessionId: sessionId, rand: rand.New(rand.NewSource(sessionSeed(sessionId))),
+		authorized: make(chan struct{})}
+	var authErr *ClientError
+	if token != "" {
+		authErr = client.authorize(identity, token)
+	}
+	if token != "" && authErr == nil {
+		client.sendState()
+	} else {
+		if authErr != nil {
+			client.sendError(authErr)
+		}
+		go client.awaitAuth()
+	}
 	client.hub.newConnection <- client
 
 	// Allow collection of memory referenced by the caller by doing all work in
 	// new goroutines.
+	g.writers.Add(1)
 	go client.Writer()
 	go client.Reader()
 }
 
+// tokenProtocol is websocket subprotocol clients pass token with,
+// as "Sec-WebSocket-Protocol: bearer, <token>"
+const tokenProtocol = "bearer"
+
+// upgradeToken returns token passed in websocket upgrade request
+// and subprotocol to respond with, if token was passed in one
+func upgradeToken(r *http.Request) (token, protocol string) {
+	if token := bearerToken(r); token != "" {
+		return token, ""
+	}
+	protocols := websocket.Subprotocols(r)
+	if len(protocols) == 2 && protocols[0] == tokenProtocol {
+		return protocols[1], tokenProtocol
+	}
+	return r.URL.Query().Get("token"), ""
+}
+
+// newSessionId returns random id of websocket session
+func newSessionId() string {
+	idBytes := make([]byte, 16)
+	crand.Read(idBytes)
+	return hex.EncodeToString(idBytes)
+}
+
+// sessionSeed derives seed of jumper scripts randomness from
+// session id, so session's runs can be replayed
+func sessionSeed(sessionId string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(sessionId))
+	return int64(h.Sum64())
+}
+
+// conditionSeed derives seed of randomness of answer's condition,
+// so condition gives the same result on every evaluation in session
+// and doesn't advance randomness of jumper scripts
+func conditionSeed(sessionId string, pageId, answerId int64) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(sessionId))
+	binary.Write(h, binary.LittleEndian, pageId)
+	binary.Write(h, binary.LittleEndian, answerId)
+	return int64(h.Sum64())
+}
+
+// Session is run of connected user, shared by all user's clients.
+// Clients hold its lock while handling messages
 type Session struct {
-	userData  *types.User
-	authToken string
+	mu       sync.Mutex
+	userData *types.User
+	// Transitions made in current run, oldest first
+	history []types.HistoryEntry
+	clients map[*Client]bool
+	// Changed since last save
+	dirty bool
+	// Server is shutting down, messages are ignored
+	closed bool
+}
+
+// reauthRequest makes authorized client use another token of its
+// user. Token of client is read by hub, so only hub changes it
+type reauthRequest struct {
+	client    *Client
+	tokenHash string
+	role      string
+	done      chan struct{}
+}
+
+// Reauthorize replaces token and role of authorized client
+func (g *GameHub) Reauthorize(client *Client, authToken, role string) {
+	reauth := reauthRequest{client: client, tokenHash: auth.HashToken(authToken),
+		role: role, done: make(chan struct{})}
+	g.reauths <- reauth
+	<-reauth.done
+}
+
+// joinRequest authorizes client, adding it to session of user. User
+// is nil unless it was loaded because user had no session
+type joinRequest struct {
+	client    *Client
+	identity  auth.Identity
+	tokenHash string
+	user      *types.User
+	session   chan *Session
+}
+
+// Join authorizes client with token issued to identity and adds it to
+// session of user, starting one if user has no other clients. User's state
+// is loaded from DB only by the first client, the rest get state of the
+// running session. Client is changed by hub, as hub reads it concurrently.
+// In cluster, session held by another node is released by it first,
+// ErrNotReleased is returned if it isn't. Errors are logged
+func (g *GameHub) Join(client *Client, identity auth.Identity, authToken string) (*Session, error) {
+	userId := identity.UserId
+	if g.cluster != nil {
+		if err := g.cluster.Claim(userId); err != nil {
+			if err != ErrNotReleased {
+				g.logError("Unable to claim session", err)
+			}
+			return nil, err
+		}
+	}
+	var user *types.User
+	for {
+		join := joinRequest{client: client, identity: identity, tokenHash: auth.HashToken(authToken),
+			user: user, session: make(chan *Session)}
+		g.joins <- join
+		session := <-join.session
+		if session != nil {
+			return session, nil
+		}
+		// User has no session yet, loading is left out
+		// of hub loop as it waits for DB
+		var err error
+		user, err = g.databaseClient.FindUserById(userId)
+		if err != nil {
+			g.logError("Unable to load user", err)
+			return nil, err
+		}
+	}
+}
+
+// join authorizes client, adding it to running session of user
+// or starting one if user was loaded, otherwise nil is returned
+func (g *GameHub) join(request joinRequest) *Session {
+	client, userId, user := request.client, request.identity.UserId, request.user
+	session, ok := g.sessions[userId]
+	if ok == false {
+		if user == nil {
+			return nil
+		}
+		session = &Session{
+			userData: user,
+			history:  g.GetUserHistory(user.Id),
+			clients:  make(map[*Client]bool),
+		}
+		// Runs started before anything was published are
+		// moved to the first published version
+		if user.StoryVersion == 0 {
+			latest, ok := g.LatestVersion()
+			if ok && latest != 0 {
+				user.StoryVersion = latest
+				session.dirty = true
+			}
+		}
+		g.sessions[user.Id] = session
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if g.sessionMode == SessionsTakeover {
+		replaceClients(session)
+	}
+	session.clients[client] = true
+	client.session = session
+	client.userData = session.userData
+	client.tokenHash = request.tokenHash
+	client.role = request.identity.Role
+	return session
+}
+
+// replaceClients closes clients of session, caller must hold session's lock
+func replaceClients(session *Session) {
+	for client := range session.clients {
+		client.trySendJSON(newPush(ChannelSessionReplaced, nil))
+		client.trySendJSON(closeMessage{code: closeSessionReplaced, reason: "session replaced"})
+		delete(session.clients, client)
+	}
+}
+
+// release saves session of user who connected to another
+// node and closes its clients
+func (g *GameHub) release(userId int64) {
+	session, ok := g.sessions[userId]
+	if ok == false {
+		return
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	replaceClients(session)
+	if session.dirty {
+		g.SaveSession(session)
+	}
+	session.closed = true
+	delete(g.sessions, userId)
+}
+
+// leave removes disconnected client from its session, user's
+// state is saved once the last client of session leaves
+func (g *GameHub) leave(client *Client) {
+	session := client.session
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.clients[client] == false {
+		// Client was replaced, its user is still playing
+		return
+	}
+	delete(session.clients, client)
+	if len(session.clients) != 0 {
+		return
+	}
+	user := session.userData
+	client.logEvent(types.EventDisconnect, user.CurrentPage, 0, *user)
+	if session.dirty {
+		g.SaveSession(session)
+	}
+	delete(g.sessions, user.Id)
+	if g.cluster != nil {
+		g.cluster.Disown(user.Id)
+	}
 }
 
 func (g *GameHub) logError(msg string, err error) {
@@ -75,43 +592,102 @@ func (g *GameHub) logError(msg string, err error) {
 	g.logger.Error(msg, zap.String("packageLevel", "hub"), zap.Error(err))
 }
 
+// logPanic logs value recovered from panic along with stack trace
+func (g *GameHub) logPanic(msg string, recovered interface{}) {
+	defer g.logger.Sync()
+	g.logger.Error(msg, zap.String("packageLevel", "hub"),
+		zap.Any("panic", recovered), zap.Stack("stack"))
+}
+
+// logDebug logs event of connection, fields mustn't
+// carry message payloads since they may hold tokens
+func (g *GameHub) logDebug(msg string, fields ...zap.Field) {
+	g.logger.Debug(msg, append(fields, zap.String("packageLevel", "hub"))...)
+}
+
 func (g *GameHub) logInfo(msg string) {
 	defer g.logger.Sync()
 	g.logger.Info("INFO", zap.String("msg", msg), zap.String("packageLevel", "hub"))
 }
 
-// GetSessionByToken returns session pointer if user's token is valid
-// by loading it from database
-func (g *GameHub) GetSessionByToken(authToken string) *types.User {
-	// Ask redis for user's id by token (if authorized)
-	// Load session by users id
-	userIdStr, err := g.redisClient.Get(authToken).Result()
-	if err != nil {
-		return nil
-	}
-	userId, err := strconv.Atoi(userIdStr)
-	if err != nil {
-		return nil
+// AuditRejectedMove writes warning about move rejected by NextPage to
+// server log, tagged with "audit" package level. Server log is the audit
+// trail of moves, audit table only keeps changes of story content, and
+// clients sending bogus moves mustn't be able to flood it
+func (g *GameHub) AuditRejectedMove(userId int64, sessionId string, pageId int64, answerId interface{}, err error) {
+	defer g.logger.Sync()
+	code := ""
+	if clientErr, ok := err.(*ClientError); ok {
+		code = clientErr.Code
 	}
-	user, err := g.databaseClient.FindUserById(int64(userId))
+	g.logger.Warn("Move rejected",
+		zap.String("packageLevel", "audit"),
+		zap.Int64("userId", userId),
+		zap.String("sessionId", sessionId),
+		zap.Int64("pageId", pageId),
+		zap.Any("answerId", answerId),
+		zap.String("code", code),
+		zap.Error(err))
+}
+
+// ResolveToken returns user and role token was issued to. JWTs
+// are verified locally, then only denylist is asked about them
+func (g *GameHub) ResolveToken(authToken string) (auth.Identity, bool) {
+	identity, err := g.tokens.Resolve(authToken)
 	if err != nil {
-		return nil
+		if err != auth.ErrInvalidToken {
+			g.logError("Unable to resolve token", err)
+		}
+		return identity, false
 	}
-	return user
+	return identity, true
 }
 
-func (g *GameHub) SaveUserSession(session *types.User) bool {
-	// Save user's session to DB
-	err := g.databaseClient.SaveUser(session)
+// SaveSession saves user's state and history, caller must hold session's
+// lock. If user was saved elsewhere since it was loaded, session is reloaded
+// from DB and its clients are notified, losing progress made since last save
+func (g *GameHub) SaveSession(session *Session) bool {
+	user := session.userData
+	err := g.databaseClient.SaveUser(user)
+	if err == db.ErrConflict {
+		g.logger.Warn("User was changed concurrently, reloading session",
+			zap.String("packageLevel", "hub"),
+			zap.Int64("userId", user.Id))
+		g.reloadSession(session)
+		return false
+	}
 	if err != nil {
 		g.logError("Unable to save user's session", err)
 		return false
 	}
+	if g.SaveUserHistory(user.Id, session.history) == false {
+		return false
+	}
+	session.dirty = false
 	return true
 }
 
-func (g *GameHub) GetPage(pageId int64) *types.Page {
-	page, err := g.databaseClient.FindPageById(pageId)
+// reloadSession replaces session's state with one saved
+// in DB and sends it to session's clients
+func (g *GameHub) reloadSession(session *Session) {
+	fresh, err := g.databaseClient.FindUserById(session.userData.Id)
+	if err != nil {
+		g.logError("Unable to reload user's session", err)
+		return
+	}
+	*session.userData = *fresh
+	session.history = g.GetUserHistory(fresh.Id)
+	session.dirty = false
+	for client := range session.clients {
+		client.sendJSON(newPush(ChannelSessionConflict, nil))
+		client.SendSessionInfo()
+		client.SendCurrentPage()
+	}
+}
+
+// GetPage returns page of story version, version 0 is the draft
+func (g *GameHub) GetPage(versionId, pageId int64) *types.Page {
+	page, err := g.FindPage(versionId, pageId)
 	if err != nil {
 		g.logError("Unable to get page", err)
 		return nil
@@ -119,20 +695,123 @@ func (g *GameHub) GetPage(pageId int64) *types.Page {
 	return page
 }
 
-func (g *GameHub) GetAnswer(answerId int64) *types.Answer {
-	answer, err := g.databaseClient.FindAnswerById(answerId)
+// FindPage is GetPage which leaves error handling to caller,
+// db.ErrNotFound is returned if version has no such page
+func (g *GameHub) FindPage(versionId, pageId int64) (*types.Page, error) {
+	if versionId == 0 {
+		return g.databaseClient.FindPageById(pageId)
+	}
+	version, err := g.storyVersion(versionId)
+	if err != nil {
+		return nil, err
+	}
+	page, ok := version.pages[pageId]
+	if ok == false {
+		return nil, db.ErrNotFound
+	}
+	return &page, nil
+}
+
+// GetAnswer returns answer of story version, version 0 is the draft
+func (g *GameHub) GetAnswer(versionId, answerId int64) *types.Answer {
+	if versionId == 0 {
+		answer, err := g.databaseClient.FindAnswerById(answerId)
+		if err != nil {
+			g.logError("Unable to get answer", err)
+			return nil
+		}
+		return answer
+	}
+	version, err := g.storyVersion(versionId)
+	if err != nil {
+		g.logError("Unable to load story version", err)
+		return nil
+	}
+	answer, ok := version.answers[answerId]
+	if ok == false {
+		g.logError("Unable to get answer", db.ErrNotFound)
+		return nil
+	}
+	return &answer
+}
+
+// GetPageAnswers returns answers of page in story
+// version, version 0 is the draft
+func (g *GameHub) GetPageAnswers(versionId, pageId int64) []types.Answer {
+	if versionId == 0 {
+		answers, err := g.databaseClient.FindPageAnswers(pageId)
+		if err != nil {
+			g.logError("Unable to get answers", err)
+			return nil
+		}
+		return answers
+	}
+	version, err := g.storyVersion(versionId)
+	if err != nil {
+		g.logError("Unable to load story version", err)
+		return nil
+	}
+	answers := version.pageAnswers[pageId]
+	return append([]types.Answer(nil), answers...)
+}
+
+// SaveSlot saves user's current run to named slot, user can't
+// have more than maxSaveSlots slots. Errors other than
+// db.ErrLimitReached are logged
+func (g *GameHub) SaveSlot(session *types.User, name string) error {
+	err := g.databaseClient.SaveSlot(session.ToSlot(name), maxSaveSlots)
+	if err != nil && err != db.ErrLimitReached {
+		g.logError("Unable to save slot", err)
+	}
+	return err
+}
+
+func (g *GameHub) GetSlot(userId int64, name string) *types.SaveSlot {
+	slot, err := g.databaseClient.FindSlot(userId, name)
 	if err != nil {
-		g.logError("Unable to get answer", err)
+		if err != db.ErrNotFound {
+			g.logError("Unable to get slot", err)
+		}
 		return nil
 	}
-	return answer
+	return slot
+}
+
+// GetUserSlots returns user's save slots, ok is false
+// if they couldn't be loaded
+func (g *GameHub) GetUserSlots(userId int64) (slots []types.SaveSlot, ok bool) {
+	slots, err := g.databaseClient.FindUserSlots(userId)
+	if err != nil {
+		g.logError("Unable to get slots", err)
+		return nil, false
+	}
+	return slots, true
+}
+
+func (g *GameHub) DeleteSlot(userId int64, name string) bool {
+	deleted, err := g.databaseClient.DeleteSlot(userId, name)
+	if err != nil {
+		g.logError("Unable to delete slot", err)
+		return false
+	}
+	return deleted
+}
+
+// SaveUserHistory saves user's transition history to DB
+func (g *GameHub) SaveUserHistory(userId int64, history []types.HistoryEntry) bool {
+	err := g.databaseClient.SaveHistory(userId, history)
+	if err != nil {
+		g.logError("Unable to save user's history", err)
+		return false
+	}
+	return true
 }
 
-func (g *GameHub) GetPageAnswers(pageId int64) []types.Answer {
-	answers, err := g.databaseClient.FindPageAnswers(pageId)
+func (g *GameHub) GetUserHistory(userId int64) []types.HistoryEntry {
+	history, err := g.databaseClient.FindUserHistory(userId)
 	if err != nil {
-		g.logError("Unable to get answers", err)
+		g.logError("Unable to get user's history", err)
 		return nil
 	}
-	return answers
+	return history
 }
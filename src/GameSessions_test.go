@@ -0,0 +1,486 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/revan730/gamedev-backend/auth"
+	"github.com/revan730/gamedev-backend/db"
+	"github.com/revan730/gamedev-backend/types"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// countingStore is memory store counting loads of users by id
+type countingStore struct {
+	*db.MemoryStore
+	userLoads int64
+}
+
+func (s *countingStore) FindUserById(id int64) (*types.User, error) {
+	atomic.AddInt64(&s.userLoads, 1)
+	return s.MemoryStore.FindUserById(id)
+}
+
+// testServer is running hub serving websocket
+// connections, with story of testPages
+type testServer struct {
+	hub          *GameHub
+	store        *countingStore
+	tokens       *auth.MemoryTokenStore
+	url          string
+	shutdownOnce sync.Once
+}
+
+func newTestServer(t *testing.T, sessionMode string) *testServer {
+	return newAutosaveServer(t, sessionMode, 0)
+}
+
+// newAutosaveServer returns test server saving changed sessions every interval
+func newAutosaveServer(t *testing.T, sessionMode string, autosave time.Duration) *testServer {
+	store := &countingStore{MemoryStore: newTestStore(t, moveAnswers)}
+	tokens := auth.NewMemoryTokenStore(time.Hour)
+	hub := NewGameHub(store, tokens, sessionMode, autosave, 1, zap.NewNop())
+	return serveHub(t, hub, store, tokens)
+}
+
+// serveHub runs hub and serves its websocket endpoint
+func serveHub(t *testing.T, hub *GameHub, store *countingStore, tokens *auth.MemoryTokenStore) *testServer {
+	go hub.Run()
+	server := httptest.NewServer(http.HandlerFunc(hub.ServeWs))
+	s := &testServer{hub: hub, store: store, tokens: tokens,
+		url: "ws" + strings.TrimPrefix(server.URL, "http")}
+	t.Cleanup(func() {
+		s.shutdown()
+		server.Close()
+	})
+	return s
+}
+
+// shutdown shuts hub down, hub can be shut down only once
+func (s *testServer) shutdown() {
+	s.shutdownOnce.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.hub.Shutdown(ctx)
+	})
+}
+
+// login creates user and issues token to it
+func (s *testServer) login(t *testing.T, login string) (*types.User, string) {
+	err := s.store.CreateUser(login, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := s.store.FindUser(login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := s.tokens.Issue(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, token
+}
+
+// dial connects to server, authorizing
+// with token at upgrade unless it's empty
+func (s *testServer) dial(t *testing.T, token string) *websocket.Conn {
+	url := s.url
+	if token != "" {
+		url += "?token=" + token
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// send sends message of channel with raw JSON data, which may be empty
+func send(t *testing.T, conn *websocket.Conn, channel, data string) {
+	message := `{"v": 1, "channel": "` + channel + `"`
+	if data != "" {
+		message += `, "data": ` + data
+	}
+	err := conn.WriteMessage(websocket.TextMessage, []byte(message+"}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receiveOn reads messages until one of channel comes
+func receiveOn(t *testing.T, conn *websocket.Conn, channel string) map[string]interface{} {
+	return receiveWithin(t, conn, channel, time.Second)
+}
+
+// receiveWithin is receiveOn waiting for every message up to timeout
+func receiveWithin(t *testing.T, conn *websocket.Conn, channel string, timeout time.Duration) map[string]interface{} {
+	for {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		var message map[string]interface{}
+		if err := conn.ReadJSON(&message); err != nil {
+			t.Fatalf("waiting for %s: %v", channel, err)
+		}
+		if message["channel"] == channel {
+			return message
+		}
+	}
+}
+
+// expectReply reads response to message of channel, failing on error response
+func expectReply(t *testing.T, conn *websocket.Conn, channel string) map[string]interface{} {
+	reply := receiveOn(t, conn, channel)
+	if reply["error"] != nil {
+		t.Fatalf("%s failed: %v", channel, reply["error"])
+	}
+	return reply
+}
+
+// expectClose reads messages until connection is closed with code
+func expectClose(t *testing.T, conn *websocket.Conn, code int) {
+	for {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if websocket.IsCloseError(err, code) == false {
+			t.Fatalf("expected close code %d, got %v", code, err)
+		}
+		return
+	}
+}
+
+// TestRacingSessionsSave plays the same user on two servers,
+// the one saving later must get its session reloaded
+func TestRacingSessionsSave(t *testing.T) {
+	store := newTestStore(t, []types.Answer{
+		{Id: 1, PageId: 1, Text: "Sure", Knowledge: 1},
+		{Id: 2, PageId: 1, Text: "Nah", Sober: -1},
+	})
+	err := store.CreateUser("player", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var clients []*Client
+	for i := 0; i < 2; i++ {
+		user, err := store.FindUser("player")
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, newStoreClient(store, user))
+	}
+	first, second := clients[0], clients[1]
+	if err := first.NextPage(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.NextPage(2); err != nil {
+		t.Fatal(err)
+	}
+	if first.hub.SaveSession(first.session) == false {
+		t.Fatal("first save failed")
+	}
+	if second.hub.SaveSession(second.session) {
+		t.Fatal("stale save succeeded")
+	}
+	saved, _ := store.FindUser("player")
+	if saved.Knowledge != 1 || saved.Sober != 0 {
+		t.Errorf("stale save overwrote user: knowledge %d, sober %d", saved.Knowledge, saved.Sober)
+	}
+	if *second.userData != *saved {
+		t.Errorf("second session wasn't reloaded: %+v", second.userData)
+	}
+	msg, ok := (<-second.send).(ServerMessage)
+	if ok == false || msg.Channel != ChannelSessionConflict {
+		t.Errorf("expected session_conflict push, got %+v", msg)
+	}
+	// Reloaded session saves normally
+	if second.hub.SaveSession(second.session) == false {
+		t.Error("save of reloaded session failed")
+	}
+}
+
+// TestReauthorizedClientUsesNewToken authorizes client twice,
+// only revocation of the latest token disconnects it
+func TestReauthorizedClientUsesNewToken(t *testing.T) {
+	s := newTestServer(t, SessionsTakeover)
+	user, first := s.login(t, "player")
+	second, err := s.tokens.Issue(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := s.dial(t, "")
+	send(t, conn, ChannelAuth, `{"authToken": "`+first+`"}`)
+	expectReply(t, conn, ChannelAuth)
+	send(t, conn, ChannelAuth, `{"authToken": "`+second+`"}`)
+	expectReply(t, conn, ChannelAuth)
+	s.hub.DisconnectToken(auth.HashToken(first))
+	// Hub applies changes in order, the first one is done once it takes another
+	s.hub.DisconnectToken(auth.HashToken("unknown"))
+	send(t, conn, ChannelListSlots, "")
+	expectReply(t, conn, ChannelListSlots)
+	s.hub.DisconnectToken(auth.HashToken(second))
+	expectClose(t, conn, closeTokenRevoked)
+}
+
+// TestRunningSessionIsNotReloaded connects user twice and reauthorizes,
+// user is loaded from DB only for the first connection
+func TestRunningSessionIsNotReloaded(t *testing.T) {
+	s := newTestServer(t, SessionsShared)
+	_, token := s.login(t, "player")
+	first := s.dial(t, token)
+	receiveOn(t, first, ChannelStoryText)
+	second := s.dial(t, "")
+	send(t, second, ChannelAuth, `{"authToken": "`+token+`"}`)
+	expectReply(t, second, ChannelAuth)
+	send(t, second, ChannelAuth, `{"authToken": "`+token+`"}`)
+	expectReply(t, second, ChannelAuth)
+	if loads := atomic.LoadInt64(&s.store.userLoads); loads != 1 {
+		t.Errorf("expected user to be loaded once, got %d loads", loads)
+	}
+}
+
+func TestStoryChannelsNeedAuth(t *testing.T) {
+	s := newTestServer(t, SessionsTakeover)
+	_, token := s.login(t, "player")
+	conn := s.dial(t, "")
+	for _, spec := range clientChannels {
+		if spec.channel == ChannelAuth {
+			continue
+		}
+		send(t, conn, spec.channel, "")
+		reply := receiveOn(t, conn, spec.channel)
+		err, _ := reply["error"].(map[string]interface{})
+		if err == nil || err["code"] != ErrCodeUnauthorized {
+			t.Errorf("%s: expected unauthorized error, got %v", spec.channel, reply)
+		}
+	}
+	send(t, conn, ChannelAuth, `{"authToken": "`+token+`"}`)
+	expectReply(t, conn, ChannelAuth)
+	send(t, conn, ChannelMove, `{"answerId": 1}`)
+	expectReply(t, conn, ChannelMove)
+}
+
+// TestAuthorizeWhileHubBroadcasts authorizes clients while hub
+// reads clients for announcements, run it with -race
+func TestAuthorizeWhileHubBroadcasts(t *testing.T) {
+	s := newTestServer(t, SessionsShared)
+	_, token := s.login(t, "player")
+	stop := make(chan struct{})
+	announced := make(chan struct{})
+	go func() {
+		defer close(announced)
+		// Fewer than fit in send buffer of clients which aren't read
+		for i := 0; i < 200; i++ {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+				s.hub.Announce("maintenance soon")
+			}
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		conn := s.dial(t, "")
+		send(t, conn, ChannelAuth, `{"authToken": "`+token+`"}`)
+		expectReply(t, conn, ChannelAuth)
+	}
+	close(stop)
+	<-announced
+}
+
+// expectText reads current page sent to client, failing unless it has text
+func expectText(t *testing.T, conn *websocket.Conn, text string) {
+	message := receiveOn(t, conn, ChannelStoryText)
+	if message["data"].(map[string]interface{})["text"] != text {
+		t.Errorf("expected page %q, got %v", text, message["data"])
+	}
+}
+
+// waitForUser polls store until saved user passes check
+func waitForUser(t *testing.T, s *testServer, login string, check func(user *types.User) bool) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		user, err := s.store.FindUser(login)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if check(user) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("user wasn't saved as expected: %+v", user)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTakeoverSession(t *testing.T) {
+	s := newTestServer(t, SessionsTakeover)
+	_, token := s.login(t, "player")
+	old := s.dial(t, token)
+	receiveOn(t, old, ChannelStoryText)
+	send(t, old, ChannelMove, `{"answerId": 1}`)
+	expectReply(t, old, ChannelMove)
+	fresh := s.dial(t, token)
+	receiveOn(t, old, ChannelSessionReplaced)
+	expectClose(t, old, closeSessionReplaced)
+	// New connection continues the run of the old one
+	expectText(t, fresh, "Lecture")
+	fresh.Close()
+	waitForUser(t, s, "player", func(user *types.User) bool {
+		return user.CurrentPage == 2 && user.Knowledge == 1
+	})
+}
+
+func TestSharedSession(t *testing.T) {
+	s := newTestServer(t, SessionsShared)
+	_, token := s.login(t, "player")
+	first := s.dial(t, token)
+	receiveOn(t, first, ChannelStoryText)
+	second := s.dial(t, token)
+	receiveOn(t, second, ChannelStoryText)
+	send(t, first, ChannelMove, `{"answerId": 1}`)
+	expectReply(t, first, ChannelMove)
+	// Both connections see the same run
+	expectText(t, first, "Lecture")
+	expectText(t, second, "Lecture")
+	first.Close()
+	send(t, second, ChannelListSlots, "")
+	expectReply(t, second, ChannelListSlots)
+	if user, _ := s.store.FindUser("player"); user.CurrentPage != 1 {
+		t.Error("run was saved while user is still connected")
+	}
+	second.Close()
+	waitForUser(t, s, "player", func(user *types.User) bool {
+		return user.CurrentPage == 2 && user.Knowledge == 1
+	})
+}
+
+func TestAutosave(t *testing.T) {
+	s := newAutosaveServer(t, SessionsTakeover, 20*time.Millisecond)
+	_, token := s.login(t, "player")
+	conn := s.dial(t, token)
+	send(t, conn, ChannelMove, `{"answerId": 1}`)
+	expectReply(t, conn, ChannelMove)
+	// Connection stays open, run is saved by autosave
+	waitForUser(t, s, "player", func(user *types.User) bool { return user.CurrentPage == 2 })
+}
+
+func TestShutdownSavesSessions(t *testing.T) {
+	s := newTestServer(t, SessionsTakeover)
+	_, token := s.login(t, "player")
+	conn := s.dial(t, token)
+	send(t, conn, ChannelMove, `{"answerId": 1}`)
+	expectReply(t, conn, ChannelMove)
+	s.shutdown()
+	if user, _ := s.store.FindUser("player"); user.CurrentPage != 2 {
+		t.Errorf("run wasn't saved on shutdown, user is on page %d", user.CurrentPage)
+	}
+	expectClose(t, conn, websocket.CloseGoingAway)
+}
+
+func TestShutdownGivesUpOnBusyHub(t *testing.T) {
+	// Hub isn't running, as if it hung on storage
+	hub := NewGameHub(db.NewMemoryStore(), nil, SessionsTakeover, 0, 1, zap.NewNop())
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	returned := make(chan struct{})
+	go func() {
+		hub.Shutdown(ctx)
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown didn't give up once ctx was done")
+	}
+}
+
+// newServerConn returns server side of websocket connection
+func newServerConn(t *testing.T) *websocket.Conn {
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err == nil {
+			conns <- conn
+		}
+	}))
+	t.Cleanup(server.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return <-conns
+}
+
+// TestHubDisconnectsStuckClients gives hub clients whose Writer
+// has exited, hub must disconnect them instead of waiting
+func TestHubDisconnectsStuckClients(t *testing.T) {
+	hub := NewGameHub(db.NewMemoryStore(), nil, SessionsTakeover, 0, 1, zap.NewNop())
+	go hub.Run()
+	stuck := func() *Client {
+		c := &Client{hub: hub, conn: newServerConn(t), send: make(chan interface{})}
+		hub.newConnection <- c
+		return c
+	}
+	replaced := stuck()
+	session := &Session{clients: map[*Client]bool{replaced: true}}
+	returned := make(chan struct{})
+	go func() {
+		replaceClients(session)
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("replaceClients waited for client")
+	}
+	closed := stuck()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	hub.Shutdown(ctx)
+	if ctx.Err() != nil {
+		t.Fatal("shutdown waited for client")
+	}
+	for _, c := range []*Client{replaced, closed} {
+		if err := c.conn.WriteMessage(websocket.TextMessage, []byte("{}")); err == nil {
+			t.Error("stuck client wasn't disconnected")
+		}
+	}
+}
+
+func TestFramesArentLogged(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	store := &countingStore{MemoryStore: newTestStore(t, moveAnswers)}
+	tokens := auth.NewMemoryTokenStore(time.Hour)
+	hub := NewGameHub(store, tokens, SessionsTakeover, 0, 1, zap.New(core))
+	s := serveHub(t, hub, store, tokens)
+	_, token := s.login(t, "player")
+	conn := s.dial(t, "")
+	send(t, conn, ChannelAuth, `{"authToken": "`+token+`"}`)
+	expectReply(t, conn, ChannelAuth)
+	conn.Close()
+	s.shutdown()
+	if logs.FilterMessage("Message received").Len() == 0 {
+		t.Error("received message wasn't logged")
+	}
+	for _, entry := range logs.All() {
+		logged, _ := json.Marshal(entry.ContextMap())
+		if strings.Contains(entry.Message+string(logged), token) {
+			t.Errorf("token was logged: %s %s", entry.Message, logged)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package src
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/revan730/gamedev-backend/db"
+	"github.com/revan730/gamedev-backend/types"
+)
+
+func (s *Server) KickUserHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params, user *types.User) {
+	userId, ok := s.idParam(w, p)
+	if ok == false {
+		return
+	}
+	err := s.hub.KickUser(userId)
+	if err != nil {
+		s.logError("Kick user error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.writeResponse(w, &map[string]interface{}{"err": nil}, http.StatusOK)
+}
+
+type announcementMessage struct {
+	Message string `json:"message"`
+}
+
+func (s *Server) AnnouncementHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params, user *types.User) {
+	var announcement announcementMessage
+	err := readJSON(r.Body, &announcement)
+	if err != nil {
+		s.logError("JSON read error", err)
+		s.writeResponse(w, &map[string]string{"err": "Bad json"}, http.StatusBadRequest)
+		return
+	}
+	if announcement.Message == "" {
+		s.writeResponse(w, &map[string]string{"err": "Empty message"}, http.StatusBadRequest)
+		return
+	}
+	s.hub.Announce(announcement.Message)
+	s.writeResponse(w, &map[string]interface{}{"err": nil}, http.StatusOK)
+}
+
+type roleMessage struct {
+	Role string `json:"role"`
+}
+
+func (s *Server) SetUserRoleHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params, user *types.User) {
+	userId, ok := s.idParam(w, p)
+	if ok == false {
+		return
+	}
+	var role roleMessage
+	err := readJSON(r.Body, &role)
+	if err != nil {
+		s.logError("JSON read error", err)
+		s.writeResponse(w, &map[string]string{"err": "Bad json"}, http.StatusBadRequest)
+		return
+	}
+	if types.IsRole(role.Role) == false {
+		s.writeResponse(w, &map[string]string{"err": "Unknown role"}, http.StatusBadRequest)
+		return
+	}
+	err = s.databaseClient.SetUserRole(userId, role.Role)
+	if err == db.ErrNotFound {
+		s.writeResponse(w, &map[string]string{"err": "User not found"}, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.logError("Set user role error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.writeResponse(w, &map[string]interface{}{"err": nil}, http.StatusOK)
+}
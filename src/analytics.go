@@ -0,0 +1,38 @@
+package src
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/revan730/gamedev-backend/types"
+)
+
+func (s *Server) AnswerStatsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params, user *types.User) {
+	stats, err := s.databaseClient.AnswerPickRates()
+	if err != nil {
+		s.logError("Answer stats error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.writeResponse(w, &map[string]interface{}{"answers": stats}, http.StatusOK)
+}
+
+func (s *Server) DropOffStatsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params, user *types.User) {
+	dropOffs, err := s.databaseClient.PageDropOffs()
+	if err != nil {
+		s.logError("Drop-off stats error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.writeResponse(w, &map[string]interface{}{"pages": dropOffs}, http.StatusOK)
+}
+
+func (s *Server) EndingStatsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params, user *types.User) {
+	endings, err := s.databaseClient.EndingDistribution()
+	if err != nil {
+		s.logError("Ending stats error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.writeResponse(w, &map[string]interface{}{"endings": endings}, http.StatusOK)
+}
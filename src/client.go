@@ -1,14 +1,22 @@
 package src
 
 import (
-	"errors"
+	"encoding/json"
 	"fmt"
+	"math/rand"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
+	"github.com/revan730/gamedev-backend/auth"
+	"github.com/revan730/gamedev-backend/db"
 	"github.com/revan730/gamedev-backend/lua"
 	"github.com/revan730/gamedev-backend/types"
+	"go.uber.org/zap"
 )
 
 const (
@@ -23,6 +31,30 @@ const (
 
 	// Maximum message size allowed from peer.
 	maxMessageSize = 512
+
+	// Maximum number of save slots per user.
+	maxSaveSlots = 10
+
+	// Maximum length of save slot name.
+	maxSlotNameLength = 32
+
+	// Maximum number of transitions kept in user's history.
+	maxHistoryLength = 50
+
+	// Time allowed to authorize with "auth" message after connecting.
+	authWait = 10 * time.Second
+
+	// Close code sent to clients whose token was revoked.
+	closeTokenRevoked = 4001
+
+	// Close code sent to clients replaced by user's new connection.
+	closeSessionReplaced = 4002
+
+	// Close code sent to clients which didn't authorize in time.
+	closeAuthTimeout = 4003
+
+	// Close code sent to clients of kicked user.
+	closeKicked = 4004
 )
 
 var upgrader = websocket.Upgrader{
@@ -39,56 +71,233 @@ var (
 )
 
 type Client struct {
-	conn     *websocket.Conn
-	hub      *GameHub
+	conn *websocket.Conn
+	hub  *GameHub
+	// User, token and session of client are set by hub
 	userData *types.User
-	send     chan interface{}
+	// Hash of token client was authorized with
+	tokenHash string
+	// Role carried in client's token
+	role string
+	// Run of user, shared with user's other clients
+	session *Session
+	// Random id of websocket session, used in playthrough log
+	sessionId string
+	// Source of randomness for jumper scripts, seeded by session id
+	rand *rand.Rand
+	// Text emitted by jumper scripts, shown after the next page text
+	pageOutput []string
+	send       chan interface{}
+	// 1 once client has sent message of LegacyProtocolVersion,
+	// then it gets messages in legacy format
+	legacy int32
+	// Closed once client is authorized
+	authorized     chan struct{}
+	authorizedOnce sync.Once
 }
 
-func (c *Client) Authorize(authToken string) {
-	// Get client's session from db via hub
-	session := c.hub.GetSessionByToken(authToken)
-	responseMap := map[string]interface{}{
-		"channel":  "auth",
-		"response": false,
+// Authorize authorizes client with token from "auth" message. User
+// is loaded from DB only if user has no running session on this node
+func (c *Client) Authorize(msg *ClientMessage, authToken string) {
+	identity, ok := c.hub.ResolveToken(authToken)
+	if ok == false {
+		c.replyError(msg, newClientError(ErrCodeInvalidToken, "token is invalid or expired"))
+		return
+	}
+	if c.session != nil {
+		// Client can't switch to another user
+		if identity.UserId != c.userData.Id {
+			c.replyError(msg, newClientError(ErrCodeAlreadyAuthorized, "already authorized as another user"))
+			return
+		}
+		c.hub.Reauthorize(c, authToken, identity.Role)
+		c.reply(msg, nil)
+		c.sendState()
+		return
 	}
-	if session == nil {
-		// Write message informing that authorization failed
-		c.sendJSON(responseMap)
+	if err := c.authorize(identity, authToken); err != nil {
+		c.replyError(msg, err)
 		return
 	}
-	// Inform user that authorization was successfull
-	// And send session data
-	c.userData = session
+	c.reply(msg, nil)
+	c.sendState()
+}
+
+// authorize joins client to user's session
+func (c *Client) authorize(identity auth.Identity, authToken string) *ClientError {
+	_, err := c.hub.Join(c, identity, authToken)
+	if err == ErrNotReleased {
+		return newClientError(ErrCodeSessionBusy, "run is still held by another server, try again")
+	}
+	if err != nil {
+		return newClientError(ErrCodeStorage, "user can't be loaded, try again later")
+	}
+	c.authorizedOnce.Do(func() {
+		close(c.authorized)
+	})
+	return nil
+}
+
+// sendState sends stats and current page of run
+func (c *Client) sendState() {
+	c.session.mu.Lock()
+	defer c.session.mu.Unlock()
 	c.SendSessionInfo()
 	c.SendCurrentPage()
 }
 
+// stateChanged marks session to be saved and sends
+// new state to every client of session
+func (c *Client) stateChanged() {
+	c.session.dirty = true
+	c.broadcastState()
+}
+
+// broadcastState sends stats and current page
+// to every client of session
+func (c *Client) broadcastState() {
+	for client := range c.session.clients {
+		client.SendSessionInfo()
+		client.SendCurrentPage()
+	}
+}
+
+// awaitAuth disconnects client if it isn't authorized in time
+func (c *Client) awaitAuth() {
+	select {
+	case <-c.authorized:
+	case <-time.After(authWait):
+		c.Disconnect(closeAuthTimeout, "authorization timeout")
+	}
+}
+
+// closeMessage makes Writer close connection after
+// sending everything queued before it
+type closeMessage struct {
+	code   int
+	reason string
+}
+
+// Disconnect closes client's connection with close code and reason,
+// Reader then unregisters client from hub
+func (c *Client) Disconnect(code int, reason string) {
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(writeWait))
+	c.conn.Close()
+}
+
 func (c *Client) sendJSON(d interface{}) {
 	//j, _ := json.Marshal(d)
+	if atomic.LoadInt32(&c.legacy) == 1 {
+		d = legacyMessage(d)
+	}
 	c.send <- d
 }
 
+// trySendJSON queues message without waiting, client which doesn't
+// take messages is disconnected. Hub sends with it, so that it isn't
+// blocked by client whose Writer has exited
+func (c *Client) trySendJSON(d interface{}) {
+	if atomic.LoadInt32(&c.legacy) == 1 {
+		d = legacyMessage(d)
+	}
+	select {
+	case c.send <- d:
+	default:
+		c.conn.Close()
+	}
+}
+
 // TODO: Very likely to be changed
 func (c *Client) SendSessionInfo() {
-	jsonMap := map[string]interface{}{
-		"channel": "stats",
+	c.push(ChannelStats, c.userData)
+}
+
+// sendError sends error which isn't a response to particular message
+func (c *Client) sendError(err *ClientError) {
+	c.sendJSON(ServerMessage{Version: ProtocolVersion, Channel: ChannelError, Error: err})
+}
+
+// currentPage returns page run is on. Run on missing page is moved to
+// the safe page and client is told about it. nil is returned if page
+// can't be loaded or safe page is missing too
+func (c *Client) currentPage() *types.Page {
+	page, err := c.hub.FindPage(c.userData.StoryVersion, c.userData.CurrentPage)
+	if err == nil {
+		return page
+	}
+	atomic.AddInt64(&c.hub.incidents.MissingPages, 1)
+	c.hub.logError(fmt.Sprintf("Unable to get page %d of version %d",
+		c.userData.CurrentPage, c.userData.StoryVersion), err)
+	if err != db.ErrNotFound {
+		c.sendError(newClientError(ErrCodePageUnavailable, "page can't be loaded, try again later"))
+		return nil
+	}
+	c.sendError(newClientError(ErrCodePageNotFound, "current page is missing"))
+	if c.userData.CurrentPage == c.hub.safePage {
+		return nil
+	}
+	page = c.hub.GetPage(c.userData.StoryVersion, c.hub.safePage)
+	if page == nil {
+		return nil
 	}
-	jsonMap["stats"] = c.userData
-	c.sendJSON(jsonMap)
+	// Rolling back would lead to the missing page again
+	c.session.history = nil
+	c.userData.CurrentPage = page.Id
+	c.session.dirty = true
+	return page
 }
 
 func (c *Client) SendCurrentPage() {
-	jsonMap := map[string]interface{}{
-		"channel": "story_text",
+	page := c.currentPage()
+	if page == nil {
+		return
+	}
+	text := StoryText{Text: page.Text}
+	if len(c.pageOutput) != 0 {
+		text.Text = page.Text + "\n\n" + strings.Join(c.pageOutput, "\n")
+		c.pageOutput = nil
 	}
-	page := c.hub.GetPage(c.userData.CurrentPage)
-	jsonMap["text"] = page.Text
 	if page.IsQuestion == true {
-		answers := c.hub.GetPageAnswers(page.Id)
-		jsonMap["answers"] = answers
+		text.Answers = c.visibleAnswers(page)
+	}
+	c.push(ChannelStoryText, text)
+}
+
+// scriptEnv returns environment for Lua scripts run on page
+func (c *Client) scriptEnv(user *types.User, page *types.Page, answerId int64) *lua.Env {
+	return &lua.Env{
+		User:       user,
+		Page:       page,
+		LastAnswer: c.lastAnswer(answerId),
+		Rand:       c.rand,
+	}
+}
+
+// isAnswerVisible evaluates answer's condition, answers
+// with broken conditions are hidden
+func (c *Client) isAnswerVisible(page *types.Page, answer *types.Answer) bool {
+	env := c.scriptEnv(c.userData, page, 0)
+	env.Rand = rand.New(rand.NewSource(conditionSeed(c.sessionId, page.Id, answer.Id)))
+	interpreter := lua.NewInterpreter(env)
+	visible, err := interpreter.IsAnswerVisible(answer)
+	if err != nil {
+		c.hub.logError(fmt.Sprintf("Condition of answer %d failed", answer.Id), err)
+		return false
+	}
+	return visible
+}
+
+// visibleAnswers returns page answers which user is allowed to pick
+func (c *Client) visibleAnswers(page *types.Page) []types.Answer {
+	answers := c.hub.GetPageAnswers(c.userData.StoryVersion, page.Id)
+	visible := make([]types.Answer, 0, len(answers))
+	for i := range answers {
+		if c.isAnswerVisible(page, &answers[i]) {
+			visible = append(visible, answers[i])
+		}
 	}
-	c.sendJSON(jsonMap)
+	return visible
 }
 
 // TODO: Using reflect?
@@ -102,20 +311,35 @@ func (c *Client) recalculateStats(answer *types.Answer) {
 }
 
 // NextPage proceeds game session to next page
-// handles questions and jump logic
-func (c *Client) NextPage(jsonMap map[string]interface{}) error {
-	currentPage := c.hub.GetPage(c.userData.CurrentPage)
+// handles questions and jump logic. Rejected moves
+// are reported with *ClientError
+func (c *Client) NextPage(answerId int64) *ClientError {
+	pageId := c.userData.CurrentPage
+	currentPage := c.currentPage()
+	if currentPage == nil || currentPage.Id != pageId {
+		return newClientError(ErrCodePageNotFound, "can't move from missing page")
+	}
+	before := *c.userData
+	if currentPage.IsQuestion == false {
+		// Answers are picked only on question pages
+		answerId = 0
+	}
 	// Check if current page has questions
 	// and handle them
 	if currentPage.IsQuestion == true {
 		// Load answer
-		answerId, ok := jsonMap["answerId"].(float64)
-		if ok == false {
-			return errors.New("NextPage: bad or missing answerId")
+		if answerId == 0 {
+			return newClientError(ErrCodeBadAnswer, "missing answerId")
 		}
-		answer := c.hub.GetAnswer(int64(answerId))
+		answer := c.hub.GetAnswer(c.userData.StoryVersion, answerId)
 		if answer == nil {
-			return errors.New("NextPage: answer not found")
+			return newClientError(ErrCodeAnswerNotFound, "answer not found")
+		}
+		if answer.PageId != currentPage.Id {
+			return newClientError(ErrCodeForeignAnswer, "answer belongs to another page")
+		}
+		if c.isAnswerVisible(currentPage, answer) == false {
+			return newClientError(ErrCodeHiddenAnswer, "answer is hidden")
 		}
 		// Recalculate user stats and set flags according to
 		// answer values
@@ -123,79 +347,325 @@ func (c *Client) NextPage(jsonMap map[string]interface{}) error {
 		c.userData.MergeFlags(answer.Flags)
 	}
 	if currentPage.IsJumper == true {
-		interpreter := lua.NewInterpreter(c.userData)
-		interpreter.DoString(currentPage.JumperLogic)
+		// Script works on a copy, so failed run
+		// doesn't leave user half-updated
+		jumped := *c.userData
+		env := c.scriptEnv(&jumped, currentPage, answerId)
+		err := lua.NewInterpreter(env).DoPage()
+		if err != nil {
+			c.hub.logError(fmt.Sprintf("Jumper script of page %d failed", currentPage.Id), err)
+			*c.userData = before
+			return newClientError(ErrCodeScriptFailed, "page script failed")
+		}
+		*c.userData = jumped
+		c.pageOutput = env.Output
+		c.recordTransition(before, answerId, true)
+		c.logEvent(types.EventMove, currentPage.Id, answerId, before)
 		return nil
 	} else {
 		// If next page is null here, story has come to end
 		// Restart from first page and reset stats and flags(?)
 		if currentPage.NextPage == 0 {
+			c.logEvent(types.EventEnding, currentPage.Id, answerId, before)
 			c.ResetStory()
 		} else {
 			// Linear transition
 			c.userData.CurrentPage = currentPage.NextPage
+			c.recordTransition(before, answerId, false)
+			c.logEvent(types.EventMove, currentPage.Id, answerId, before)
 		}
 		return nil
 	}
 }
 
+// lastAnswer returns id of the answer picked on current move,
+// or the last one picked earlier in the run
+func (c *Client) lastAnswer(answerId int64) int64 {
+	if answerId != 0 {
+		return answerId
+	}
+	for i := len(c.session.history) - 1; i >= 0; i-- {
+		if c.session.history[i].AnswerId != 0 {
+			return c.session.history[i].AnswerId
+		}
+	}
+	return 0
+}
+
+// recordTransition appends transition from before state
+// to the current one to user's history
+func (c *Client) recordTransition(before types.User, answerId int64, jumped bool) {
+	entry := types.HistoryEntry{
+		UserId:       c.userData.Id,
+		FromPage:     before.CurrentPage,
+		ToPage:       c.userData.CurrentPage,
+		AnswerId:     answerId,
+		Delta:        c.userData.Stats().Sub(before.Stats()),
+		FlagsAdded:   types.AddedFlags(before.Flags, c.userData.Flags),
+		FlagsRemoved: types.AddedFlags(c.userData.Flags, before.Flags),
+		Jumped:       jumped,
+		CreatedAt:    time.Now(),
+	}
+	c.session.history = append(c.session.history, entry)
+	if len(c.session.history) > maxHistoryLength {
+		c.session.history = c.session.history[len(c.session.history)-maxHistoryLength:]
+	}
+}
+
+// logEvent appends event to playthrough log, before
+// is user's state prior to the event
+func (c *Client) logEvent(kind string, pageId, answerId int64, before types.User) {
+	c.hub.LogEvent(&types.StoryEvent{
+		UserId:      c.userData.Id,
+		SessionId:   c.sessionId,
+		Kind:        kind,
+		PageId:      pageId,
+		AnswerId:    answerId,
+		StatsBefore: before.Stats(),
+		StatsAfter:  c.userData.Stats(),
+		Flags:       c.userData.Flags,
+		CreatedAt:   time.Now(),
+		// Reset moves run to another version
+		StoryVersion: before.StoryVersion,
+	})
+}
+
+// StepBack rolls back up to steps last transitions,
+// returning false if there is nothing to roll back
+func (c *Client) StepBack(steps int) bool {
+	if len(c.session.history) == 0 || steps < 1 {
+		return false
+	}
+	if steps > len(c.session.history) {
+		steps = len(c.session.history)
+	}
+	for i := len(c.session.history) - 1; i >= len(c.session.history)-steps; i-- {
+		c.session.history[i].Revert(c.userData)
+	}
+	c.session.history = c.session.history[:len(c.session.history)-steps]
+	return true
+}
+
+// can returns true if permission is granted both by role
+// carried in client's token and by user's role
+func (c *Client) can(permission string) bool {
+	return types.Can(c.role, permission) && types.Can(c.userData.Role, permission)
+}
+
+// GoToPage moves user to page without picking answers, so writers
+// can check any page. Move is recorded, so it can be stepped back
+func (c *Client) GoToPage(pageId int64) {
+	before := *c.userData
+	c.userData.CurrentPage = pageId
+	c.recordTransition(before, 0, true)
+}
+
+// ResetStory starts new run on the latest published story version
 func (c *Client) ResetStory() {
 	c.userData.Reset()
-	c.SendSessionInfo()
+	c.session.history = nil
+	c.pinLatestVersion()
+}
+
+// pinLatestVersion moves run to the latest published story version,
+// run keeps its version if the latest one is unknown
+func (c *Client) pinLatestVersion() {
+	latest, ok := c.hub.LatestVersion()
+	if ok {
+		c.userData.StoryVersion = latest
+	}
+}
+
+// slotName returns trimmed save slot name,
+// ok is false if it's empty or too long
+func slotName(name string) (string, bool) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > maxSlotNameLength {
+		return "", false
+	}
+	return name, true
+}
+
+// SaveSlot saves current run to named slot, overwriting
+// existing one with the same name
+func (c *Client) SaveSlot(name string) *ClientError {
+	err := c.hub.SaveSlot(c.userData, name)
+	if err == db.ErrLimitReached {
+		return newClientError(ErrCodeSlotLimit, fmt.Sprintf("user can't have more than %d slots", maxSaveSlots))
+	}
+	if err != nil {
+		return newClientError(ErrCodeStorage, "slot couldn't be saved")
+	}
+	return nil
+}
+
+// LoadSlot replaces current run with one from named slot
+func (c *Client) LoadSlot(name string) bool {
+	slot := c.hub.GetSlot(c.userData.Id, name)
+	if slot == nil {
+		return false
+	}
+	c.userData.LoadSlot(slot)
+	c.session.history = nil
+	// Slot was saved before story versions
+	if slot.StoryVersion == 0 {
+		c.pinLatestVersion()
+	}
+	return true
 }
 
-func (c *Client) HandleStoryMessages(jsonMap map[string]interface{}) {
-	responseMap := map[string]interface{}{
-		"channel":  "story",
-		"response": false,
+// handleSlotMessage handles messages of save slot channels
+func (c *Client) handleSlotMessage(msg *ClientMessage) {
+	if msg.Channel == ChannelListSlots {
+		slots, ok := c.hub.GetUserSlots(c.userData.Id)
+		if ok == false {
+			c.replyError(msg, newClientError(ErrCodeStorage, "slots couldn't be loaded"))
+			return
+		}
+		if slots == nil {
+			slots = []types.SaveSlot{}
+		}
+		c.reply(msg, SlotList{Slots: slots})
+		return
+	}
+	var request SlotRequest
+	if c.readData(msg, &request) == false {
+		return
+	}
+	name, ok := slotName(request.Name)
+	if ok == false {
+		c.replyError(msg, newClientError(ErrCodeBadSlotName,
+			fmt.Sprintf("slot name must have 1 to %d characters", maxSlotNameLength)))
+		return
+	}
+	switch msg.Channel {
+	case ChannelSaveSlot:
+		err := c.SaveSlot(name)
+		if err != nil {
+			c.replyError(msg, err)
+			return
+		}
+		c.reply(msg, nil)
+	case ChannelLoadSlot:
+		if c.LoadSlot(name) == false {
+			c.replyError(msg, newClientError(ErrCodeSlotNotFound, "there is no such slot"))
+			return
+		}
+		c.reply(msg, nil)
+		c.stateChanged()
+	case ChannelDeleteSlot:
+		if c.hub.DeleteSlot(c.userData.Id, name) == false {
+			c.replyError(msg, newClientError(ErrCodeSlotNotFound, "there is no such slot"))
+			return
+		}
+		c.reply(msg, nil)
 	}
-	switch jsonMap["channel"] {
-	case "story_save":
+}
+
+// handleStoryMessage handles messages changing run
+func (c *Client) handleStoryMessage(msg *ClientMessage) {
+	switch msg.Channel {
+	case ChannelSave:
 		// Save user's progress
-		responseMap["response"] = c.hub.SaveUserSession(c.userData)
-		responseMap["channel"] = "story_save"
-		c.sendJSON(responseMap)
-	case "story_move":
-		err := c.NextPage(jsonMap)
+		if c.hub.SaveSession(c.session) == false {
+			c.replyError(msg, newClientError(ErrCodeStorage, "run couldn't be saved"))
+			return
+		}
+		c.reply(msg, nil)
+	case ChannelMove:
+		var request MoveRequest
+		if c.readData(msg, &request) == false {
+			return
+		}
+		pageId := c.userData.CurrentPage
+		err := c.NextPage(request.AnswerId)
 		if err != nil {
-			fmt.Println("Failed to go to next page: ", err)
-			responseMap["channel"] = "story_move"
-			c.sendJSON(responseMap)
+			c.hub.AuditRejectedMove(c.userData.Id, c.sessionId, pageId, request.AnswerId, err)
+			c.replyError(msg, err)
+			if c.userData.CurrentPage != pageId {
+				// Run was moved to the safe page
+				c.stateChanged()
+			}
 			return
 		}
-		c.SendSessionInfo()
-		c.SendCurrentPage()
-	case "story_reset":
+		c.reply(msg, nil)
+		c.stateChanged()
+	case ChannelReset:
+		before := *c.userData
 		c.ResetStory()
-		c.SendCurrentPage()
-	default:
-		// Unknown method
-		c.sendJSON(responseMap)
+		c.logEvent(types.EventReset, before.CurrentPage, 0, before)
+		c.reply(msg, nil)
+		c.stateChanged()
+	case ChannelBack:
+		var request BackRequest
+		if c.readData(msg, &request) == false {
+			return
+		}
+		steps := request.Steps
+		if steps == 0 {
+			steps = 1
+		}
+		if c.StepBack(steps) == false {
+			c.replyError(msg, newClientError(ErrCodeNothingToRollBack, "there is nothing to roll back"))
+			return
+		}
+		c.reply(msg, nil)
+		c.stateChanged()
+	case ChannelGoTo:
+		if c.can(types.PermPreviewStory) == false {
+			c.replyError(msg, newClientError(ErrCodeForbidden, "role doesn't allow going to pages"))
+			return
+		}
+		var request GoToRequest
+		if c.readData(msg, &request) == false {
+			return
+		}
+		if c.hub.GetPage(c.userData.StoryVersion, request.PageId) == nil {
+			c.replyError(msg, newClientError(ErrCodePageNotFound, "there is no such page"))
+			return
+		}
+		c.GoToPage(request.PageId)
+		c.reply(msg, nil)
+		c.stateChanged()
 	}
 }
 
-func (c *Client) HandleClientMessage(jsonInt interface{}) {
-	jsonMap := jsonInt.(map[string]interface{})
-	switch jsonMap["channel"] {
-	case "auth":
-		responseMap := map[string]interface{}{
-			"channel":  "auth",
-			"response": false,
+// HandleClientMessage handles message of any channel,
+// messages of authorized users are handled one at a time
+func (c *Client) HandleClientMessage(msg *ClientMessage) {
+	if msg.Version != ProtocolVersion && msg.Version != LegacyProtocolVersion {
+		c.replyError(msg, newClientError(ErrCodeBadVersion,
+			fmt.Sprintf("protocol version must be %d", ProtocolVersion)))
+		return
+	}
+	if isClientChannel(msg.Channel) == false {
+		c.replyError(msg, newClientError(ErrCodeUnknownChannel, "unknown channel"))
+		return
+	}
+	if msg.Channel != ChannelAuth {
+		if c.session == nil {
+			c.replyError(msg, newClientError(ErrCodeUnauthorized, "authorize first"))
+			return
 		}
-		token, ok := jsonMap["authToken"].(string)
-		if ok != true {
-			c.sendJSON(responseMap)
+		// Messages of user's clients are handled one at a time
+		c.session.mu.Lock()
+		defer c.session.mu.Unlock()
+		if c.session.clients[c] == false || c.session.closed {
+			// Client was replaced or server is shutting down
 			return
 		}
-		c.Authorize(token)
-	case "story_move":
-		c.HandleStoryMessages(jsonMap)
-	case "story_save":
-		c.HandleStoryMessages(jsonMap)
-	case "story_reset":
-		c.HandleStoryMessages(jsonMap)
-	default:
-		c.sendJSON(map[string]string{"err": "wtf"})
+	}
+	switch msg.Channel {
+	case ChannelAuth:
+		var request AuthRequest
+		if c.readData(msg, &request) == false {
+			return
+		}
+		c.Authorize(msg, request.AuthToken)
+	case ChannelMove, ChannelSave, ChannelReset, ChannelBack, ChannelGoTo:
+		c.handleStoryMessage(msg)
+	case ChannelSaveSlot, ChannelLoadSlot, ChannelListSlots, ChannelDeleteSlot:
+		c.handleSlotMessage(msg)
 	}
 }
 
@@ -209,25 +679,51 @@ func (c *Client) Reader() {
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
 
-	var msg interface{}
 	for {
-		err := c.conn.ReadJSON(&msg)
+		_, data, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				fmt.Printf("error: %v", err)
+				c.hub.logDebug("Connection closed unexpectedly", zap.Error(err))
 			}
 			break
 		}
-		fmt.Printf("Message: %s", msg)
-		c.HandleClientMessage(msg)
+		c.hub.logDebug("Message received", zap.Int("bytes", len(data)))
+		c.handleMessage(data)
 	}
 }
 
+// handleMessage decodes and handles client message, recovering
+// from panic so that it doesn't take the connection down
+func (c *Client) handleMessage(data []byte) {
+	var msg ClientMessage
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			atomic.AddInt64(&c.hub.incidents.Panics, 1)
+			c.hub.logPanic("Message handler panicked", recovered)
+			c.replyError(&msg, newClientError(ErrCodeInternal, "message couldn't be handled"))
+		}
+	}()
+	err := json.Unmarshal(data, &msg)
+	if err != nil {
+		c.sendError(newClientError(ErrCodeBadMessage, "message must be a JSON object"))
+		return
+	}
+	if msg.Version == LegacyProtocolVersion {
+		// Legacy messages have data fields at top level
+		msg.Data = data
+		if atomic.CompareAndSwapInt32(&c.legacy, 0, 1) {
+			c.hub.logInfo("Session " + c.sessionId + " uses deprecated unversioned protocol")
+		}
+	}
+	c.HandleClientMessage(&msg)
+}
+
 func (c *Client) Writer() {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
+		c.hub.writers.Done()
 	}()
 	for {
 		select {
@@ -239,6 +735,11 @@ func (c *Client) Writer() {
 				return
 			}
 
+			if closing, ok := message.(closeMessage); ok {
+				c.conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(closing.code, closing.reason))
+				return
+			}
 			c.conn.WriteJSON(message)
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
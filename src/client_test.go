@@ -0,0 +1,332 @@
+package src
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/revan730/gamedev-backend/db"
+	"github.com/revan730/gamedev-backend/types"
+	"go.uber.org/zap"
+)
+
+const testSessionId = "0123456789abcdef0123456789abcdef"
+
+// testPages is a story with question page 1 leading to page 2
+var testPages = []types.Page{
+	{Id: 1, IsQuestion: true, NextPage: 2, Text: "Go to the lecture?"},
+	{Id: 2, IsQuestion: true, NextPage: 3, Text: "Lecture"},
+	{Id: 3, Text: "The end"},
+}
+
+// newTestStore returns memory store with testPages and answers
+func newTestStore(t *testing.T, answers []types.Answer) *db.MemoryStore {
+	store := db.NewMemoryStore()
+	err := store.ReplaceStory(nil, nil, testPages, answers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// newStoreClient returns client of user playing story from store
+// on a hub of its own, as if every client was on another server
+func newStoreClient(store db.Store, user *types.User) *Client {
+	hub := NewGameHub(store, nil, SessionsTakeover, 0, 1, zap.NewNop())
+	c := &Client{
+		hub:       hub,
+		userData:  user,
+		sessionId: testSessionId,
+		rand:      rand.New(rand.NewSource(sessionSeed(testSessionId))),
+		send:      make(chan interface{}, 16),
+	}
+	c.session = &Session{userData: user, clients: map[*Client]bool{c: true}}
+	return c
+}
+
+// newTestClient returns client playing story from memory store,
+// user is on page 1 of the draft
+func newTestClient(t *testing.T, answers []types.Answer) (*Client, *db.MemoryStore) {
+	store := newTestStore(t, answers)
+	return newStoreClient(store, &types.User{Id: 1, CurrentPage: 1}), store
+}
+
+func answerIds(answers []types.Answer) []int64 {
+	ids := make([]int64, len(answers))
+	for i, answer := range answers {
+		ids[i] = answer.Id
+	}
+	return ids
+}
+
+func TestRandomConditionIsStable(t *testing.T) {
+	var answers []types.Answer
+	for id := int64(1); id <= 8; id++ {
+		answers = append(answers, types.Answer{Id: id, PageId: 1, Text: "Maybe",
+			Condition: "random(1, 2) == 1"})
+	}
+	c, _ := newTestClient(t, answers)
+	page := c.currentPage()
+	visible := answerIds(c.visibleAnswers(page))
+	if len(visible) == 0 || len(visible) == len(answers) {
+		t.Fatalf("condition doesn't depend on answer: %v visible", visible)
+	}
+	for i := 0; i < 5; i++ {
+		again := answerIds(c.visibleAnswers(page))
+		if len(again) != len(visible) {
+			t.Fatalf("visible answers changed from %v to %v", visible, again)
+		}
+		for j := range again {
+			if again[j] != visible[j] {
+				t.Fatalf("visible answers changed from %v to %v", visible, again)
+			}
+		}
+	}
+	expected := rand.New(rand.NewSource(sessionSeed(testSessionId))).Int63()
+	if c.rand.Int63() != expected {
+		t.Error("conditions advanced randomness of session")
+	}
+	err := c.NextPage(visible[0])
+	if err != nil {
+		t.Fatalf("shown answer was rejected: %v", err)
+	}
+	if c.userData.CurrentPage != 2 {
+		t.Errorf("expected page 2, got %d", c.userData.CurrentPage)
+	}
+}
+
+func TestNextPageRejectsAnswers(t *testing.T) {
+	answers := []types.Answer{
+		{Id: 1, PageId: 1, Text: "Sure", Knowledge: 1},
+		{Id: 2, PageId: 1, Text: "Ask the dean", Condition: `flagCheck("dean_friend")`},
+		{Id: 3, PageId: 2, Text: "Listen", Knowledge: 1},
+	}
+	cases := []struct {
+		name     string
+		answerId int64
+		code     string
+	}{
+		{"answer of another page", 3, ErrCodeForeignAnswer},
+		{"hidden answer", 2, ErrCodeHiddenAnswer},
+		{"missing answer id", 0, ErrCodeBadAnswer},
+		{"unknown answer id", 42, ErrCodeAnswerNotFound},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, _ := newTestClient(t, answers)
+			err := c.NextPage(tc.answerId)
+			if err == nil {
+				t.Fatal("move was accepted")
+			}
+			if err.Code != tc.code {
+				t.Errorf("expected %s, got %s", tc.code, err.Code)
+			}
+			if c.userData.CurrentPage != 1 || c.userData.Knowledge != 0 {
+				t.Errorf("run has moved to page %d", c.userData.CurrentPage)
+			}
+			if len(c.session.history) != 0 {
+				t.Error("rejected move was recorded in history")
+			}
+		})
+	}
+}
+
+// request handles message of client and returns its response,
+// pushes sent along with it are dropped
+func request(t *testing.T, c *Client, message string) map[string]interface{} {
+	c.handleMessage([]byte(message))
+	messages := sent(t, c)
+	if len(messages) == 0 {
+		t.Fatalf("no response to %s", message)
+	}
+	return messages[0]
+}
+
+// errorCode returns code of error in response, "" if it succeeded
+func errorCode(response map[string]interface{}) string {
+	clientErr, _ := response["error"].(map[string]interface{})
+	code, _ := clientErr["code"].(string)
+	return code
+}
+
+func TestSlots(t *testing.T) {
+	c, _ := newTestClient(t, moveAnswers)
+	response := request(t, c, `{"v": 1, "channel": "story_save_slot", "data": {"name": " first day "}}`)
+	if code := errorCode(response); code != "" {
+		t.Fatalf("slot wasn't saved: %s", code)
+	}
+	request(t, c, `{"v": 1, "channel": "story_move", "data": {"answerId": 1}}`)
+	response = request(t, c, `{"v": 1, "channel": "story_list_slots"}`)
+	slots := response["data"].(map[string]interface{})["slots"].([]interface{})
+	if len(slots) != 1 || slots[0].(map[string]interface{})["name"] != "first day" {
+		t.Errorf("expected slot \"first day\", got %v", slots)
+	}
+	response = request(t, c, `{"v": 1, "channel": "story_load_slot", "data": {"name": "first day"}}`)
+	if code := errorCode(response); code != "" {
+		t.Fatalf("slot wasn't loaded: %s", code)
+	}
+	if c.userData.CurrentPage != 1 || c.userData.Knowledge != 0 || len(c.session.history) != 0 {
+		t.Errorf("run wasn't replaced with slot: page %d", c.userData.CurrentPage)
+	}
+	response = request(t, c, `{"v": 1, "channel": "story_delete_slot", "data": {"name": "first day"}}`)
+	if code := errorCode(response); code != "" {
+		t.Fatalf("slot wasn't deleted: %s", code)
+	}
+	for _, channel := range []string{ChannelLoadSlot, ChannelDeleteSlot} {
+		response = request(t, c, `{"v": 1, "channel": "`+channel+`", "data": {"name": "first day"}}`)
+		if code := errorCode(response); code != ErrCodeSlotNotFound {
+			t.Errorf("expected %s from %s, got %q", ErrCodeSlotNotFound, channel, code)
+		}
+	}
+	response = request(t, c, `{"v": 1, "channel": "story_save_slot", "data": {"name": "  "}}`)
+	if code := errorCode(response); code != ErrCodeBadSlotName {
+		t.Errorf("expected %s, got %q", ErrCodeBadSlotName, code)
+	}
+}
+
+func TestSlotLimit(t *testing.T) {
+	c, _ := newTestClient(t, moveAnswers)
+	for i := 0; i < maxSaveSlots; i++ {
+		response := request(t, c, fmt.Sprintf(`{"v": 1, "channel": "story_save_slot", "data": {"name": "slot %d"}}`, i))
+		if code := errorCode(response); code != "" {
+			t.Fatalf("slot %d wasn't saved: %s", i, code)
+		}
+	}
+	response := request(t, c, `{"v": 1, "channel": "story_save_slot", "data": {"name": "one more"}}`)
+	if code := errorCode(response); code != ErrCodeSlotLimit {
+		t.Errorf("expected %s, got %q", ErrCodeSlotLimit, code)
+	}
+	response = request(t, c, `{"v": 1, "channel": "story_save_slot", "data": {"name": "slot 0"}}`)
+	if code := errorCode(response); code != "" {
+		t.Errorf("slot wasn't overwritten at the limit: %s", code)
+	}
+}
+
+func TestGoToNeedsPermissionOfBothRoles(t *testing.T) {
+	cases := []struct {
+		tokenRole, userRole string
+		allowed             bool
+	}{
+		{types.RoleWriter, types.RoleWriter, true},
+		{types.RoleAdmin, types.RoleWriter, true},
+		{types.RolePlayer, types.RolePlayer, false},
+		{types.RoleModerator, types.RoleModerator, false},
+		{types.RoleWriter, types.RolePlayer, false},
+		{types.RolePlayer, types.RoleWriter, false},
+	}
+	for _, tc := range cases {
+		c, _ := newTestClient(t, moveAnswers)
+		c.role = tc.tokenRole
+		c.userData.Role = tc.userRole
+		if c.can(types.PermPreviewStory) != tc.allowed {
+			t.Errorf("token of %s, user %s: expected preview allowed %v", tc.tokenRole, tc.userRole, tc.allowed)
+		}
+		response := request(t, c, `{"v": 1, "channel": "story_goto", "data": {"pageId": 3}}`)
+		code := errorCode(response)
+		if tc.allowed && (code != "" || c.userData.CurrentPage != 3) {
+			t.Errorf("token of %s, user %s: go to wasn't allowed: %q", tc.tokenRole, tc.userRole, code)
+		}
+		if tc.allowed == false && (code != ErrCodeForbidden || c.userData.CurrentPage != 1) {
+			t.Errorf("token of %s, user %s: expected %s, got %q", tc.tokenRole, tc.userRole, ErrCodeForbidden, code)
+		}
+	}
+}
+
+// brokenStore is memory store failing to load pages with errPage
+// and panicking on loads of answers if panics is set
+type brokenStore struct {
+	*db.MemoryStore
+	errPage error
+	panics  bool
+}
+
+func (s *brokenStore) FindPageById(pageId int64) (*types.Page, error) {
+	if s.errPage != nil {
+		return nil, s.errPage
+	}
+	return s.MemoryStore.FindPageById(pageId)
+}
+
+func (s *brokenStore) FindAnswerById(answerId int64) (*types.Answer, error) {
+	if s.panics {
+		panic("answer can't be loaded")
+	}
+	return s.MemoryStore.FindAnswerById(answerId)
+}
+
+// channels returns channels of messages
+func channels(messages []map[string]interface{}) []string {
+	var names []string
+	for _, message := range messages {
+		names = append(names, message["channel"].(string))
+	}
+	return names
+}
+
+func TestMissingPageMovesRunToSafePage(t *testing.T) {
+	c, _ := newTestClient(t, moveAnswers)
+	c.userData.CurrentPage = 99
+	c.session.history = []types.HistoryEntry{{FromPage: 1, ToPage: 99, AnswerId: 1}}
+	c.SendCurrentPage()
+	messages := sent(t, c)
+	if len(messages) < 2 || errorCode(messages[0]) != ErrCodePageNotFound {
+		t.Fatalf("expected %s error, got %v", ErrCodePageNotFound, messages)
+	}
+	if text := messages[len(messages)-1]["data"].(map[string]interface{})["text"]; text != "Go to the lecture?" {
+		t.Errorf("expected text of safe page, got %v", channels(messages))
+	}
+	if c.userData.CurrentPage != 1 || len(c.session.history) != 0 || c.session.dirty == false {
+		t.Errorf("run wasn't moved to safe page: page %d, history %+v", c.userData.CurrentPage, c.session.history)
+	}
+	if incidents := c.hub.Incidents(); incidents.MissingPages != 1 {
+		t.Errorf("expected 1 missing page, got %+v", incidents)
+	}
+}
+
+func TestMissingSafePage(t *testing.T) {
+	store := db.NewMemoryStore()
+	if err := store.ReplaceStory(nil, nil, testPages[1:], nil); err != nil {
+		t.Fatal(err)
+	}
+	c := newStoreClient(store, &types.User{Id: 1, CurrentPage: 99})
+	c.SendCurrentPage()
+	messages := sent(t, c)
+	if len(messages) != 1 || errorCode(messages[0]) != ErrCodePageNotFound {
+		t.Errorf("expected %s error alone, got %v", ErrCodePageNotFound, messages)
+	}
+	if c.userData.CurrentPage != 99 {
+		t.Errorf("run was moved to page %d", c.userData.CurrentPage)
+	}
+}
+
+func TestUnavailablePageKeepsRun(t *testing.T) {
+	store := &brokenStore{MemoryStore: newTestStore(t, moveAnswers), errPage: errors.New("connection refused")}
+	c := newStoreClient(store, &types.User{Id: 1, CurrentPage: 2})
+	c.SendCurrentPage()
+	messages := sent(t, c)
+	if len(messages) != 1 || errorCode(messages[0]) != ErrCodePageUnavailable {
+		t.Errorf("expected %s error alone, got %v", ErrCodePageUnavailable, messages)
+	}
+	if c.userData.CurrentPage != 2 {
+		t.Errorf("run was moved to page %d", c.userData.CurrentPage)
+	}
+}
+
+func TestHandlerPanicIsRecovered(t *testing.T) {
+	store := &brokenStore{MemoryStore: newTestStore(t, moveAnswers), panics: true}
+	c := newStoreClient(store, &types.User{Id: 1, CurrentPage: 1})
+	response := request(t, c, `{"v": 1, "id": "move", "channel": "story_move", "data": {"answerId": 1}}`)
+	if code := errorCode(response); code != ErrCodeInternal || response["id"] != "move" {
+		t.Errorf("expected %s reply to the message, got %v", ErrCodeInternal, response)
+	}
+	if incidents := c.hub.Incidents(); incidents.Panics != 1 {
+		t.Errorf("expected 1 panic, got %+v", incidents)
+	}
+	// Client keeps handling messages
+	store.panics = false
+	response = request(t, c, `{"v": 1, "channel": "story_move", "data": {"answerId": 1}}`)
+	if code := errorCode(response); code != "" || c.userData.CurrentPage != 2 {
+		t.Errorf("move after panic failed: %q, page %d", code, c.userData.CurrentPage)
+	}
+}
@@ -0,0 +1,348 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"go.uber.org/zap"
+)
+
+const (
+	// Period of writing node's stats to redis
+	heartbeatPeriod = 10 * time.Second
+
+	// Node is considered dead if it didn't write stats in this time
+	nodeTimeout = 3 * heartbeatPeriod
+
+	// Time allowed for another node to release user's session
+	releaseWait = 5 * time.Second
+
+	// Set of ids of running nodes
+	nodesKey = "hub:nodes"
+
+	// Pub/sub channel every node listens on
+	clusterChannel = "hub:events"
+
+	// Number of messages of other nodes waiting for hub,
+	// replies to release requests don't wait behind them
+	inboxSize = 256
+)
+
+// ErrNotReleased is returned when user's session is held
+// by another node, which didn't release it in time
+var ErrNotReleased = errors.New("session wasn't released by another node")
+
+// Types of cluster messages
+const (
+	// Token was revoked or refreshed
+	msgTokenChange = "token_change"
+	// Clients of user must be disconnected
+	msgKick = "kick"
+	// Message must be sent to every client
+	msgBroadcast = "broadcast"
+	// Node must release user's session to sender
+	msgRelease = "release"
+	// Node released user's session
+	msgReleased = "released"
+)
+
+// nodeKey is redis key of node's stats
+func nodeKey(nodeId string) string {
+	return "hub:node:" + nodeId
+}
+
+// nodeChannel is pub/sub channel of messages to node
+func nodeChannel(nodeId string) string {
+	return "hub:events:" + nodeId
+}
+
+// ownerKey is redis key of id of node holding user's session
+func ownerKey(userId int64) string {
+	return fmt.Sprintf("hub:session:%d", userId)
+}
+
+// Deletes key only if it still has expected value
+var deleteIfEqual = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`)
+
+// Sets key to ARGV[2] only if it still has value ARGV[1]
+var setIfEqual = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("set", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// clusterMessage is sent between hubs of different nodes
+type clusterMessage struct {
+	Type string `json:"type"`
+	// Node message was sent by
+	From        string      `json:"from"`
+	UserId      int64       `json:"userId,omitempty"`
+	TokenHash   string      `json:"tokenHash,omitempty"`
+	Replacement string      `json:"replacement,omitempty"`
+	RequestId   string      `json:"requestId,omitempty"`
+	Payload     interface{} `json:"payload,omitempty"`
+}
+
+// HubStats are numbers of connected clients and users
+type HubStats struct {
+	Clients int `json:"clients"`
+	Users   int `json:"users"`
+	Nodes   int `json:"nodes"`
+}
+
+// Cluster coordinates hubs of several server instances through redis.
+// Every node writes its stats to redis, keeps ids of users whose sessions
+// it holds and listens for commands on shared and its own pub/sub channels
+type Cluster struct {
+	client *redis.Client
+	nodeId string
+	hub    *GameHub
+	pubsub *redis.PubSub
+	// Messages for hub, so that pub/sub isn't blocked while hub is busy
+	inbox chan clusterMessage
+	// Release requests waiting for answer, by request id
+	mu      sync.Mutex
+	pending map[string]chan struct{}
+}
+
+// NewCluster joins hub to cluster, node id is random
+func NewCluster(client *redis.Client, hub *GameHub) *Cluster {
+	cluster := &Cluster{
+		client:  client,
+		nodeId:  newSessionId()[:12],
+		hub:     hub,
+		inbox:   make(chan clusterMessage, inboxSize),
+		pending: make(map[string]chan struct{}),
+	}
+	hub.cluster = cluster
+	return cluster
+}
+
+// Run listens for messages of other nodes and writes node's stats
+func (c *Cluster) Run() {
+	c.pubsub = c.client.Subscribe(clusterChannel, nodeChannel(c.nodeId))
+	messages := c.pubsub.Channel()
+	go c.forward()
+	ticker := time.NewTicker(heartbeatPeriod)
+	defer ticker.Stop()
+	c.heartbeat()
+	c.hub.logger.Info("Joined cluster", zap.String("packageLevel", "cluster"),
+		zap.String("nodeId", c.nodeId))
+	for {
+		select {
+		case message, ok := <-messages:
+			if ok == false {
+				return
+			}
+			c.handleMessage(message.Payload)
+		case <-ticker.C:
+			c.heartbeat()
+		}
+	}
+}
+
+// Leave removes node from cluster, releasing sessions it holds
+func (c *Cluster) Leave(userIds []int64) {
+	if c.pubsub != nil {
+		c.pubsub.Close()
+	}
+	for _, userId := range userIds {
+		c.Disown(userId)
+	}
+	c.client.SRem(nodesKey, c.nodeId)
+	c.client.Del(nodeKey(c.nodeId))
+}
+
+func (c *Cluster) heartbeat() {
+	stats, _ := json.Marshal(c.hub.Stats())
+	err := c.client.Set(nodeKey(c.nodeId), stats, nodeTimeout).Err()
+	if err == nil {
+		err = c.client.SAdd(nodesKey, c.nodeId).Err()
+	}
+	if err != nil {
+		c.logError("Unable to write node stats", err)
+	}
+}
+
+func (c *Cluster) handleMessage(payload string) {
+	var message clusterMessage
+	err := json.Unmarshal([]byte(payload), &message)
+	if err != nil {
+		c.logError("Bad cluster message", err)
+		return
+	}
+	if message.From == c.nodeId {
+		return
+	}
+	if message.Type == msgReleased {
+		c.mu.Lock()
+		released, ok := c.pending[message.RequestId]
+		delete(c.pending, message.RequestId)
+		c.mu.Unlock()
+		if ok {
+			close(released)
+		}
+		return
+	}
+	// Revocations mustn't be lost, so full inbox blocks pub/sub
+	c.inbox <- message
+}
+
+// forward passes messages of other nodes to hub in order they came
+func (c *Cluster) forward() {
+	for message := range c.inbox {
+		if message.Type == msgTokenChange {
+			c.hub.tokenChanges <- tokenChange{
+				tokenHash:   message.TokenHash,
+				userId:      message.UserId,
+				replacement: message.Replacement,
+			}
+		} else {
+			c.hub.commands <- message
+		}
+	}
+}
+
+// publish sends message to channel, marking it as sent by node
+func (c *Cluster) publish(channel string, message clusterMessage) {
+	message.From = c.nodeId
+	payload, _ := json.Marshal(message)
+	err := c.client.Publish(channel, payload).Err()
+	if err != nil {
+		c.logError("Unable to publish cluster message", err)
+	}
+}
+
+// Broadcast sends message to every other node
+func (c *Cluster) Broadcast(message clusterMessage) {
+	c.publish(clusterChannel, message)
+}
+
+// SendTo sends message to node
+func (c *Cluster) SendTo(nodeId string, message clusterMessage) {
+	c.publish(nodeChannel(nodeId), message)
+}
+
+// Owner returns id of live node holding user's session,
+// empty if user isn't connected anywhere
+func (c *Cluster) Owner(userId int64) (string, error) {
+	owner, err := c.client.Get(ownerKey(userId)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	alive, err := c.client.Exists(nodeKey(owner)).Result()
+	if err != nil || alive == 0 {
+		return "", err
+	}
+	return owner, nil
+}
+
+// Claim makes node the holder of user's session. If it was held by
+// another live node, that node is asked to save and release it first.
+// ErrNotReleased is returned if it didn't do so in time, then the other
+// node stays the holder, so session isn't played on two nodes at once
+func (c *Cluster) Claim(userId int64) error {
+	previous, err := c.client.GetSet(ownerKey(userId), c.nodeId).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if previous == "" || previous == c.nodeId {
+		return nil
+	}
+	alive, err := c.client.Exists(nodeKey(previous)).Result()
+	if err != nil {
+		c.restoreOwner(userId, previous)
+		return err
+	}
+	if alive == 0 {
+		return nil
+	}
+	requestId := newSessionId()
+	released := make(chan struct{})
+	c.mu.Lock()
+	c.pending[requestId] = released
+	c.mu.Unlock()
+	c.SendTo(previous, clusterMessage{Type: msgRelease, UserId: userId, RequestId: requestId})
+	select {
+	case <-released:
+		return nil
+	case <-time.After(releaseWait):
+		c.mu.Lock()
+		delete(c.pending, requestId)
+		c.mu.Unlock()
+		c.hub.logger.Warn("Session wasn't released in time",
+			zap.String("packageLevel", "cluster"),
+			zap.Int64("userId", userId),
+			zap.String("nodeId", previous))
+		c.restoreOwner(userId, previous)
+		return ErrNotReleased
+	}
+}
+
+// restoreOwner gives failed claim of user's session back
+// to previous holder, unless another node claimed it since
+func (c *Cluster) restoreOwner(userId int64, previous string) {
+	err := setIfEqual.Run(c.client, []string{ownerKey(userId)}, c.nodeId, previous).Err()
+	if err != nil && err != redis.Nil {
+		c.logError("Unable to restore session holder", err)
+	}
+}
+
+// Disown removes node as holder of user's session,
+// unless it was already claimed by another node
+func (c *Cluster) Disown(userId int64) {
+	err := deleteIfEqual.Run(c.client, []string{ownerKey(userId)}, c.nodeId).Err()
+	if err != nil {
+		c.logError("Unable to release session", err)
+	}
+}
+
+// Stats returns sums of stats of live nodes
+func (c *Cluster) Stats() (HubStats, error) {
+	var total HubStats
+	nodes, err := c.client.SMembers(nodesKey).Result()
+	if err != nil || len(nodes) == 0 {
+		return total, err
+	}
+	keys := make([]string, len(nodes))
+	for i, nodeId := range nodes {
+		keys[i] = nodeKey(nodeId)
+	}
+	values, err := c.client.MGet(keys...).Result()
+	if err != nil {
+		return total, err
+	}
+	for i, value := range values {
+		data, ok := value.(string)
+		if ok == false {
+			// Node died without leaving
+			c.client.SRem(nodesKey, nodes[i])
+			continue
+		}
+		var stats HubStats
+		if json.Unmarshal([]byte(data), &stats) != nil {
+			continue
+		}
+		total.Clients += stats.Clients
+		total.Users += stats.Users
+		total.Nodes++
+	}
+	return total, nil
+}
+
+func (c *Cluster) logError(msg string, err error) {
+	defer c.hub.logger.Sync()
+	c.hub.logger.Error(msg, zap.String("packageLevel", "cluster"),
+		zap.String("nodeId", c.nodeId), zap.Error(err))
+}
@@ -0,0 +1,123 @@
+package src
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/revan730/gamedev-backend/auth"
+	"github.com/revan730/gamedev-backend/db"
+	"go.uber.org/zap"
+)
+
+// TestReleasedDoesntWaitForHub passes messages to cluster of hub
+// which is busy, reply to release request must get through anyway
+func TestReleasedDoesntWaitForHub(t *testing.T) {
+	hub := NewGameHub(db.NewMemoryStore(), nil, SessionsTakeover, 0, 1, zap.NewNop())
+	cluster := NewCluster(nil, hub)
+	released := make(chan struct{})
+	cluster.pending["request"] = released
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		for _, message := range []clusterMessage{
+			{Type: msgTokenChange, From: "other", UserId: 1},
+			{Type: msgKick, From: "other", UserId: 1},
+			{Type: msgReleased, From: "other", RequestId: "request"},
+		} {
+			payload, _ := json.Marshal(message)
+			cluster.handleMessage(string(payload))
+		}
+	}()
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatal("release reply waited for hub")
+	}
+	<-handled
+	if len(cluster.inbox) != 2 {
+		t.Errorf("expected 2 messages waiting for hub, got %d", len(cluster.inbox))
+	}
+}
+
+func TestOwnMessagesAreIgnored(t *testing.T) {
+	hub := NewGameHub(db.NewMemoryStore(), nil, SessionsTakeover, 0, 1, zap.NewNop())
+	cluster := NewCluster(nil, hub)
+	payload, _ := json.Marshal(clusterMessage{Type: msgKick, From: cluster.nodeId, UserId: 1})
+	cluster.handleMessage(string(payload))
+	if len(cluster.inbox) != 0 {
+		t.Error("node handled its own message")
+	}
+}
+
+// newTestCluster returns servers of nodes sharing storage and tokens,
+// coordinated through redis set by TEST_REDIS_ADDR
+func newTestCluster(t *testing.T, nodes int) ([]*testServer, *redis.Client) {
+	addr := os.Getenv("TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("TEST_REDIS_ADDR isn't set")
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	t.Cleanup(func() { client.Close() })
+	store := &countingStore{MemoryStore: newTestStore(t, moveAnswers)}
+	tokens := auth.NewMemoryTokenStore(time.Hour)
+	var servers []*testServer
+	for i := 0; i < nodes; i++ {
+		hub := NewGameHub(store, tokens, SessionsTakeover, 0, 1, zap.NewNop())
+		cluster := NewCluster(client, hub)
+		go cluster.Run()
+		servers = append(servers, serveHub(t, hub, store, tokens))
+		// Node is alive once it has written its stats
+		deadline := time.Now().Add(time.Second)
+		for client.Exists(nodeKey(cluster.nodeId)).Val() == 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("node didn't join cluster")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return servers, client
+}
+
+func TestClusterHandsSessionOver(t *testing.T) {
+	servers, client := newTestCluster(t, 2)
+	user, token := servers[0].login(t, "player")
+	t.Cleanup(func() { client.Del(ownerKey(user.Id)) })
+	old := servers[0].dial(t, token)
+	send(t, old, ChannelMove, `{"answerId": 1}`)
+	expectReply(t, old, ChannelMove)
+	fresh := servers[1].dial(t, token)
+	receiveOn(t, old, ChannelSessionReplaced)
+	expectClose(t, old, closeSessionReplaced)
+	// Run was saved by the first node before it was handed over
+	expectText(t, fresh, "Lecture")
+	if owner := client.Get(ownerKey(user.Id)).Val(); owner != servers[1].hub.cluster.nodeId {
+		t.Errorf("session is held by %q", owner)
+	}
+}
+
+func TestClusterJoinFailsIfSessionIsntReleased(t *testing.T) {
+	servers, client := newTestCluster(t, 1)
+	user, token := servers[0].login(t, "player")
+	// Node which is alive but doesn't answer
+	ghost := "ghost-" + newSessionId()[:6]
+	client.Set(nodeKey(ghost), "{}", time.Minute)
+	client.Set(ownerKey(user.Id), ghost, 0)
+	t.Cleanup(func() { client.Del(nodeKey(ghost), ownerKey(user.Id)) })
+	conn := servers[0].dial(t, token)
+	message := receiveWithin(t, conn, ChannelError, releaseWait+time.Second)
+	err, _ := message["error"].(map[string]interface{})
+	if err == nil || err["code"] != ErrCodeSessionBusy {
+		t.Errorf("expected session_busy error, got %v", message)
+	}
+	if owner := client.Get(ownerKey(user.Id)).Val(); owner != ghost {
+		t.Errorf("session was taken from node which holds it, holder is %q", owner)
+	}
+	send(t, conn, ChannelMove, `{"answerId": 1}`)
+	reply := receiveOn(t, conn, ChannelMove)
+	if err, _ := reply["error"].(map[string]interface{}); err == nil || err["code"] != ErrCodeUnauthorized {
+		t.Errorf("client was authorized: %v", reply)
+	}
+}
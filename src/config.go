@@ -1,5 +1,28 @@
 package src
 
+import "time"
+
+// Storage backends
+const (
+	StoragePostgres = "postgres"
+	StorageMemory   = "memory"
+)
+
+// Ways to handle user connecting more than once
+const (
+	// New connection replaces the old one
+	SessionsTakeover = "takeover"
+	// Every connection plays the same run
+	SessionsShared = "shared"
+)
+
+// Token store backends
+const (
+	TokensRedis  = "redis"
+	TokensMemory = "memory"
+	TokensJWT    = "jwt"
+)
+
 // Config represents configuration for application
 type Config struct {
 	// Port to listen for requests
@@ -10,4 +33,24 @@ type Config struct {
 	DBPassword    string
 	RedisAddr     string
 	RedisPassword string
+	// Storage backend, either "postgres" or "memory"
+	Storage string
+	// Story bundle to load into memory storage on start
+	StoryFile string
+	// Token store backend, either "redis", "memory" or "jwt"
+	Tokens string
+	// Directory with JWT keys
+	JWTKeysDir string
+	// Id of key JWTs are signed with, latest one if empty
+	JWTKeyId string
+	// Backend of revoked JWTs denylist, either "redis" or "memory"
+	Denylist string
+	// What to do with user's connections, either "takeover" or "shared"
+	SessionMode string
+	// Interval of saving changed sessions, 0 disables autosave
+	Autosave time.Duration
+	// Coordinate hub with other instances through redis
+	Cluster bool
+	// Page runs are moved to when their current page is missing
+	SafePage int64
 }
@@ -0,0 +1,455 @@
+package src
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/revan730/gamedev-backend/db"
+	"github.com/revan730/gamedev-backend/lua"
+	"github.com/revan730/gamedev-backend/story"
+	"github.com/revan730/gamedev-backend/types"
+)
+
+// Number of audit log entries returned by default
+const defaultAuditLimit = 100
+
+// Kinds of story records in audit log
+const (
+	recordPage       = "page"
+	recordAnswer     = "answer"
+	recordDepartment = "department"
+	recordSpeciality = "speciality"
+	recordVersion    = "version"
+)
+
+// recordChange describes record changed by story edit
+type recordChange struct {
+	id     int64
+	before interface{}
+	after  interface{}
+}
+
+// storyChange applies edit to story
+type storyChange func(b *story.Bundle) (recordChange, error)
+
+// auditRecord converts record to JSON object kept in audit log
+func auditRecord(record interface{}) map[string]interface{} {
+	if record == nil {
+		return nil
+	}
+	data, _ := json.Marshal(record)
+	var object map[string]interface{}
+	json.Unmarshal(data, &object)
+	return object
+}
+
+// idParam parses id URL parameter, writing 400 response if it's malformed
+func (s *Server) idParam(w http.ResponseWriter, p httprouter.Params) (int64, bool) {
+	id, err := strconv.ParseInt(p.ByName("id"), 10, 64)
+	if err != nil || id <= 0 {
+		s.writeResponse(w, &map[string]string{"err": "Bad id"}, http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// readBody reads JSON request body, writing 400 response if it's malformed
+func (s *Server) readBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := readJSON(r.Body, v)
+	if err != nil {
+		s.logError("JSON read error", err)
+		s.writeResponse(w, &map[string]string{"err": "Bad json"}, http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// editStory applies change to story and writes it to audit log at once.
+// Edit introducing story errors is rejected with 400 and list of them
+func (s *Server) editStory(w http.ResponseWriter, user *types.User, action, kind string, change storyChange) bool {
+	s.storyMu.Lock()
+	defer s.storyMu.Unlock()
+	var record recordChange
+	report, err := story.Edit(s.databaseClient, func(b *story.Bundle) (*types.AuditEntry, error) {
+		var err error
+		record, err = change(b)
+		if err != nil {
+			return nil, err
+		}
+		return &types.AuditEntry{
+			UserId:   user.Id,
+			Login:    user.Login,
+			Action:   action,
+			Kind:     kind,
+			RecordId: record.id,
+			Before:   auditRecord(record.before),
+			After:    auditRecord(record.after),
+		}, nil
+	})
+	if err == db.ErrNotFound {
+		s.writeResponse(w, &map[string]string{"err": "Not found"}, http.StatusNotFound)
+		return false
+	}
+	if err == story.ErrInvalidStory {
+		s.writeResponse(w, &map[string]interface{}{"err": "Story has errors", "issues": report.Issues},
+			http.StatusBadRequest)
+		return false
+	}
+	if err != nil {
+		s.logError("Story edit error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	s.writeResponse(w, &map[string]interface{}{"id": record.id, "issues": report.Issues}, http.StatusOK)
+	return true
+}
+
+func (s *Server) ListPagesHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params, user *types.User) {
+	bundle, err := story.Export(s.databaseClient)
+	if err != nil {
+		s.logError("Story export error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.writeResponse(w, &map[string]interface{}{"pages": bundle.Pages}, http.StatusOK)
+}
+
+func (s *Server) GetPageHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params, user *types.User) {
+	pageId, ok := s.idParam(w, p)
+	if ok == false {
+		return
+	}
+	bundle, err := story.Export(s.databaseClient)
+	if err != nil {
+		s.logError("Story export error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	page := bundle.FindPage(pageId)
+	if page == nil {
+		s.writeResponse(w, &map[string]string{"err": "Not found"}, http.StatusNotFound)
+		return
+	}
+	s.writeResponse(w, &map[string]interface{}{"page": page}, http.StatusOK)
+}
+
+func (s *Server) CreatePageHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params, user *types.User) {
+	var page story.Page
+	if s.readBody(w, r, &page) == false {
+		return
+	}
+	s.editStory(w, user, types.AuditCreate, recordPage, func(b *story.Bundle) (recordChange, error) {
+		pageId := b.AddPage(page)
+		return recordChange{id: pageId, after: *b.FindPage(pageId)}, nil
+	})
+}
+
+func (s *Server) UpdatePageHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params, user *types.User) {
+	pageId, ok := s.idParam(w, p)
+	if ok == false {
+		return
+	}
+	var page story.Page
+	if s.readBody(w, r, &page) == false {
+		return
+	}
+	page.Id = pageId
+	s.editStory(w, user, types.AuditUpdate, recordPage, func(b *story.Bundle) (recordChange, error) {
+		existing := b.FindPage(pageId)
+		if existing == nil {
+			return recordChange{}, db.ErrNotFound
+		}
+		record := recordChange{id: pageId, before: *existing}
+		err := b.ReplacePage(page)
+		record.after = *existing
+		return record, err
+	})
+}
+
+func (s *Server) DeletePageHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params, user *types.User) {
+	pageId, ok := s.idParam(w, p)
+	if ok == false {
+		return
+	}
+	var answers []story.Answer
+	deleted := s.editStory(w, user, types.AuditDelete, recordPage, func(b *story.Bundle) (recordChange, error) {
+		existing := b.FindPage(pageId)
+		if existing == nil {
+			return recordChange{}, db.ErrNotFound
+		}
+		answers = existing.Answers
+		record := recordChange{id: pageId, before: *existing}
+		return record, b.RemovePage(pageId)
+	})
+	if deleted {
+		lua.Invalidate(pageId)
+		for _, answer := range answers {
+			lua.InvalidateAnswer(answer.Id)
+		}
+	}
+}
+
+func (s *Server) CreateAnswerHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params, user *types.User) {
+	pageId, ok := s.idParam(w, p)
+	if ok == false {
+		return
+	}
+	var answer story.Answer
+	if s.readBody(w, r, &answer) == false {
+		return
+	}
+	s.editStory(w, user, types.AuditCreate, recordAnswer, func(b *story.Bundle) (recordChange, error) {
+		answerId, err := b.AddAnswer(pageId, answer)
+		answer.Id = answerId
+		return recordChange{id: answerId, after: answer}, err
+	})
+}
+
+func (s *Server) UpdateAnswerHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params, user *types.User) {
+	answerId, ok := s.idParam(w, p)
+	if ok == false {
+		return
+	}
+	var answer story.Answer
+	if s.readBody(w, r, &answer) == false {
+		return
+	}
+	answer.Id = answerId
+	s.editStory(w, user, types.AuditUpdate, recordAnswer, func(b *story.Bundle) (recordChange, error) {
+		before := b.FindAnswer(answerId)
+		if before == nil {
+			return recordChange{}, db.ErrNotFound
+		}
+		record := recordChange{id: answerId, before: *before, after: answer}
+		return record, b.ReplaceAnswer(answer)
+	})
+}
+
+func (s *Server) DeleteAnswerHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params, user *types.User) {
+	answerId, ok := s.idParam(w, p)
+	if ok == false {
+		return
+	}
+	deleted := s.editStory(w, user, types.AuditDelete, recordAnswer, func(b *story.Bundle) (recordChange, error) {
+		before := b.FindAnswer(answerId)
+		if before == nil {
+			return recordChange{}, db.ErrNotFound
+		}
+		record := recordChange{id: answerId, before: *before}
+		return record, b.RemoveAnswer(answerId)
+	})
+	if deleted {
+		lua.InvalidateAnswer(answerId)
+	}
+}
+
+func (s *Server) ListDepartmentsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params, user *types.User) {
+	deps, err := s.databaseClient.FindAllDepartments()
+	if err != nil {
+		s.logError("Find departments error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.writeResponse(w, &map[string]interface{}{"departments": deps}, http.StatusOK)
+}
+
+func (s *Server) CreateDepartmentHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params, user *types.User) {
+	var dep story.Department
+	if s.readBody(w, r, &dep) == false {
+		return
+	}
+	s.editStory(w, user, types.AuditCreate, recordDepartment, func(b *story.Bundle) (recordChange, error) {
+		dep.Id = b.AddDepartment(dep)
+		return recordChange{id: dep.Id, after: dep}, nil
+	})
+}
+
+func (s *Server) UpdateDepartmentHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params, user *types.User) {
+	depId, ok := s.idParam(w, p)
+	if ok == false {
+		return
+	}
+	var dep story.Department
+	if s.readBody(w, r, &dep) == false {
+		return
+	}
+	dep.Id = depId
+	s.editStory(w, user, types.AuditUpdate, recordDepartment, func(b *story.Bundle) (recordChange, error) {
+		for _, before := range b.Departments {
+			if before.Id == depId {
+				return recordChange{id: depId, before: before, after: dep}, b.ReplaceDepartment(dep)
+			}
+		}
+		return recordChange{}, db.ErrNotFound
+	})
+}
+
+func (s *Server) DeleteDepartmentHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params, user *types.User) {
+	depId, ok := s.idParam(w, p)
+	if ok == false {
+		return
+	}
+	s.editStory(w, user, types.AuditDelete, recordDepartment, func(b *story.Bundle) (recordChange, error) {
+		for _, before := range b.Departments {
+			if before.Id == depId {
+				return recordChange{id: depId, before: before}, b.RemoveDepartment(depId)
+			}
+		}
+		return recordChange{}, db.ErrNotFound
+	})
+}
+
+func (s *Server) ListSpecialitiesHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params, user *types.User) {
+	specs, err := s.databaseClient.FindAllSpecialities()
+	if err != nil {
+		s.logError("Find specialities error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.writeResponse(w, &map[string]interface{}{"specialities": specs}, http.StatusOK)
+}
+
+func (s *Server) CreateSpecialityHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params, user *types.User) {
+	var spec story.Speciality
+	if s.readBody(w, r, &spec) == false {
+		return
+	}
+	s.editStory(w, user, types.AuditCreate, recordSpeciality, func(b *story.Bundle) (recordChange, error) {
+		spec.Id = b.AddSpeciality(spec)
+		return recordChange{id: spec.Id, after: spec}, nil
+	})
+}
+
+func (s *Server) UpdateSpecialityHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params, user *types.User) {
+	specId, ok := s.idParam(w, p)
+	if ok == false {
+		return
+	}
+	var spec story.Speciality
+	if s.readBody(w, r, &spec) == false {
+		return
+	}
+	spec.Id = specId
+	s.editStory(w, user, types.AuditUpdate, recordSpeciality, func(b *story.Bundle) (recordChange, error) {
+		for _, before := range b.Specialities {
+			if before.Id == specId {
+				return recordChange{id: specId, before: before, after: spec}, b.ReplaceSpeciality(spec)
+			}
+		}
+		return recordChange{}, db.ErrNotFound
+	})
+}
+
+func (s *Server) DeleteSpecialityHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params, user *types.User) {
+	specId, ok := s.idParam(w, p)
+	if ok == false {
+		return
+	}
+	s.editStory(w, user, types.AuditDelete, recordSpeciality, func(b *story.Bundle) (recordChange, error) {
+		for _, before := range b.Specialities {
+			if before.Id == specId {
+				return recordChange{id: specId, before: before}, b.RemoveSpeciality(specId)
+			}
+		}
+		return recordChange{}, db.ErrNotFound
+	})
+}
+
+func (s *Server) AuditLogHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params, user *types.User) {
+	limit := defaultAuditLimit
+	if param := r.URL.Query().Get("limit"); param != "" {
+		parsed, err := strconv.Atoi(param)
+		if err != nil || parsed <= 0 {
+			s.writeResponse(w, &map[string]string{"err": "Bad limit"}, http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	entries, err := s.databaseClient.FindAuditLog(limit)
+	if err != nil {
+		s.logError("Audit log error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.writeResponse(w, &map[string]interface{}{"entries": entries}, http.StatusOK)
+}
+
+func (s *Server) ListVersionsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params, user *types.User) {
+	versions, err := s.databaseClient.FindStoryVersions()
+	if err != nil {
+		s.logError("Story versions error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	changed, err := story.DraftChanged(s.databaseClient)
+	if err != nil {
+		s.logError("Story versions error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.writeResponse(w, &map[string]interface{}{"versions": versions, "draftChanged": changed}, http.StatusOK)
+}
+
+func (s *Server) GetVersionHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params, user *types.User) {
+	versionId, ok := s.idParam(w, p)
+	if ok == false {
+		return
+	}
+	version, err := s.databaseClient.FindStoryVersion(versionId)
+	if err == db.ErrNotFound {
+		s.writeResponse(w, &map[string]string{"err": "Not found"}, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.logError("Story version error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	bundle, err := story.FromVersion(version)
+	if err != nil {
+		s.logError("Story version error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.writeResponse(w, &map[string]interface{}{"version": version, "story": bundle}, http.StatusOK)
+}
+
+type publishMessage struct {
+	Comment string `json:"comment"`
+}
+
+// PublishVersionHandler publishes the draft story as a new version,
+// players get it once they start a new run
+func (s *Server) PublishVersionHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params, user *types.User) {
+	var publish publishMessage
+	if s.readBody(w, r, &publish) == false {
+		return
+	}
+	s.storyMu.Lock()
+	defer s.storyMu.Unlock()
+	version, report, err := story.Publish(s.databaseClient, user.Id, publish.Comment)
+	if err == story.ErrInvalidStory {
+		s.writeResponse(w, &map[string]interface{}{"err": "Story has errors", "issues": report.Issues},
+			http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		s.logError("Story publish error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = s.databaseClient.CreateAuditEntry(&types.AuditEntry{
+		UserId:   user.Id,
+		Login:    user.Login,
+		Action:   types.AuditCreate,
+		Kind:     recordVersion,
+		RecordId: version.Id,
+		After:    auditRecord(version),
+	})
+	if err != nil {
+		s.logError("Audit log error", err)
+	}
+	s.writeResponse(w, &map[string]interface{}{"id": version.Id, "issues": report.Issues}, http.StatusOK)
+}
@@ -0,0 +1,132 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/revan730/gamedev-backend/db"
+	"github.com/revan730/gamedev-backend/types"
+	"go.uber.org/zap"
+)
+
+var testWriter = &types.User{Id: 100, Login: "writer", Role: types.RoleWriter}
+
+// newContentServer returns server editing story of store
+func newContentServer(store db.Store) *Server {
+	return &Server{logger: zap.NewNop(), databaseClient: store}
+}
+
+// callHandler calls handler as user, with id URL parameter if it isn't 0,
+// and returns response status and body
+func callHandler(t *testing.T, handler userHandle, id int64, body string) (int, map[string]interface{}) {
+	t.Helper()
+	var params httprouter.Params
+	if id != 0 {
+		params = httprouter.Params{{Key: "id", Value: strconv.FormatInt(id, 10)}}
+	}
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)), params, testWriter)
+	var response map[string]interface{}
+	if w.Body.Len() != 0 {
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("bad response %q: %v", w.Body.String(), err)
+		}
+	}
+	return w.Code, response
+}
+
+func auditLog(t *testing.T, store db.Store) []types.AuditEntry {
+	entries, err := store.FindAuditLog(defaultAuditLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestContentEditsAreAudited(t *testing.T) {
+	store := newTestStore(t, moveAnswers)
+	s := newContentServer(store)
+	code, response := callHandler(t, s.CreateAnswerHandler, 2, `{"text": "Listen"}`)
+	if code != http.StatusOK {
+		t.Fatalf("answer wasn't created: %d %v", code, response)
+	}
+	answerId := int64(response["id"].(float64))
+	if answer, err := store.FindAnswerById(answerId); err != nil || answer.PageId != 2 || answer.Text != "Listen" {
+		t.Errorf("expected answer of page 2, got %+v %v", answer, err)
+	}
+	code, response = callHandler(t, s.UpdatePageHandler, 3, `{"text": "Graduation"}`)
+	if code != http.StatusOK {
+		t.Fatalf("page wasn't updated: %d %v", code, response)
+	}
+	entries := auditLog(t, store)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 audit entries, got %+v", entries)
+	}
+	created, updated := entries[1], entries[0]
+	if created.Action != types.AuditCreate || created.Kind != recordAnswer || created.RecordId != answerId ||
+		created.Before != nil || created.After["text"] != "Listen" {
+		t.Errorf("unexpected entry of created answer: %+v", created)
+	}
+	if updated.Action != types.AuditUpdate || updated.Kind != recordPage || updated.RecordId != 3 ||
+		updated.UserId != testWriter.Id || updated.Login != testWriter.Login ||
+		updated.Before["text"] != "The end" || updated.After["text"] != "Graduation" {
+		t.Errorf("unexpected entry of updated page: %+v", updated)
+	}
+}
+
+func TestRefusedContentEditsArentAudited(t *testing.T) {
+	store := newTestStore(t, moveAnswers)
+	s := newContentServer(store)
+	// Page 1 leads to page 2
+	code, response := callHandler(t, s.DeletePageHandler, 2, "")
+	if code != http.StatusBadRequest || response["issues"] == nil {
+		t.Errorf("expected 400 with issues, got %d %v", code, response)
+	}
+	if _, err := store.FindPageById(2); err != nil {
+		t.Errorf("page of refused edit was deleted: %v", err)
+	}
+	if code, _ := callHandler(t, s.UpdateAnswerHandler, 99, `{"text": "Missing"}`); code != http.StatusNotFound {
+		t.Errorf("expected 404 for missing answer, got %d", code)
+	}
+	if code, _ := callHandler(t, s.CreatePageHandler, 0, `{"text": `); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for bad JSON, got %d", code)
+	}
+	if entries := auditLog(t, store); len(entries) != 0 {
+		t.Errorf("refused edits are in audit log: %+v", entries)
+	}
+}
+
+// TestContentEditsOfInstancesArentLost edits story through servers
+// sharing storage, as several instances of the game do
+func TestContentEditsOfInstancesArentLost(t *testing.T) {
+	store := newTestStore(t, moveAnswers)
+	servers := []*Server{newContentServer(store), newContentServer(store)}
+	const edits = 10
+	var wg sync.WaitGroup
+	for i := 0; i < edits; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s := servers[i%len(servers)]
+			code, response := callHandler(t, s.CreateAnswerHandler, 2, fmt.Sprintf(`{"text": "answer %d"}`, i))
+			if code != http.StatusOK {
+				t.Errorf("answer %d wasn't created: %d %v", i, code, response)
+			}
+		}(i)
+	}
+	wg.Wait()
+	answers, _ := store.FindPageAnswers(2)
+	if len(answers) != edits {
+		t.Errorf("expected %d answers, got %+v", edits, answers)
+	}
+	if entries := auditLog(t, store); len(entries) != edits {
+		t.Errorf("expected %d audit entries, got %d", edits, len(entries))
+	}
+}
@@ -0,0 +1,51 @@
+package src
+
+// Codes of errors sent to websocket clients
+const (
+	ErrCodeBadAnswer         = "bad_answer"
+	ErrCodeAnswerNotFound    = "answer_not_found"
+	ErrCodeForeignAnswer     = "answer_not_on_page"
+	ErrCodeHiddenAnswer      = "answer_hidden"
+	ErrCodeScriptFailed      = "script_failed"
+	ErrCodeUnauthorized      = "unauthorized"
+	ErrCodeBadMessage        = "bad_message"
+	ErrCodeAlreadyAuthorized = "already_authorized"
+	ErrCodeForbidden         = "forbidden"
+	ErrCodePageNotFound      = "page_not_found"
+	ErrCodePageUnavailable   = "page_unavailable"
+	ErrCodeInternal          = "internal_error"
+	ErrCodeBadVersion        = "unsupported_version"
+	ErrCodeUnknownChannel    = "unknown_channel"
+	ErrCodeInvalidToken      = "invalid_token"
+	ErrCodeNothingToRollBack = "nothing_to_roll_back"
+	ErrCodeBadSlotName       = "bad_slot_name"
+	ErrCodeSlotNotFound      = "slot_not_found"
+	ErrCodeSlotLimit         = "slot_limit"
+	ErrCodeStorage           = "storage_error"
+	ErrCodeSessionBusy       = "session_busy"
+)
+
+// errorCodes lists every code for protocol schema
+var errorCodes = []string{
+	ErrCodeBadAnswer, ErrCodeAnswerNotFound, ErrCodeForeignAnswer, ErrCodeHiddenAnswer,
+	ErrCodeScriptFailed, ErrCodeUnauthorized, ErrCodeBadMessage, ErrCodeAlreadyAuthorized,
+	ErrCodeForbidden, ErrCodePageNotFound, ErrCodePageUnavailable, ErrCodeInternal,
+	ErrCodeBadVersion, ErrCodeUnknownChannel, ErrCodeInvalidToken,
+	ErrCodeNothingToRollBack, ErrCodeBadSlotName, ErrCodeSlotNotFound, ErrCodeSlotLimit,
+	ErrCodeStorage, ErrCodeSessionBusy,
+}
+
+// ClientError is an error which is reported to
+// websocket client with its code
+type ClientError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ClientError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func newClientError(code, message string) *ClientError {
+	return &ClientError{Code: code, Message: message}
+}
@@ -0,0 +1,82 @@
+package src
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/revan730/gamedev-backend/types"
+)
+
+const (
+	// Number of playthrough events waiting to be written,
+	// events beyond it are dropped.
+	eventQueueSize = 1024
+
+	// Maximum number of events written at once.
+	eventBatchSize = 100
+
+	// Time events may wait for batch to fill up.
+	eventFlushInterval = time.Second
+)
+
+// LogEvent queues event to be appended to playthrough log, so that
+// moves don't wait for storage. Event is dropped if queue is full
+func (g *GameHub) LogEvent(event *types.StoryEvent) {
+	select {
+	case g.events <- *event:
+	default:
+		atomic.AddInt64(&g.incidents.DroppedEvents, 1)
+	}
+}
+
+// writeEvents writes queued events in batches until flushEvents
+func (g *GameHub) writeEvents() {
+	ticker := time.NewTicker(eventFlushInterval)
+	defer ticker.Stop()
+	var batch []types.StoryEvent
+	for {
+		select {
+		case event := <-g.events:
+			batch = append(batch, event)
+			if len(batch) >= eventBatchSize {
+				g.saveEvents(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			g.saveEvents(batch)
+			batch = nil
+		case done := <-g.stopEvents:
+		drain:
+			for {
+				select {
+				case event := <-g.events:
+					batch = append(batch, event)
+				default:
+					break drain
+				}
+			}
+			g.saveEvents(batch)
+			close(done)
+			return
+		}
+	}
+}
+
+func (g *GameHub) saveEvents(batch []types.StoryEvent) {
+	if len(batch) == 0 {
+		return
+	}
+	err := g.databaseClient.CreateEvents(batch)
+	if err != nil {
+		atomic.AddInt64(&g.incidents.DroppedEvents, int64(len(batch)))
+		g.logError(fmt.Sprintf("Unable to log %d story events", len(batch)), err)
+	}
+}
+
+// flushEvents writes events queued so far and stops writeEvents
+func (g *GameHub) flushEvents() {
+	done := make(chan struct{})
+	g.stopEvents <- done
+	<-done
+}
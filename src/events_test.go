@@ -0,0 +1,34 @@
+package src
+
+import (
+	"testing"
+
+	"github.com/revan730/gamedev-backend/types"
+)
+
+func TestEventsAreWrittenOnFlush(t *testing.T) {
+	c, store := newTestClient(t, moveAnswers)
+	go c.hub.writeEvents()
+	c.handleMessage([]byte(`{"v": 1, "channel": "story_move", "data": {"answerId": 1}}`))
+	c.handleMessage([]byte(`{"v": 1, "channel": "story_reset"}`))
+	c.handleMessage([]byte(`{"v": 1, "channel": "story_move", "data": {"answerId": 1}}`))
+	c.hub.flushEvents()
+	stats, err := store.AnswerPickRates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].AnswerId != 1 || stats[0].Picks != 2 {
+		t.Errorf("expected 2 picks of answer 1, got %+v", stats)
+	}
+}
+
+func TestEventsOverQueueAreDropped(t *testing.T) {
+	c, _ := newTestClient(t, moveAnswers)
+	// Writer isn't running, as if storage hung
+	for i := 0; i < eventQueueSize+5; i++ {
+		c.hub.LogEvent(&types.StoryEvent{Kind: types.EventMove, PageId: 1, AnswerId: 1})
+	}
+	if dropped := c.hub.Incidents().DroppedEvents; dropped != 5 {
+		t.Errorf("expected 5 dropped events, got %d", dropped)
+	}
+}
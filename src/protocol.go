@@ -0,0 +1,218 @@
+package src
+
+import (
+	"encoding/json"
+
+	"github.com/revan730/gamedev-backend/types"
+)
+
+// ProtocolVersion is version of websocket message envelope,
+// messages of other versions are refused
+const ProtocolVersion = 1
+
+// LegacyProtocolVersion is unversioned protocol used before envelope,
+// with data fields at top level of message. It's deprecated and
+// accepted only while clients move to ProtocolVersion
+const LegacyProtocolVersion = 0
+
+// Channels of messages sent by clients
+const (
+	ChannelAuth       = "auth"
+	ChannelMove       = "story_move"
+	ChannelSave       = "story_save"
+	ChannelReset      = "story_reset"
+	ChannelBack       = "story_back"
+	ChannelGoTo       = "story_goto"
+	ChannelSaveSlot   = "story_save_slot"
+	ChannelLoadSlot   = "story_load_slot"
+	ChannelListSlots  = "story_list_slots"
+	ChannelDeleteSlot = "story_delete_slot"
+)
+
+// Channels of messages sent by server on its own
+const (
+	ChannelStats           = "stats"
+	ChannelStoryText       = "story_text"
+	ChannelError           = "error"
+	ChannelAnnouncement    = "announcement"
+	ChannelSessionReplaced = "session_replaced"
+	ChannelSessionConflict = "session_conflict"
+)
+
+// ClientMessage is envelope of message sent by client
+type ClientMessage struct {
+	Version int `json:"v"`
+	// Optional, copied to response so client can match it with request
+	Id      string          `json:"id,omitempty"`
+	Channel string          `json:"channel"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// ServerMessage is envelope of message sent by server, response
+// to client message has its id and either data or error
+type ServerMessage struct {
+	Version int          `json:"v"`
+	Id      string       `json:"id,omitempty"`
+	Channel string       `json:"channel"`
+	Data    interface{}  `json:"data,omitempty"`
+	Error   *ClientError `json:"error,omitempty"`
+	// Message is a response, it matters only for legacy clients
+	response bool
+}
+
+type AuthRequest struct {
+	AuthToken string `json:"authToken"`
+}
+
+type MoveRequest struct {
+	// Required if current page has a question
+	AnswerId int64 `json:"answerId,omitempty"`
+}
+
+type BackRequest struct {
+	// Number of transitions to roll back, 1 by default
+	Steps int `json:"steps,omitempty"`
+}
+
+type GoToRequest struct {
+	PageId int64 `json:"pageId"`
+}
+
+type SlotRequest struct {
+	Name string `json:"name"`
+}
+
+type SlotList struct {
+	Slots []types.SaveSlot `json:"slots"`
+}
+
+type StoryText struct {
+	Text string `json:"text"`
+	// Answers user can pick, only on question pages
+	Answers []types.Answer `json:"answers,omitempty"`
+}
+
+type Announcement struct {
+	Message string `json:"message"`
+}
+
+// channelSpec describes messages of channel, nil request
+// or data means messages have no data
+type channelSpec struct {
+	channel string
+	doc     string
+	request interface{}
+	data    interface{}
+}
+
+// clientChannels lists channels handled by HandleClientMessage
+// with data of requests and successful responses
+var clientChannels = []channelSpec{
+	{ChannelAuth, "Authorize with token", AuthRequest{}, nil},
+	{ChannelMove, "Go to next page, answering question of current one", MoveRequest{}, nil},
+	{ChannelSave, "Save run", nil, nil},
+	{ChannelReset, "Start new run", nil, nil},
+	{ChannelBack, "Roll back last transitions", BackRequest{}, nil},
+	{ChannelGoTo, "Go to any page, needs preview_story permission", GoToRequest{}, nil},
+	{ChannelSaveSlot, "Save run to named slot", SlotRequest{}, nil},
+	{ChannelLoadSlot, "Replace run with one from named slot", SlotRequest{}, nil},
+	{ChannelListSlots, "List save slots, most recently updated first", nil, SlotList{}},
+	{ChannelDeleteSlot, "Delete save slot", SlotRequest{}, nil},
+}
+
+// serverChannels lists channels server sends on its own with their data
+var serverChannels = []channelSpec{
+	{ChannelStats, "User's stats, sent on authorization and every change", nil, types.User{}},
+	{ChannelStoryText, "Current page, sent on authorization and every change", nil, StoryText{}},
+	{ChannelError, "Error which isn't a response to particular message", nil, nil},
+	{ChannelAnnouncement, "Message sent by admins to every player", nil, Announcement{}},
+	{ChannelSessionReplaced, "User connected again, connection is closed with code 4002", nil, nil},
+	{ChannelSessionConflict, "Run was saved elsewhere and is reloaded, stats and page follow", nil, nil},
+}
+
+func isClientChannel(channel string) bool {
+	for _, spec := range clientChannels {
+		if spec.channel == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// newPush makes message server sends on its own
+func newPush(channel string, data interface{}) ServerMessage {
+	return ServerMessage{Version: ProtocolVersion, Channel: channel, Data: data}
+}
+
+// reply sends successful response to client message, data may be nil
+func (c *Client) reply(msg *ClientMessage, data interface{}) {
+	c.sendJSON(ServerMessage{Version: ProtocolVersion, Id: msg.Id, Channel: msg.Channel, Data: data,
+		response: true})
+}
+
+// replyError sends error response to client message
+func (c *Client) replyError(msg *ClientMessage, err *ClientError) {
+	c.sendJSON(ServerMessage{Version: ProtocolVersion, Id: msg.Id, Channel: msg.Channel, Error: err,
+		response: true})
+}
+
+// push sends message which isn't a response
+func (c *Client) push(channel string, data interface{}) {
+	c.sendJSON(newPush(channel, data))
+}
+
+// readData decodes data of client message, replying with
+// bad_message error if it's malformed
+func (c *Client) readData(msg *ClientMessage, v interface{}) bool {
+	if len(msg.Data) == 0 {
+		return true
+	}
+	err := json.Unmarshal(msg.Data, v)
+	if err != nil {
+		c.replyError(msg, newClientError(ErrCodeBadMessage, "malformed data"))
+		return false
+	}
+	return true
+}
+
+// legacyMessage converts message to format of LegacyProtocolVersion.
+// Fields of data are put at top level, except stats which are put
+// to "stats", and responses have "response" flag telling if they
+// succeeded. Messages which aren't ServerMessage are left as is
+func legacyMessage(d interface{}) interface{} {
+	var msg ServerMessage
+	switch m := d.(type) {
+	case ServerMessage:
+		msg = m
+	case map[string]interface{}:
+		// Broadcast received from another node
+		raw, err := json.Marshal(m)
+		if err != nil || json.Unmarshal(raw, &msg) != nil {
+			return d
+		}
+	default:
+		return d
+	}
+	legacy := map[string]interface{}{"channel": msg.Channel}
+	if msg.response {
+		legacy["response"] = msg.Error == nil
+	}
+	if msg.Error != nil {
+		legacy["error"] = msg.Error
+	}
+	if msg.Data == nil {
+		return legacy
+	}
+	if msg.Channel == ChannelStats {
+		legacy["stats"] = msg.Data
+		return legacy
+	}
+	var fields map[string]interface{}
+	raw, err := json.Marshal(msg.Data)
+	if err == nil && json.Unmarshal(raw, &fields) == nil {
+		for name, value := range fields {
+			legacy[name] = value
+		}
+	}
+	return legacy
+}
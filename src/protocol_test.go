@@ -0,0 +1,114 @@
+package src
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/revan730/gamedev-backend/types"
+)
+
+var moveAnswers = []types.Answer{{Id: 1, PageId: 1, Text: "Sure", Knowledge: 1}}
+
+// sent returns messages sent to client so far, as decoded JSON
+func sent(t *testing.T, c *Client) []map[string]interface{} {
+	var messages []map[string]interface{}
+	for {
+		select {
+		case d := <-c.send:
+			raw, err := json.Marshal(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var message map[string]interface{}
+			if err := json.Unmarshal(raw, &message); err != nil {
+				t.Fatal(err)
+			}
+			messages = append(messages, message)
+		default:
+			return messages
+		}
+	}
+}
+
+func TestUnversionedMove(t *testing.T) {
+	c, _ := newTestClient(t, moveAnswers)
+	c.handleMessage([]byte(`{"channel": "story_move", "answerId": 1}`))
+	if c.userData.CurrentPage != 2 {
+		t.Fatalf("expected page 2, got %d", c.userData.CurrentPage)
+	}
+	messages := sent(t, c)
+	if len(messages) != 3 {
+		t.Fatalf("expected response, stats and text, got %v", messages)
+	}
+	response, stats, text := messages[0], messages[1], messages[2]
+	if response["channel"] != ChannelMove || response["response"] != true {
+		t.Errorf("unexpected response %v", response)
+	}
+	for _, message := range messages {
+		if _, ok := message["v"]; ok {
+			t.Errorf("legacy message has version: %v", message)
+		}
+	}
+	if userStats, ok := stats["stats"].(map[string]interface{}); ok == false || userStats["knowledge"] != 1.0 {
+		t.Errorf("unexpected stats %v", stats)
+	}
+	if text["channel"] != ChannelStoryText || text["text"] != "Lecture" {
+		t.Errorf("unexpected story text %v", text)
+	}
+}
+
+func TestUnversionedError(t *testing.T) {
+	c, _ := newTestClient(t, moveAnswers)
+	c.session = nil
+	c.handleMessage([]byte(`{"channel": "story_move", "answerId": 1}`))
+	messages := sent(t, c)
+	if len(messages) != 1 {
+		t.Fatalf("expected one response, got %v", messages)
+	}
+	response := messages[0]
+	clientErr, _ := response["error"].(map[string]interface{})
+	if response["response"] != false || clientErr["code"] != ErrCodeUnauthorized {
+		t.Errorf("unexpected response %v", response)
+	}
+}
+
+func TestVersionedMove(t *testing.T) {
+	c, _ := newTestClient(t, moveAnswers)
+	c.handleMessage([]byte(`{"v": 1, "id": "7", "channel": "story_move", "data": {"answerId": 1}}`))
+	if c.userData.CurrentPage != 2 {
+		t.Fatalf("expected page 2, got %d", c.userData.CurrentPage)
+	}
+	messages := sent(t, c)
+	if len(messages) == 0 {
+		t.Fatal("no response")
+	}
+	response := messages[0]
+	if response["v"] != 1.0 || response["id"] != "7" || response["channel"] != ChannelMove {
+		t.Errorf("unexpected response %v", response)
+	}
+	if _, ok := response["response"]; ok {
+		t.Errorf("response has legacy fields: %v", response)
+	}
+	if messages[len(messages)-1]["data"] == nil {
+		t.Errorf("story text isn't in data: %v", messages[len(messages)-1])
+	}
+}
+
+func TestLegacyBroadcast(t *testing.T) {
+	// Broadcasts from other nodes arrive decoded into maps
+	raw, err := json.Marshal(newPush(ChannelAnnouncement, Announcement{Message: "Hi"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload interface{}
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		t.Fatal(err)
+	}
+	legacy := legacyMessage(payload).(map[string]interface{})
+	if legacy["channel"] != ChannelAnnouncement || legacy["message"] != "Hi" {
+		t.Errorf("unexpected message %v", legacy)
+	}
+	if _, ok := legacy["response"]; ok {
+		t.Errorf("push has response flag: %v", legacy)
+	}
+}
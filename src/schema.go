@@ -0,0 +1,211 @@
+package src
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// schemaGenerator builds JSON Schema out of Go types, named
+// structs are put to definitions and referenced by name
+type schemaGenerator struct {
+	definitions map[string]interface{}
+}
+
+type schemaObject map[string]interface{}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// ProtocolSchema returns JSON Schema of websocket messages,
+// generated from message types
+func ProtocolSchema() ([]byte, error) {
+	g := &schemaGenerator{definitions: make(map[string]interface{})}
+	var clientMessages, serverMessages []interface{}
+	for _, spec := range clientChannels {
+		clientMessages = append(clientMessages, g.envelope(spec.channel, spec.doc, spec.request, false))
+		serverMessages = append(serverMessages, g.envelope(spec.channel,
+			"Response to "+spec.channel, spec.data, true))
+	}
+	for _, spec := range serverChannels {
+		serverMessages = append(serverMessages, g.envelope(spec.channel, spec.doc, spec.data, false))
+	}
+	g.definitions["ClientMessage"] = schemaObject{"oneOf": clientMessages,
+		"description": "Unversioned messages without v and data, with data fields at top level, " +
+			"are deprecated and accepted only during transition to version 1"}
+	g.definitions["ServerMessage"] = schemaObject{"oneOf": serverMessages}
+	// Code is plain string in Go, but only known codes are sent
+	errorProperties := g.definitions["ClientError"].(schemaObject)["properties"].(schemaObject)
+	errorProperties["code"] = schemaObject{"type": "string", "enum": errorCodes}
+	schema := schemaObject{
+		"$schema":     "http://json-schema.org/draft-07/schema#",
+		"title":       "Gamedev backend websocket protocol",
+		"description": "Messages of protocol version 1, see ClientMessage and ServerMessage, deprecated unversioned messages aren't described",
+		"oneOf": []interface{}{
+			schemaObject{"$ref": "#/definitions/ClientMessage"},
+			schemaObject{"$ref": "#/definitions/ServerMessage"},
+		},
+		"definitions": g.definitions,
+	}
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+// envelope returns schema of message of channel. Responses have
+// either data or error, other messages have data if they have any
+func (g *schemaGenerator) envelope(channel, doc string, data interface{}, response bool) schemaObject {
+	properties := schemaObject{
+		"v":       schemaObject{"const": ProtocolVersion},
+		"id":      schemaObject{"type": "string"},
+		"channel": schemaObject{"const": channel},
+	}
+	required := []string{"v", "channel"}
+	if data != nil {
+		dataSchema := g.typeSchema(reflect.TypeOf(data))
+		properties["data"] = dataSchema
+		if response == false && g.hasRequired(reflect.TypeOf(data)) {
+			required = append(required, "data")
+		}
+	}
+	if response || channel == ChannelError {
+		properties["error"] = g.typeSchema(reflect.TypeOf(ClientError{}))
+	}
+	if channel == ChannelError {
+		required = append(required, "error")
+	}
+	return schemaObject{
+		"description": doc,
+		"type":        "object",
+		"properties":  properties,
+		"required":    required,
+	}
+}
+
+// typeSchema returns schema of values of type
+func (g *schemaGenerator) typeSchema(t reflect.Type) schemaObject {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return schemaObject{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return schemaObject{}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return schemaObject{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return schemaObject{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return schemaObject{"type": "number"}
+	case reflect.String:
+		return schemaObject{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return schemaObject{"type": "array", "items": g.typeSchema(t.Elem())}
+	case reflect.Map:
+		return schemaObject{"type": "object", "additionalProperties": g.typeSchema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		if _, ok := g.definitions[t.Name()]; ok == false {
+			// Placeholder stops recursion on self-referencing types
+			g.definitions[t.Name()] = schemaObject{}
+			g.definitions[t.Name()] = g.structSchema(t)
+		}
+		return schemaObject{"$ref": "#/definitions/" + t.Name()}
+	}
+	// Interfaces can hold anything
+	return schemaObject{}
+}
+
+// structSchema returns schema of struct's JSON object
+func (g *schemaGenerator) structSchema(t reflect.Type) schemaObject {
+	properties := schemaObject{}
+	var required []string
+	g.addFields(t, properties, &required)
+	schema := schemaObject{"type": "object", "properties": properties}
+	if len(required) != 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// addFields adds JSON fields of struct to properties, fields
+// without omitempty are required
+func (g *schemaGenerator) addFields(t reflect.Type, properties schemaObject, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, omitEmpty, ok := jsonField(field)
+		if ok == false {
+			continue
+		}
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			// Fields of embedded struct are encoded as own ones
+			g.addFields(field.Type, properties, required)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = g.typeSchema(field.Type)
+		if omitEmpty == false {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// hasRequired returns true if values of type have required fields
+func (g *schemaGenerator) hasRequired(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return true
+	}
+	for i := 0; i < t.NumField(); i++ {
+		_, omitEmpty, ok := jsonField(t.Field(i))
+		if ok && omitEmpty == false {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonField returns name of field in JSON from its tag, empty if tag
+// doesn't set it. ok is false if field isn't encoded
+func jsonField(field reflect.StructField) (name string, omitEmpty bool, ok bool) {
+	if field.PkgPath != "" && field.Anonymous == false {
+		// Unexported
+		return "", false, false
+	}
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", false, false
+	}
+	parts := strings.Split(tag, ",")
+	for _, option := range parts[1:] {
+		if option == "omitempty" {
+			omitEmpty = true
+		}
+	}
+	return parts[0], omitEmpty, true
+}
+
+func (s *Server) ProtocolSchemaHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	schema, err := ProtocolSchema()
+	if err != nil {
+		s.logError("Protocol schema error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(schema)
+}
@@ -1,6 +1,7 @@
 package src
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,35 +9,97 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
-	"math/rand"
-	"encoding/base64"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
-	"go.uber.org/zap"
-	"github.com/go-pg/pg"
 	"github.com/rs/cors"
+	"go.uber.org/zap"
 
 	"github.com/go-redis/redis"
+	"github.com/revan730/gamedev-backend/auth"
 	"github.com/revan730/gamedev-backend/db"
+	"github.com/revan730/gamedev-backend/story"
 	"github.com/revan730/gamedev-backend/types"
 )
 
+// Time allowed to finish requests and save sessions on shutdown
+const shutdownTimeout = 15 * time.Second
+
 type Server struct {
 	logger         *zap.Logger
 	config         *Config
-	hub *GameHub
-	redisClient *redis.Client
-	databaseClient *db.DatabaseClient
+	hub            *GameHub
+	tokens         auth.TokenStore
+	databaseClient db.Store
 	router         *httprouter.Router
+	// Held while story is edited
+	storyMu sync.Mutex
 }
 
-func NewServer(logger *zap.Logger, config *Config) *Server {
+func NewServer(logger *zap.Logger, config *Config) (*Server, error) {
 	server := &Server{
 		logger: logger,
 		router: httprouter.New(),
 		config: config,
 	}
+	tokens, err := newTokenStore(config)
+	if err != nil {
+		return nil, err
+	}
+	var dbClient db.Store
+	if config.Storage == StorageMemory {
+		dbClient = db.NewMemoryStore()
+	} else {
+		dbClient = db.NewDBClient(config.DBAddr, config.DB, config.DBUser, config.DBPassword)
+	}
+	server.hub = NewGameHub(dbClient, tokens, config.SessionMode, config.Autosave, config.SafePage, logger)
+	if config.Cluster {
+		redisClient, err := newRedisClient(config)
+		if err != nil {
+			return nil, err
+		}
+		NewCluster(redisClient, server.hub)
+	}
+	server.tokens = tokens
+	server.databaseClient = dbClient
+	return server, nil
+}
+
+// newTokenStore returns token store chosen by config,
+// making sure redis is reachable if it's used
+func newTokenStore(config *Config) (auth.TokenStore, error) {
+	switch config.Tokens {
+	case TokensMemory:
+		return auth.NewMemoryTokenStore(auth.TokenTTL), nil
+	case TokensJWT:
+		keys, err := auth.LoadKeys(config.JWTKeysDir, config.JWTKeyId)
+		if err != nil {
+			return nil, err
+		}
+		var denylist auth.Denylist
+		if config.Denylist == TokensMemory {
+			denylist = auth.NewMemoryDenylist(auth.TokenTTL)
+		} else {
+			redisClient, err := newRedisClient(config)
+			if err != nil {
+				return nil, err
+			}
+			denylist = auth.NewRedisDenylist(redisClient, auth.TokenTTL)
+		}
+		return auth.NewJWTTokenStore(keys, denylist, auth.TokenTTL), nil
+	}
+	redisClient, err := newRedisClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return auth.NewRedisTokenStore(redisClient, auth.TokenTTL), nil
+}
+
+func newRedisClient(config *Config) (*redis.Client, error) {
 	redisClient := redis.NewClient(&redis.Options{
 		Addr:     config.RedisAddr,
 		Password: config.RedisPassword,
@@ -44,13 +107,9 @@ func NewServer(logger *zap.Logger, config *Config) *Server {
 	})
 	_, err := redisClient.Ping().Result()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	dbClient := db.NewDBClient(config.DBAddr, config.DB, config.DBUser, config.DBPassword)
-	server.hub = NewGameHub(dbClient, redisClient, logger)
-	server.redisClient = redisClient
-	server.databaseClient = dbClient
-	return server
+	return redisClient, nil
 }
 
 func (s *Server) logError(msg string, err error) {
@@ -66,7 +125,40 @@ func (s *Server) logInfo(msg string) {
 func (s *Server) Routes() *Server {
 	s.router.POST("/api/v1/login", s.LoginHandler)
 	s.router.POST("/api/v1/register", s.RegisterHandler)
-	s.router.GET("/api/v1/debug/users", s.DebugUsersHandler)
+	s.router.POST("/api/v1/logout", s.LogoutHandler)
+	s.router.POST("/api/v1/token/refresh", s.RefreshTokenHandler)
+	s.router.GET("/api/v1/protocol/schema", s.ProtocolSchemaHandler)
+	s.router.GET("/api/v1/sessions", s.SessionsHandler)
+	s.router.DELETE("/api/v1/sessions", s.RevokeAllSessionsHandler)
+	s.router.DELETE("/api/v1/sessions/:id", s.RevokeSessionHandler)
+	s.router.GET("/api/v1/debug/users", s.requirePermission(s.DebugUsersHandler, types.PermViewStats))
+	s.router.GET("/api/v1/debug/incidents", s.requirePermission(s.DebugIncidentsHandler, types.PermViewStats))
+	s.router.POST("/api/v1/admin/users/:id/kick", s.requirePermission(s.KickUserHandler, types.PermModerate))
+	s.router.PUT("/api/v1/admin/users/:id/role", s.requirePermission(s.SetUserRoleHandler, types.PermManageRoles))
+	s.router.POST("/api/v1/admin/announcements", s.requirePermission(s.AnnouncementHandler, types.PermModerate))
+	s.router.GET("/api/v1/admin/pages", s.requirePermission(s.ListPagesHandler, types.PermEditStory))
+	s.router.POST("/api/v1/admin/pages", s.requirePermission(s.CreatePageHandler, types.PermEditStory))
+	s.router.GET("/api/v1/admin/pages/:id", s.requirePermission(s.GetPageHandler, types.PermEditStory))
+	s.router.PUT("/api/v1/admin/pages/:id", s.requirePermission(s.UpdatePageHandler, types.PermEditStory))
+	s.router.DELETE("/api/v1/admin/pages/:id", s.requirePermission(s.DeletePageHandler, types.PermEditStory))
+	s.router.POST("/api/v1/admin/pages/:id/answers", s.requirePermission(s.CreateAnswerHandler, types.PermEditStory))
+	s.router.PUT("/api/v1/admin/answers/:id", s.requirePermission(s.UpdateAnswerHandler, types.PermEditStory))
+	s.router.DELETE("/api/v1/admin/answers/:id", s.requirePermission(s.DeleteAnswerHandler, types.PermEditStory))
+	s.router.GET("/api/v1/admin/departments", s.requirePermission(s.ListDepartmentsHandler, types.PermEditStory))
+	s.router.POST("/api/v1/admin/departments", s.requirePermission(s.CreateDepartmentHandler, types.PermEditStory))
+	s.router.PUT("/api/v1/admin/departments/:id", s.requirePermission(s.UpdateDepartmentHandler, types.PermEditStory))
+	s.router.DELETE("/api/v1/admin/departments/:id", s.requirePermission(s.DeleteDepartmentHandler, types.PermEditStory))
+	s.router.GET("/api/v1/admin/specialities", s.requirePermission(s.ListSpecialitiesHandler, types.PermEditStory))
+	s.router.POST("/api/v1/admin/specialities", s.requirePermission(s.CreateSpecialityHandler, types.PermEditStory))
+	s.router.PUT("/api/v1/admin/specialities/:id", s.requirePermission(s.UpdateSpecialityHandler, types.PermEditStory))
+	s.router.DELETE("/api/v1/admin/specialities/:id", s.requirePermission(s.DeleteSpecialityHandler, types.PermEditStory))
+	s.router.GET("/api/v1/admin/versions", s.requirePermission(s.ListVersionsHandler, types.PermEditStory))
+	s.router.POST("/api/v1/admin/versions", s.requirePermission(s.PublishVersionHandler, types.PermEditStory))
+	s.router.GET("/api/v1/admin/versions/:id", s.requirePermission(s.GetVersionHandler, types.PermEditStory))
+	s.router.GET("/api/v1/admin/audit", s.requirePermission(s.AuditLogHandler, types.PermEditStory))
+	s.router.GET("/api/v1/admin/stats/answers", s.requirePermission(s.AnswerStatsHandler, types.PermViewStats))
+	s.router.GET("/api/v1/admin/stats/dropoff", s.requirePermission(s.DropOffStatsHandler, types.PermViewStats))
+	s.router.GET("/api/v1/admin/stats/endings", s.requirePermission(s.EndingStatsHandler, types.PermViewStats))
 	return s
 }
 
@@ -98,21 +190,78 @@ func (s *Server) writeResponse(w http.ResponseWriter, responseBody interface{},
 
 func (s *Server) Run() {
 	defer s.databaseClient.Close()
-	rand.Seed(time.Now().UnixNano())
 	err := s.databaseClient.CreateSchema()
 	if err != nil {
 		s.logError("Failed to create database schema", err)
 		os.Exit(1)
 	}
+	if s.config.StoryFile != "" {
+		err = s.loadStory(s.config.StoryFile)
+		if err != nil {
+			s.logError("Failed to load story", err)
+			os.Exit(1)
+		}
+	}
 	s.router.HandlerFunc("GET", "/api/v1/game", s.hub.ServeWs)
 	s.logger.Info("Starting server", zap.Int("port", s.config.Port))
 	go s.hub.Run()
-	corsRouter := cors.Default().Handler(s.router)
-	err = http.ListenAndServe(fmt.Sprintf(":%d", s.config.Port), corsRouter)
+	if s.hub.cluster != nil {
+		go s.hub.cluster.Run()
+	}
+	corsRouter := cors.New(cors.Options{
+		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE"},
+		AllowedHeaders: []string{"Authorization", "Content-Type"},
+	}).Handler(s.router)
+	httpServer := &http.Server{
+		Addr:    fmt.Sprintf(":%d", s.config.Port),
+		Handler: corsRouter,
+	}
+	go func() {
+		err := httpServer.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			s.logError("Server failed", err)
+			os.Exit(1)
+		}
+	}()
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	<-stop
+	s.logInfo("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	// Websocket connections are hijacked, so Shutdown
+	// doesn't wait for them, hub closes them instead
+	err = httpServer.Shutdown(ctx)
 	if err != nil {
-		s.logError("Server failed", err)
-		os.Exit(1)
+		s.logError("HTTP server shutdown failed", err)
+	}
+	s.hub.Shutdown(ctx)
+}
+
+// loadStory imports story bundle into storage and publishes
+// it, unless it's the same as the latest published version
+func (s *Server) loadStory(path string) error {
+	bundle, err := story.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	report, err := story.Import(s.databaseClient, bundle)
+	for _, issue := range report.Issues {
+		s.logger.Warn(issue.String(), zap.String("packageLevel", "core"))
+	}
+	if err != nil {
+		return err
 	}
+	changed, err := story.DraftChanged(s.databaseClient)
+	if err != nil || changed == false {
+		return err
+	}
+	version, _, err := story.Publish(s.databaseClient, 0, "Loaded from "+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	s.logger.Info("Published story", zap.Int64("version", version.Id), zap.String("packageLevel", "core"))
+	return nil
 }
 
 func (s *Server) LoginHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
@@ -128,9 +277,11 @@ func (s *Server) LoginHandler(w http.ResponseWriter, r *http.Request, p httprout
 		s.writeResponse(w, &map[string]string{"err": "Empty login or password"}, http.StatusBadRequest)
 		return
 	}
-	// TODO: Handle pg error, or it will throw 500
-	// if user not found
 	user, err := s.databaseClient.FindUser(loginMsg.Login)
+	if err == db.ErrNotFound {
+		s.writeResponse(w, &map[string]string{"err": "Failed to login"}, http.StatusUnauthorized)
+		return
+	}
 	if err != nil {
 		s.logError("Find user error", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -144,12 +295,13 @@ func (s *Server) LoginHandler(w http.ResponseWriter, r *http.Request, p httprout
 		s.writeResponse(w, &map[string]string{"err": "Failed to login"}, http.StatusUnauthorized)
 		return
 	}
-	
-	// Generate user token and save to redis
-	tokenBytes := make([]byte, 8)
-	rand.Read(tokenBytes)
-	authToken := base64.StdEncoding.EncodeToString(tokenBytes)
-	s.redisClient.Set(authToken, user.Id, 6 * time.Hour).Result()
+
+	authToken, err := s.tokens.Issue(user)
+	if err != nil {
+		s.logError("Issue token error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
 	s.writeResponse(w, &map[string]string{"token": authToken}, http.StatusOK)
 }
@@ -169,9 +321,7 @@ func (s *Server) RegisterHandler(w http.ResponseWriter, r *http.Request, p httpr
 	}
 	err = s.databaseClient.CreateUser(registerMsg.Login, registerMsg.Password)
 	if err != nil {
-		// TODO: Maybe move this error handling to CreateUser func?
-		pgErr, ok := err.(pg.Error)
-		if ok && pgErr.IntegrityViolation() {
+		if err == db.ErrAlreadyExists {
 			s.writeResponse(w, &map[string]string{"err": "User already exists"}, http.StatusForbidden)
 			return
 		}
@@ -182,6 +332,20 @@ func (s *Server) RegisterHandler(w http.ResponseWriter, r *http.Request, p httpr
 	s.writeResponse(w, &map[string]interface{}{"err": nil}, http.StatusOK)
 }
 
-func (s *Server) DebugUsersHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	s.writeResponse(w, &map[string]int{"count": len(s.hub.clients)}, http.StatusOK)
-}
\ No newline at end of file
+func (s *Server) DebugUsersHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params, user *types.User) {
+	stats, err := s.hub.ClusterStats()
+	if err != nil {
+		s.logError("Cluster stats error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.writeResponse(w, &map[string]int{
+		"count": stats.Clients,
+		"users": stats.Users,
+		"nodes": stats.Nodes,
+	}, http.StatusOK)
+}
+
+func (s *Server) DebugIncidentsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params, user *types.User) {
+	s.writeResponse(w, s.hub.Incidents(), http.StatusOK)
+}
@@ -0,0 +1,190 @@
+package src
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/revan730/gamedev-backend/auth"
+	"github.com/revan730/gamedev-backend/db"
+	"github.com/revan730/gamedev-backend/types"
+)
+
+// bearerToken returns token from Authorization header
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") == false {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+}
+
+// authenticate resolves request's bearer token, writing
+// 401 response if it's missing or invalid
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (token string, identity auth.Identity, ok bool) {
+	token = bearerToken(r)
+	if token == "" {
+		s.writeResponse(w, &map[string]string{"err": "Missing token"}, http.StatusUnauthorized)
+		return "", identity, false
+	}
+	identity, err := s.tokens.Resolve(token)
+	if err == auth.ErrInvalidToken {
+		s.writeResponse(w, &map[string]string{"err": "Invalid token"}, http.StatusUnauthorized)
+		return "", identity, false
+	}
+	if err != nil {
+		s.logError("Resolve token error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return "", identity, false
+	}
+	return token, identity, true
+}
+
+// findUser loads authenticated user, writing error response if it fails
+func (s *Server) findUser(w http.ResponseWriter, userId int64) (*types.User, bool) {
+	user, err := s.databaseClient.FindUserById(userId)
+	if err == db.ErrNotFound {
+		s.writeResponse(w, &map[string]string{"err": "Invalid token"}, http.StatusUnauthorized)
+		return nil, false
+	}
+	if err != nil {
+		s.logError("Find user error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, false
+	}
+	return user, true
+}
+
+// userHandle is handler of request made by authenticated user
+type userHandle func(w http.ResponseWriter, r *http.Request, p httprouter.Params, user *types.User)
+
+// requirePermission wraps handler so it's served only to users whose
+// role grants permission, 401 is written for anonymous requests and 403
+// for the rest. Permission must be granted both by role carried in token
+// and by the current one, so taking role away applies right away
+func (s *Server) requirePermission(handler userHandle, permission string) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		_, identity, ok := s.authenticate(w, r)
+		if ok == false {
+			return
+		}
+		if types.Can(identity.Role, permission) == false {
+			s.writeResponse(w, &map[string]string{"err": "Forbidden"}, http.StatusForbidden)
+			return
+		}
+		user, ok := s.findUser(w, identity.UserId)
+		if ok == false {
+			return
+		}
+		if types.Can(user.Role, permission) == false {
+			s.writeResponse(w, &map[string]string{"err": "Forbidden"}, http.StatusForbidden)
+			return
+		}
+		handler(w, r, p, user)
+	}
+}
+
+func (s *Server) LogoutHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	token, _, ok := s.authenticate(w, r)
+	if ok == false {
+		return
+	}
+	err := s.tokens.Revoke(token)
+	if err != nil {
+		s.logError("Revoke token error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.hub.DisconnectToken(auth.HashToken(token))
+	s.writeResponse(w, &map[string]interface{}{"err": nil}, http.StatusOK)
+}
+
+func (s *Server) RefreshTokenHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	token, identity, ok := s.authenticate(w, r)
+	if ok == false {
+		return
+	}
+	// Fresh token carries user's current role
+	user, ok := s.findUser(w, identity.UserId)
+	if ok == false {
+		return
+	}
+	fresh, err := s.tokens.Refresh(token, user)
+	if err == auth.ErrInvalidToken {
+		s.writeResponse(w, &map[string]string{"err": "Invalid token"}, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		s.logError("Refresh token error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.hub.ReplaceToken(auth.HashToken(token), auth.HashToken(fresh))
+	s.writeResponse(w, &map[string]string{"token": fresh}, http.StatusOK)
+}
+
+func (s *Server) SessionsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	token, identity, ok := s.authenticate(w, r)
+	if ok == false {
+		return
+	}
+	sessions, err := s.tokens.List(identity.UserId)
+	if err == auth.ErrNotSupported {
+		s.writeResponse(w, &map[string]string{"err": "Not supported"}, http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		s.logError("List sessions error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	tokenHash := auth.HashToken(token)
+	list := make([]map[string]interface{}, 0, len(sessions))
+	for _, session := range sessions {
+		list = append(list, map[string]interface{}{
+			"id":        session.Id,
+			"createdAt": session.CreatedAt,
+			"expiresAt": session.ExpiresAt,
+			"current":   session.TokenHash == tokenHash,
+		})
+	}
+	s.writeResponse(w, &map[string]interface{}{"sessions": list}, http.StatusOK)
+}
+
+func (s *Server) RevokeAllSessionsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	_, identity, ok := s.authenticate(w, r)
+	if ok == false {
+		return
+	}
+	err := s.tokens.RevokeAll(identity.UserId)
+	if err != nil {
+		s.logError("Revoke sessions error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.hub.DisconnectUser(identity.UserId)
+	s.writeResponse(w, &map[string]interface{}{"err": nil}, http.StatusOK)
+}
+
+func (s *Server) RevokeSessionHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	_, identity, ok := s.authenticate(w, r)
+	if ok == false {
+		return
+	}
+	session, err := s.tokens.RevokeSession(identity.UserId, p.ByName("id"))
+	if err == auth.ErrNotSupported {
+		s.writeResponse(w, &map[string]string{"err": "Not supported"}, http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		s.logError("Revoke session error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if session == nil {
+		s.writeResponse(w, &map[string]string{"err": "Session not found"}, http.StatusNotFound)
+		return
+	}
+	s.hub.DisconnectToken(session.TokenHash)
+	s.writeResponse(w, &map[string]interface{}{"err": nil}, http.StatusOK)
+}
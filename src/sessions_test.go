@@ -0,0 +1,85 @@
+package src
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/revan730/gamedev-backend/auth"
+	"github.com/revan730/gamedev-backend/db"
+	"github.com/revan730/gamedev-backend/types"
+	"go.uber.org/zap"
+)
+
+// newUserWithRole creates user with role, returns it with token
+// issued while user had tokenRole
+func newUserWithRole(t *testing.T, store db.Store, tokens auth.TokenStore, login, tokenRole, role string) (*types.User, string) {
+	if err := store.CreateUser(login, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	user, err := store.FindUser(login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.Role = tokenRole
+	token, err := tokens.Issue(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetUserRole(user.Id, role); err != nil {
+		t.Fatal(err)
+	}
+	user.Role = role
+	return user, token
+}
+
+func TestRequirePermission(t *testing.T) {
+	store := db.NewMemoryStore()
+	tokens := auth.NewMemoryTokenStore(time.Hour)
+	s := &Server{logger: zap.NewNop(), databaseClient: store, tokens: tokens}
+	writer, writerToken := newUserWithRole(t, store, tokens, "writer", types.RoleWriter, types.RoleWriter)
+	_, playerToken := newUserWithRole(t, store, tokens, "player", types.RolePlayer, types.RolePlayer)
+	_, moderatorToken := newUserWithRole(t, store, tokens, "moderator", types.RoleModerator, types.RoleModerator)
+	_, demotedToken := newUserWithRole(t, store, tokens, "demoted", types.RoleWriter, types.RolePlayer)
+	_, promotedToken := newUserWithRole(t, store, tokens, "promoted", types.RolePlayer, types.RoleWriter)
+	cases := []struct {
+		name  string
+		token string
+		code  int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"unknown token", "unknown", http.StatusUnauthorized},
+		{"player", playerToken, http.StatusForbidden},
+		{"role without permission", moderatorToken, http.StatusForbidden},
+		{"role taken away after token was issued", demotedToken, http.StatusForbidden},
+		{"role granted after token was issued", promotedToken, http.StatusForbidden},
+		{"writer", writerToken, http.StatusOK},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var called *types.User
+			handle := s.requirePermission(func(w http.ResponseWriter, r *http.Request,
+				p httprouter.Params, user *types.User) {
+				called = user
+				w.WriteHeader(http.StatusOK)
+			}, types.PermEditStory)
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/admin/pages", nil)
+			if tc.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			w := httptest.NewRecorder()
+			handle(w, r, nil)
+			if w.Code != tc.code {
+				t.Errorf("expected %d, got %d", tc.code, w.Code)
+			}
+			if tc.code == http.StatusOK && (called == nil || called.Id != writer.Id) {
+				t.Errorf("handler wasn't called with writer: %+v", called)
+			}
+			if tc.code != http.StatusOK && called != nil {
+				t.Errorf("handler was called with %+v", called)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package src
+
+import (
+	"github.com/revan730/gamedev-backend/story"
+	"github.com/revan730/gamedev-backend/types"
+)
+
+// storyVersion is published story indexed for serving pages,
+// versions never change, so they are kept once loaded
+type storyVersion struct {
+	pages       map[int64]types.Page
+	answers     map[int64]types.Answer
+	pageAnswers map[int64][]types.Answer
+}
+
+func newStoryVersion(b *story.Bundle) *storyVersion {
+	version := &storyVersion{
+		pages:       make(map[int64]types.Page),
+		answers:     make(map[int64]types.Answer),
+		pageAnswers: make(map[int64][]types.Answer),
+	}
+	_, _, pages, answers := b.Types()
+	for _, page := range pages {
+		version.pages[page.Id] = page
+	}
+	for _, answer := range answers {
+		version.answers[answer.Id] = answer
+		version.pageAnswers[answer.PageId] = append(version.pageAnswers[answer.PageId], answer)
+	}
+	return version
+}
+
+// storyVersion returns published version, loading it on first use
+func (g *GameHub) storyVersion(versionId int64) (*storyVersion, error) {
+	g.versionsMu.RLock()
+	version, ok := g.versions[versionId]
+	g.versionsMu.RUnlock()
+	if ok {
+		return version, nil
+	}
+	stored, err := g.databaseClient.FindStoryVersion(versionId)
+	if err != nil {
+		return nil, err
+	}
+	b, err := story.FromVersion(stored)
+	if err != nil {
+		return nil, err
+	}
+	version = newStoryVersion(b)
+	g.versionsMu.Lock()
+	g.versions[versionId] = version
+	g.versionsMu.Unlock()
+	return version, nil
+}
+
+// LatestVersion returns id of the newest published story version,
+// 0 (the draft) if nothing is published yet. ok is false if it
+// couldn't be found out
+func (g *GameHub) LatestVersion() (versionId int64, ok bool) {
+	versionId, err := g.databaseClient.LatestStoryVersion()
+	if err != nil {
+		g.logError("Unable to get latest story version", err)
+		return 0, false
+	}
+	return versionId, true
+}
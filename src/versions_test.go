@@ -0,0 +1,92 @@
+package src
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/revan730/gamedev-backend/db"
+	"github.com/revan730/gamedev-backend/story"
+	"github.com/revan730/gamedev-backend/types"
+)
+
+// publishPages publishes pages with moveAnswers as a new
+// story version, returns its id
+func publishPages(t *testing.T, store db.Store, pages []types.Page) int64 {
+	content, err := json.Marshal(story.FromTypes(nil, nil, pages, moveAnswers))
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := &types.StoryVersion{Comment: "test", Content: string(content)}
+	if err := store.CreateStoryVersion(version); err != nil {
+		t.Fatal(err)
+	}
+	return version.Id
+}
+
+// labeledPages returns testPages with texts prefixed by label
+func labeledPages(label string) []types.Page {
+	pages := append([]types.Page(nil), testPages...)
+	for i := range pages {
+		pages[i].Text = label + ": " + pages[i].Text
+	}
+	return pages
+}
+
+func TestRunIsPinnedToVersion(t *testing.T) {
+	c, store := newTestClient(t, moveAnswers)
+	first := publishPages(t, store, labeledPages("v1"))
+	c.userData.StoryVersion = first
+	// Neither draft nor newer versions change pinned run
+	if err := store.ReplaceStory(nil, nil, labeledPages("draft"), moveAnswers); err != nil {
+		t.Fatal(err)
+	}
+	second := publishPages(t, store, labeledPages("v2"))
+	response := request(t, c, `{"v": 1, "channel": "story_move", "data": {"answerId": 1}}`)
+	if code := errorCode(response); code != "" {
+		t.Fatalf("move failed: %s", code)
+	}
+	if page := c.currentPage(); page == nil || page.Text != "v1: Lecture" {
+		t.Errorf("expected page of version %d, got %+v", first, page)
+	}
+	response = request(t, c, `{"v": 1, "channel": "story_reset"}`)
+	if code := errorCode(response); code != "" {
+		t.Fatalf("reset failed: %s", code)
+	}
+	if c.userData.StoryVersion != second {
+		t.Errorf("reset run is on version %d, expected %d", c.userData.StoryVersion, second)
+	}
+	if page := c.currentPage(); page == nil || page.Text != "v2: Go to the lecture?" {
+		t.Errorf("expected the first page of version %d, got %+v", second, page)
+	}
+}
+
+func TestEndingMovesRunToLatestVersion(t *testing.T) {
+	c, store := newTestClient(t, moveAnswers)
+	first := publishPages(t, store, labeledPages("v1"))
+	second := publishPages(t, store, labeledPages("v2"))
+	c.userData.StoryVersion = first
+	c.userData.CurrentPage = 3
+	response := request(t, c, `{"v": 1, "channel": "story_move", "data": {}}`)
+	if code := errorCode(response); code != "" {
+		t.Fatalf("move failed: %s", code)
+	}
+	if c.userData.StoryVersion != second || c.userData.CurrentPage != 1 {
+		t.Errorf("expected new run on version %d, got page %d of version %d",
+			second, c.userData.CurrentPage, c.userData.StoryVersion)
+	}
+}
+
+func TestJoinMovesDraftRunToLatestVersion(t *testing.T) {
+	s := newTestServer(t, SessionsTakeover)
+	first := publishPages(t, s.store, labeledPages("v1"))
+	_, token := s.login(t, "player")
+	conn := s.dial(t, token)
+	expectText(t, conn, "v1: Go to the lecture?")
+	conn.Close()
+	waitForUser(t, s, "player", func(user *types.User) bool { return user.StoryVersion == first })
+
+	// Run already pinned to a version stays on it
+	publishPages(t, s.store, labeledPages("v2"))
+	conn = s.dial(t, token)
+	expectText(t, conn, "v1: Go to the lecture?")
+}
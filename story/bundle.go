@@ -0,0 +1,243 @@
+package story
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/revan730/gamedev-backend/types"
+	"gopkg.in/yaml.v2"
+)
+
+// BundleVersion is the version of bundle format
+// produced by this build
+const BundleVersion = 1
+
+// Bundle represents the whole story graph in a form
+// suitable for authoring in files
+type Bundle struct {
+	Version      int          `json:"version" yaml:"version"`
+	Departments  []Department `json:"departments" yaml:"departments"`
+	Specialities []Speciality `json:"specialities" yaml:"specialities"`
+	Pages        []Page       `json:"pages" yaml:"pages"`
+}
+
+type Department struct {
+	Id    int64  `json:"id" yaml:"id"`
+	Title string `json:"title" yaml:"title"`
+}
+
+type Speciality struct {
+	Id    int64  `json:"id" yaml:"id"`
+	Title string `json:"title" yaml:"title"`
+}
+
+type Page struct {
+	Id          int64    `json:"id" yaml:"id"`
+	NextPage    int64    `json:"nextPage,omitempty" yaml:"nextPage,omitempty"`
+	IsQuestion  bool     `json:"isQuestion,omitempty" yaml:"isQuestion,omitempty"`
+	IsJumper    bool     `json:"isJumper,omitempty" yaml:"isJumper,omitempty"`
+	Year        int      `json:"year,omitempty" yaml:"year,omitempty"`
+	Dep         int64    `json:"dep,omitempty" yaml:"dep,omitempty"`
+	Spec        int64    `json:"spec,omitempty" yaml:"spec,omitempty"`
+	Text        string   `json:"text" yaml:"text"`
+	JumperLogic string   `json:"jumperLogic,omitempty" yaml:"jumperLogic,omitempty"`
+	Answers     []Answer `json:"answers,omitempty" yaml:"answers,omitempty"`
+}
+
+type Answer struct {
+	Id          int64  `json:"id" yaml:"id"`
+	Text        string `json:"text" yaml:"text"`
+	Knowledge   int    `json:"knowledge,omitempty" yaml:"knowledge,omitempty"`
+	Performance int    `json:"performance,omitempty" yaml:"performance,omitempty"`
+	Sober       int    `json:"sober,omitempty" yaml:"sober,omitempty"`
+	Prestige    int    `json:"prestige,omitempty" yaml:"prestige,omitempty"`
+	Connections int    `json:"connections,omitempty" yaml:"connections,omitempty"`
+	Praepostor  int    `json:"praepostor,omitempty" yaml:"praepostor,omitempty"`
+	Flags       string `json:"flags,omitempty" yaml:"flags,omitempty"`
+	Condition   string `json:"condition,omitempty" yaml:"condition,omitempty"`
+}
+
+func isYAML(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// ReadFile loads bundle from file, YAML is expected for .yaml/.yml
+// files and JSON for anything else. Unknown fields are errors
+// in both formats, so typos aren't silently dropped
+func ReadFile(path string) (*Bundle, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	bundle := &Bundle{}
+	if isYAML(path) {
+		err = yaml.UnmarshalStrict(data, bundle)
+	} else {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(bundle)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bundle, nil
+}
+
+// WriteFile saves bundle to file, format is chosen
+// the same way as in ReadFile
+func WriteFile(path string, b *Bundle) error {
+	var data []byte
+	var err error
+	if isYAML(path) {
+		data, err = yaml.Marshal(b)
+	} else {
+		data, err = json.MarshalIndent(b, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// Check makes sure bundle is structurally sound:
+// format version is supported and ids are set and unique
+func (b *Bundle) Check() error {
+	if b.Version != BundleVersion {
+		return fmt.Errorf("unsupported bundle version %d, expected %d", b.Version, BundleVersion)
+	}
+	depIds := make(map[int64]bool)
+	for _, dep := range b.Departments {
+		if dep.Id <= 0 {
+			return fmt.Errorf("department %q: id must be positive", dep.Title)
+		}
+		if depIds[dep.Id] {
+			return fmt.Errorf("department %d: duplicate id", dep.Id)
+		}
+		depIds[dep.Id] = true
+	}
+	specIds := make(map[int64]bool)
+	for _, spec := range b.Specialities {
+		if spec.Id <= 0 {
+			return fmt.Errorf("speciality %q: id must be positive", spec.Title)
+		}
+		if specIds[spec.Id] {
+			return fmt.Errorf("speciality %d: duplicate id", spec.Id)
+		}
+		specIds[spec.Id] = true
+	}
+	if len(b.Pages) == 0 {
+		return errors.New("bundle has no pages")
+	}
+	pageIds := make(map[int64]bool)
+	answerIds := make(map[int64]bool)
+	for _, page := range b.Pages {
+		if page.Id <= 0 {
+			return errors.New("page id must be positive")
+		}
+		if pageIds[page.Id] {
+			return fmt.Errorf("page %d: duplicate id", page.Id)
+		}
+		pageIds[page.Id] = true
+		for _, answer := range page.Answers {
+			if answer.Id <= 0 {
+				return fmt.Errorf("page %d: answer id must be positive", page.Id)
+			}
+			if answerIds[answer.Id] {
+				return fmt.Errorf("answer %d: duplicate id", answer.Id)
+			}
+			answerIds[answer.Id] = true
+		}
+	}
+	return nil
+}
+
+// FromTypes builds bundle out of database models
+func FromTypes(deps []types.Department, specs []types.Speciality,
+	pages []types.Page, answers []types.Answer) *Bundle {
+	b := &Bundle{Version: BundleVersion}
+	for _, dep := range deps {
+		b.Departments = append(b.Departments, Department{Id: dep.Id, Title: dep.Title})
+	}
+	for _, spec := range specs {
+		b.Specialities = append(b.Specialities, Speciality{Id: spec.Id, Title: spec.Title})
+	}
+	pageAnswers := make(map[int64][]Answer)
+	for _, a := range answers {
+		pageAnswers[a.PageId] = append(pageAnswers[a.PageId], Answer{
+			Id:          a.Id,
+			Text:        a.Text,
+			Knowledge:   a.Knowledge,
+			Performance: a.Performance,
+			Sober:       a.Sober,
+			Prestige:    a.Prestige,
+			Connections: a.Connections,
+			Praepostor:  a.Praepostor,
+			Flags:       a.Flags,
+			Condition:   a.Condition,
+		})
+	}
+	for _, p := range pages {
+		b.Pages = append(b.Pages, Page{
+			Id:          p.Id,
+			NextPage:    p.NextPage,
+			IsQuestion:  p.IsQuestion,
+			IsJumper:    p.IsJumper,
+			Year:        p.Year,
+			Dep:         p.Dep,
+			Spec:        p.Spec,
+			Text:        p.Text,
+			JumperLogic: p.JumperLogic,
+			Answers:     pageAnswers[p.Id],
+		})
+	}
+	return b
+}
+
+// Types converts bundle into database models
+func (b *Bundle) Types() ([]types.Department, []types.Speciality, []types.Page, []types.Answer) {
+	var deps []types.Department
+	var specs []types.Speciality
+	var pages []types.Page
+	var answers []types.Answer
+	for _, dep := range b.Departments {
+		deps = append(deps, types.Department{Id: dep.Id, Title: dep.Title})
+	}
+	for _, spec := range b.Specialities {
+		specs = append(specs, types.Speciality{Id: spec.Id, Title: spec.Title})
+	}
+	for _, p := range b.Pages {
+		pages = append(pages, types.Page{
+			Id:          p.Id,
+			NextPage:    p.NextPage,
+			IsQuestion:  p.IsQuestion,
+			IsJumper:    p.IsJumper,
+			Year:        p.Year,
+			Dep:         p.Dep,
+			Spec:        p.Spec,
+			Text:        p.Text,
+			JumperLogic: p.JumperLogic,
+		})
+		for _, a := range p.Answers {
+			answers = append(answers, types.Answer{
+				Id:          a.Id,
+				PageId:      p.Id,
+				Text:        a.Text,
+				Knowledge:   a.Knowledge,
+				Performance: a.Performance,
+				Sober:       a.Sober,
+				Prestige:    a.Prestige,
+				Connections: a.Connections,
+				Praepostor:  a.Praepostor,
+				Flags:       a.Flags,
+				Condition:   a.Condition,
+			})
+		}
+	}
+	return deps, specs, pages, answers
+}
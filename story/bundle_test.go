@@ -0,0 +1,76 @@
+package story
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/revan730/gamedev-backend/db"
+)
+
+// testBundle is a valid story with every field of bundle set
+func testBundle() *Bundle {
+	return &Bundle{
+		Version:      BundleVersion,
+		Departments:  []Department{{Id: 1, Title: "FICT"}},
+		Specialities: []Speciality{{Id: 1, Title: "Software engineering"}},
+		Pages: []Page{
+			{Id: 1, NextPage: 2, Year: 1, Dep: 1, Spec: 1, Text: "First day at university"},
+			{Id: 2, IsQuestion: true, NextPage: 3, Text: "Go to the lecture?", Answers: []Answer{
+				{Id: 1, Text: "Sure", Knowledge: 1, Performance: 2, Prestige: 3, Connections: 4, Praepostor: 5},
+				{Id: 2, Text: "Nah", Sober: -1, Flags: "skipper", Condition: `flagCheck("lazy") == false`},
+			}},
+			{Id: 3, IsJumper: true, JumperLogic: `if flagCheck("skipper") then jump(4) else jump(5) end`},
+			{Id: 4, Text: "Expelled"},
+			{Id: 5, Text: "Graduated"},
+		},
+	}
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	for _, name := range []string{"story.yaml", "story.json"} {
+		t.Run(name, func(t *testing.T) {
+			store := db.NewMemoryStore()
+			report, err := Import(store, testBundle())
+			if err != nil {
+				t.Fatalf("import: %v %v", err, report.Issues)
+			}
+			exported, err := Export(store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), name)
+			if err := WriteFile(path, exported); err != nil {
+				t.Fatal(err)
+			}
+			read, err := ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reflect.DeepEqual(read, testBundle()) == false {
+				t.Errorf("bundle changed on round trip:\n%+v\n%+v", read, testBundle())
+			}
+		})
+	}
+}
+
+func TestReadFileRejectsUnknownFields(t *testing.T) {
+	files := map[string]string{
+		"story.json": `{"version": 1, "pages": [{"id": 1, "text": "End", "nextPge": 2}]}`,
+		"story.yaml": "version: 1\npages:\n  - id: 1\n    text: End\n    nextPge: 2\n",
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := ReadFile(path)
+			if err == nil || strings.Contains(err.Error(), "nextPge") == false {
+				t.Errorf("expected error about nextPge, got %v", err)
+			}
+		})
+	}
+}
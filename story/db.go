@@ -0,0 +1,43 @@
+package story
+
+import (
+	"errors"
+
+	"github.com/revan730/gamedev-backend/db"
+)
+
+// ErrInvalidStory is returned when story
+// can't be saved because of validation errors
+var ErrInvalidStory = errors.New("story has errors")
+
+// Export loads the whole story graph from storage
+func Export(d db.Store) (*Bundle, error) {
+	deps, err := d.FindAllDepartments()
+	if err != nil {
+		return nil, err
+	}
+	specs, err := d.FindAllSpecialities()
+	if err != nil {
+		return nil, err
+	}
+	pages, err := d.FindAllPages()
+	if err != nil {
+		return nil, err
+	}
+	answers, err := d.FindAllAnswers()
+	if err != nil {
+		return nil, err
+	}
+	return FromTypes(deps, specs, pages, answers), nil
+}
+
+// Import validates bundle and replaces story in storage with it,
+// nothing is changed if validation found errors
+func Import(d db.Store, b *Bundle) (*Report, error) {
+	report := Validate(b)
+	if report.HasErrors() {
+		return report, ErrInvalidStory
+	}
+	deps, specs, pages, answers := b.Types()
+	return report, d.ReplaceStory(deps, specs, pages, answers)
+}
@@ -0,0 +1,314 @@
+package story
+
+import (
+	"github.com/revan730/gamedev-backend/db"
+	"github.com/revan730/gamedev-backend/types"
+)
+
+// Edit applies change to story and saves records it touched together
+// with audit entry change returns. Change is rejected with ErrInvalidStory
+// if it introduces errors story didn't have before, returned report
+// contains only new issues
+func Edit(d db.Store, change func(b *Bundle) (*types.AuditEntry, error)) (*Report, error) {
+	var report *Report
+	err := d.EditStory(func(content *db.StoryContent) (*db.StoryChanges, error) {
+		b := FromTypes(content.Departments, content.Specialities, content.Pages, content.Answers)
+		known := make(map[string]bool)
+		for _, issue := range Validate(b).Issues {
+			known[issue.String()] = true
+		}
+		entry, err := change(b)
+		if err != nil {
+			return nil, err
+		}
+		report = &Report{}
+		for _, issue := range Validate(b).Issues {
+			if known[issue.String()] == false {
+				report.Issues = append(report.Issues, issue)
+			}
+		}
+		if report.HasErrors() {
+			return nil, ErrInvalidStory
+		}
+		changes := diff(content, b)
+		changes.Audit = entry
+		return changes, nil
+	})
+	return report, err
+}
+
+// diff returns changes turning stored story into bundle
+func diff(content *db.StoryContent, b *Bundle) *db.StoryChanges {
+	changes := &db.StoryChanges{}
+	deps, specs, pages, answers := b.Types()
+
+	oldDeps := make(map[int64]types.Department)
+	for _, dep := range content.Departments {
+		oldDeps[dep.Id] = dep
+	}
+	for _, dep := range deps {
+		old, ok := oldDeps[dep.Id]
+		if ok == false || old != dep {
+			changes.Saved.Departments = append(changes.Saved.Departments, dep)
+		}
+		delete(oldDeps, dep.Id)
+	}
+	for _, dep := range content.Departments {
+		if _, ok := oldDeps[dep.Id]; ok {
+			changes.Removed.Departments = append(changes.Removed.Departments, dep)
+		}
+	}
+
+	oldSpecs := make(map[int64]types.Speciality)
+	for _, spec := range content.Specialities {
+		oldSpecs[spec.Id] = spec
+	}
+	for _, spec := range specs {
+		old, ok := oldSpecs[spec.Id]
+		if ok == false || old != spec {
+			changes.Saved.Specialities = append(changes.Saved.Specialities, spec)
+		}
+		delete(oldSpecs, spec.Id)
+	}
+	for _, spec := range content.Specialities {
+		if _, ok := oldSpecs[spec.Id]; ok {
+			changes.Removed.Specialities = append(changes.Removed.Specialities, spec)
+		}
+	}
+
+	oldPages := make(map[int64]types.Page)
+	for _, page := range content.Pages {
+		oldPages[page.Id] = page
+	}
+	for _, page := range pages {
+		old, ok := oldPages[page.Id]
+		if ok == false || old != page {
+			changes.Saved.Pages = append(changes.Saved.Pages, page)
+		}
+		delete(oldPages, page.Id)
+	}
+	for _, page := range content.Pages {
+		if _, ok := oldPages[page.Id]; ok {
+			changes.Removed.Pages = append(changes.Removed.Pages, page)
+		}
+	}
+
+	oldAnswers := make(map[int64]types.Answer)
+	for _, answer := range content.Answers {
+		oldAnswers[answer.Id] = answer
+	}
+	for _, answer := range answers {
+		old, ok := oldAnswers[answer.Id]
+		if ok == false || old != answer {
+			changes.Saved.Answers = append(changes.Saved.Answers, answer)
+		}
+		delete(oldAnswers, answer.Id)
+	}
+	for _, answer := range content.Answers {
+		if _, ok := oldAnswers[answer.Id]; ok {
+			changes.Removed.Answers = append(changes.Removed.Answers, answer)
+		}
+	}
+	return changes
+}
+
+// FindPage returns page by id, nil if there is none
+func (b *Bundle) FindPage(pageId int64) *Page {
+	for i := range b.Pages {
+		if b.Pages[i].Id == pageId {
+			return &b.Pages[i]
+		}
+	}
+	return nil
+}
+
+// FindAnswer returns answer by id, nil if there is none
+func (b *Bundle) FindAnswer(answerId int64) *Answer {
+	page, i := b.findAnswer(answerId)
+	if page == nil {
+		return nil
+	}
+	return &page.Answers[i]
+}
+
+// findAnswer returns page answer is on and its index there
+func (b *Bundle) findAnswer(answerId int64) (*Page, int) {
+	for i := range b.Pages {
+		for j := range b.Pages[i].Answers {
+			if b.Pages[i].Answers[j].Id == answerId {
+				return &b.Pages[i], j
+			}
+		}
+	}
+	return nil, -1
+}
+
+func (b *Bundle) lastAnswerId() int64 {
+	var last int64
+	for _, page := range b.Pages {
+		for _, answer := range page.Answers {
+			if answer.Id > last {
+				last = answer.Id
+			}
+		}
+	}
+	return last
+}
+
+// numberAnswers gives ids to new answers, ones with zero id
+func (b *Bundle) numberAnswers(answers []Answer) {
+	last := b.lastAnswerId()
+	for i := range answers {
+		if answers[i].Id == 0 {
+			last++
+			answers[i].Id = last
+		}
+	}
+}
+
+// AddPage adds page with its answers to story, giving them new ids
+func (b *Bundle) AddPage(page Page) int64 {
+	var last int64
+	for _, existing := range b.Pages {
+		if existing.Id > last {
+			last = existing.Id
+		}
+	}
+	page.Id = last + 1
+	for i := range page.Answers {
+		page.Answers[i].Id = 0
+	}
+	b.numberAnswers(page.Answers)
+	b.Pages = append(b.Pages, page)
+	return page.Id
+}
+
+// ReplacePage replaces page with the same id. Page keeps its answers
+// if new ones aren't given, answers without id are added as new ones
+func (b *Bundle) ReplacePage(page Page) error {
+	existing := b.FindPage(page.Id)
+	if existing == nil {
+		return db.ErrNotFound
+	}
+	if page.Answers == nil {
+		page.Answers = existing.Answers
+	} else {
+		b.numberAnswers(page.Answers)
+	}
+	*existing = page
+	return nil
+}
+
+// RemovePage removes page with its answers
+func (b *Bundle) RemovePage(pageId int64) error {
+	for i := range b.Pages {
+		if b.Pages[i].Id == pageId {
+			b.Pages = append(b.Pages[:i], b.Pages[i+1:]...)
+			return nil
+		}
+	}
+	return db.ErrNotFound
+}
+
+// AddAnswer adds answer to page, giving it new id
+func (b *Bundle) AddAnswer(pageId int64, answer Answer) (int64, error) {
+	page := b.FindPage(pageId)
+	if page == nil {
+		return 0, db.ErrNotFound
+	}
+	answer.Id = b.lastAnswerId() + 1
+	page.Answers = append(page.Answers, answer)
+	return answer.Id, nil
+}
+
+// ReplaceAnswer replaces answer with the same id, keeping its page
+func (b *Bundle) ReplaceAnswer(answer Answer) error {
+	page, i := b.findAnswer(answer.Id)
+	if page == nil {
+		return db.ErrNotFound
+	}
+	page.Answers[i] = answer
+	return nil
+}
+
+// RemoveAnswer removes answer from its page
+func (b *Bundle) RemoveAnswer(answerId int64) error {
+	page, i := b.findAnswer(answerId)
+	if page == nil {
+		return db.ErrNotFound
+	}
+	page.Answers = append(page.Answers[:i], page.Answers[i+1:]...)
+	return nil
+}
+
+// AddDepartment adds department to story, giving it new id
+func (b *Bundle) AddDepartment(dep Department) int64 {
+	var last int64
+	for _, existing := range b.Departments {
+		if existing.Id > last {
+			last = existing.Id
+		}
+	}
+	dep.Id = last + 1
+	b.Departments = append(b.Departments, dep)
+	return dep.Id
+}
+
+// ReplaceDepartment replaces department with the same id
+func (b *Bundle) ReplaceDepartment(dep Department) error {
+	for i := range b.Departments {
+		if b.Departments[i].Id == dep.Id {
+			b.Departments[i] = dep
+			return nil
+		}
+	}
+	return db.ErrNotFound
+}
+
+// RemoveDepartment removes department, pages
+// still using it make story invalid
+func (b *Bundle) RemoveDepartment(depId int64) error {
+	for i := range b.Departments {
+		if b.Departments[i].Id == depId {
+			b.Departments = append(b.Departments[:i], b.Departments[i+1:]...)
+			return nil
+		}
+	}
+	return db.ErrNotFound
+}
+
+// AddSpeciality adds speciality to story, giving it new id
+func (b *Bundle) AddSpeciality(spec Speciality) int64 {
+	var last int64
+	for _, existing := range b.Specialities {
+		if existing.Id > last {
+			last = existing.Id
+		}
+	}
+	spec.Id = last + 1
+	b.Specialities = append(b.Specialities, spec)
+	return spec.Id
+}
+
+// ReplaceSpeciality replaces speciality with the same id
+func (b *Bundle) ReplaceSpeciality(spec Speciality) error {
+	for i := range b.Specialities {
+		if b.Specialities[i].Id == spec.Id {
+			b.Specialities[i] = spec
+			return nil
+		}
+	}
+	return db.ErrNotFound
+}
+
+// RemoveSpeciality removes speciality, pages
+// still using it make story invalid
+func (b *Bundle) RemoveSpeciality(specId int64) error {
+	for i := range b.Specialities {
+		if b.Specialities[i].Id == specId {
+			b.Specialities = append(b.Specialities[:i], b.Specialities[i+1:]...)
+			return nil
+		}
+	}
+	return db.ErrNotFound
+}
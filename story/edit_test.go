@@ -0,0 +1,95 @@
+package story
+
+import (
+	"testing"
+
+	"github.com/revan730/gamedev-backend/db"
+	"github.com/revan730/gamedev-backend/types"
+)
+
+// changesStore is memory store keeping changes of the last story edit
+type changesStore struct {
+	*db.MemoryStore
+	changes *db.StoryChanges
+}
+
+func (s *changesStore) EditStory(edit func(content *db.StoryContent) (*db.StoryChanges, error)) error {
+	return s.MemoryStore.EditStory(func(content *db.StoryContent) (*db.StoryChanges, error) {
+		changes, err := edit(content)
+		s.changes = changes
+		return changes, err
+	})
+}
+
+func newChangesStore(t *testing.T) *changesStore {
+	store := &changesStore{MemoryStore: db.NewMemoryStore()}
+	if report, err := Import(store, testBundle()); err != nil {
+		t.Fatalf("import: %v %v", err, report.Issues)
+	}
+	return store
+}
+
+func TestEditSavesOnlyChangedRecords(t *testing.T) {
+	store := newChangesStore(t)
+	entry := &types.AuditEntry{Action: types.AuditUpdate, Kind: "answer", RecordId: 2}
+	_, err := Edit(store, func(b *Bundle) (*types.AuditEntry, error) {
+		answer := *b.FindAnswer(2)
+		answer.Text = "Nope"
+		return entry, b.ReplaceAnswer(answer)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, removed := store.changes.Saved, store.changes.Removed
+	if len(saved.Answers) != 1 || saved.Answers[0].Id != 2 || saved.Answers[0].PageId != 2 ||
+		len(saved.Pages)+len(saved.Departments)+len(saved.Specialities) != 0 {
+		t.Errorf("expected answer 2 to be saved alone, got %+v", saved)
+	}
+	if len(removed.Pages)+len(removed.Answers)+len(removed.Departments)+len(removed.Specialities) != 0 {
+		t.Errorf("records were removed: %+v", removed)
+	}
+	if store.changes.Audit != entry {
+		t.Error("audit entry isn't saved with changes")
+	}
+	if log, _ := store.FindAuditLog(10); len(log) != 1 || log[0].RecordId != 2 {
+		t.Errorf("expected audit entry of answer 2, got %+v", log)
+	}
+}
+
+func TestEditRemovesPageWithAnswers(t *testing.T) {
+	store := newChangesStore(t)
+	_, err := Edit(store, func(b *Bundle) (*types.AuditEntry, error) {
+		page := b.FindPage(1)
+		page.NextPage = 3
+		return &types.AuditEntry{Action: types.AuditDelete, Kind: "page", RecordId: 2}, b.RemovePage(2)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, removed := store.changes.Saved, store.changes.Removed
+	if len(saved.Pages) != 1 || saved.Pages[0].Id != 1 || len(saved.Answers) != 0 {
+		t.Errorf("expected page 1 to be saved alone, got %+v", saved)
+	}
+	if len(removed.Pages) != 1 || removed.Pages[0].Id != 2 || len(removed.Answers) != 2 {
+		t.Errorf("expected page 2 to be removed with its answers, got %+v", removed)
+	}
+	if answers, _ := store.FindAllAnswers(); len(answers) != 0 {
+		t.Errorf("answers of removed page are still there: %+v", answers)
+	}
+}
+
+func TestEditWithErrorsSavesNothing(t *testing.T) {
+	store := newChangesStore(t)
+	report, err := Edit(store, func(b *Bundle) (*types.AuditEntry, error) {
+		return &types.AuditEntry{Action: types.AuditDelete, Kind: "page", RecordId: 4}, b.RemovePage(4)
+	})
+	if err != ErrInvalidStory || report.HasErrors() == false {
+		t.Fatalf("expected ErrInvalidStory with report of errors, got %v %+v", err, report)
+	}
+	if _, err := store.FindPageById(4); err != nil {
+		t.Errorf("page of refused edit was removed: %v", err)
+	}
+	if log, _ := store.FindAuditLog(10); len(log) != 0 {
+		t.Errorf("refused edit is in audit log: %+v", log)
+	}
+}
@@ -0,0 +1,200 @@
+package story
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/revan730/gamedev-backend/lua"
+)
+
+// FirstPage is the page every run starts from
+const FirstPage = 1
+
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// Issue is a single problem found in story graph
+type Issue struct {
+	Severity Severity `json:"severity"`
+	PageId   int64    `json:"pageId,omitempty"`
+	AnswerId int64    `json:"answerId,omitempty"`
+	Message  string   `json:"message"`
+}
+
+func (i Issue) String() string {
+	switch {
+	case i.AnswerId != 0:
+		return fmt.Sprintf("%s: page %d, answer %d: %s", i.Severity, i.PageId, i.AnswerId, i.Message)
+	case i.PageId != 0:
+		return fmt.Sprintf("%s: page %d: %s", i.Severity, i.PageId, i.Message)
+	default:
+		return fmt.Sprintf("%s: %s", i.Severity, i.Message)
+	}
+}
+
+// Report contains all issues found by Validate
+type Report struct {
+	Issues []Issue `json:"issues"`
+}
+
+func (r *Report) add(severity Severity, pageId, answerId int64, format string, args ...interface{}) {
+	r.Issues = append(r.Issues, Issue{
+		Severity: severity,
+		PageId:   pageId,
+		AnswerId: answerId,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// HasErrors returns true if report contains issues
+// that would break a run
+func (r *Report) HasErrors() bool {
+	for _, issue := range r.Issues {
+		if issue.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate walks story graph starting from the first page and reports
+// dangling references, question pages without answers, broken
+// jumper scripts, unreachable pages and pages that never lead to an ending
+func Validate(b *Bundle) *Report {
+	report := &Report{}
+	if err := b.Check(); err != nil {
+		report.add(SeverityError, 0, 0, "%s", err)
+		return report
+	}
+	pages := make(map[int64]*Page)
+	for i := range b.Pages {
+		pages[b.Pages[i].Id] = &b.Pages[i]
+	}
+	deps := make(map[int64]bool)
+	for _, dep := range b.Departments {
+		deps[dep.Id] = true
+	}
+	specs := make(map[int64]bool)
+	for _, spec := range b.Specialities {
+		specs[spec.Id] = true
+	}
+	if pages[FirstPage] == nil {
+		report.add(SeverityError, 0, 0, "first page %d is missing", FirstPage)
+	}
+
+	// Pages each page can lead to, ending pages lead nowhere
+	edges := make(map[int64][]int64)
+	// Jumper pages with targets that can't be resolved statically
+	dynamic := make(map[int64]bool)
+	// Jumper pages which don't compile, already reported
+	broken := make(map[int64]bool)
+	endings := make(map[int64]bool)
+	for _, page := range b.Pages {
+		if page.Dep != 0 && deps[page.Dep] == false {
+			report.add(SeverityError, page.Id, 0, "unknown department %d", page.Dep)
+		}
+		if page.Spec != 0 && specs[page.Spec] == false {
+			report.add(SeverityError, page.Id, 0, "unknown speciality %d", page.Spec)
+		}
+		if page.IsQuestion && len(page.Answers) == 0 {
+			report.add(SeverityError, page.Id, 0, "question page has no answers")
+		}
+		if page.IsQuestion == false && len(page.Answers) != 0 {
+			report.add(SeverityWarning, page.Id, 0, "answers of non-question page are never shown")
+		}
+		for _, answer := range page.Answers {
+			if answer.Condition == "" {
+				continue
+			}
+			if _, err := lua.CompileCondition(answer.Condition); err != nil {
+				report.add(SeverityError, page.Id, answer.Id, "condition doesn't compile: %s",
+					strings.TrimSpace(err.Error()))
+			}
+		}
+		if page.IsJumper {
+			if page.NextPage != 0 {
+				report.add(SeverityWarning, page.Id, 0, "nextPage of jumper page is ignored")
+			}
+			targets, isDynamic, err := lua.JumpTargets(page.JumperLogic)
+			if err != nil {
+				report.add(SeverityError, page.Id, 0, "jumper logic doesn't compile: %s",
+					strings.TrimSpace(err.Error()))
+				broken[page.Id] = true
+				continue
+			}
+			for _, target := range targets {
+				if pages[target] == nil {
+					report.add(SeverityError, page.Id, 0, "jump() to missing page %d", target)
+					continue
+				}
+				edges[page.Id] = append(edges[page.Id], target)
+			}
+			if isDynamic {
+				dynamic[page.Id] = true
+				report.add(SeverityWarning, page.Id, 0, "jump() target can't be checked statically")
+			} else if len(targets) == 0 {
+				report.add(SeverityError, page.Id, 0, "jumper logic never calls jump()")
+			}
+			continue
+		}
+		if page.NextPage == 0 {
+			endings[page.Id] = true
+			continue
+		}
+		if pages[page.NextPage] == nil {
+			report.add(SeverityError, page.Id, 0, "nextPage %d is missing", page.NextPage)
+			continue
+		}
+		edges[page.Id] = append(edges[page.Id], page.NextPage)
+	}
+
+	reachable := walk([]int64{FirstPage}, edges)
+	// Reverse edges to find pages leading to an ending. Dynamic jumpers
+	// are given the benefit of the doubt, as well as broken ones, whose
+	// targets are unknown until they compile
+	reverse := make(map[int64][]int64)
+	for from, targets := range edges {
+		for _, to := range targets {
+			reverse[to] = append(reverse[to], from)
+		}
+	}
+	var exits []int64
+	for _, page := range b.Pages {
+		if endings[page.Id] || dynamic[page.Id] || broken[page.Id] {
+			exits = append(exits, page.Id)
+		}
+	}
+	finishing := walk(exits, reverse)
+	for _, page := range b.Pages {
+		if broken[page.Id] {
+			continue
+		}
+		if pages[FirstPage] != nil && reachable[page.Id] == false {
+			report.add(SeverityWarning, page.Id, 0, "page is unreachable from page %d", FirstPage)
+		}
+		if finishing[page.Id] == false {
+			report.add(SeverityError, page.Id, 0, "page never leads to an ending")
+		}
+	}
+	return report
+}
+
+// walk returns set of pages reachable from start pages
+func walk(start []int64, edges map[int64][]int64) map[int64]bool {
+	visited := make(map[int64]bool)
+	queue := append([]int64{}, start...)
+	for len(queue) != 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if visited[id] {
+			continue
+		}
+		visited[id] = true
+		queue = append(queue, edges[id]...)
+	}
+	return visited
+}
@@ -0,0 +1,99 @@
+package story
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name   string
+		change func(b *Bundle)
+		// Prefixes of issues, in order they are reported
+		issues []string
+	}{
+		{"valid story", func(b *Bundle) {}, nil},
+		{"unsupported version", func(b *Bundle) { b.Version = 2 }, []string{
+			"error: unsupported bundle version 2, expected 1",
+		}},
+		{"missing first page", func(b *Bundle) { b.Pages = b.Pages[1:] }, []string{
+			"error: first page 1 is missing",
+		}},
+		{"unknown department", func(b *Bundle) { b.Pages[0].Dep = 9 }, []string{
+			"error: page 1: unknown department 9",
+		}},
+		{"unknown speciality", func(b *Bundle) { b.Pages[0].Spec = 9 }, []string{
+			"error: page 1: unknown speciality 9",
+		}},
+		{"question without answers", func(b *Bundle) { b.Pages[1].Answers = nil }, []string{
+			"error: page 2: question page has no answers",
+		}},
+		{"answers of non-question page", func(b *Bundle) { b.Pages[1].IsQuestion = false }, []string{
+			"warning: page 2: answers of non-question page are never shown",
+		}},
+		{"broken condition", func(b *Bundle) { b.Pages[1].Answers[1].Condition = "flagCheck(" }, []string{
+			"error: page 2, answer 2: condition doesn't compile",
+		}},
+		{"nextPage of jumper", func(b *Bundle) { b.Pages[2].NextPage = 4 }, []string{
+			"warning: page 3: nextPage of jumper page is ignored",
+		}},
+		{"broken jumper", func(b *Bundle) { b.Pages[2].JumperLogic = "jump(4" }, []string{
+			"error: page 3: jumper logic doesn't compile",
+			"warning: page 4: page is unreachable from page 1",
+			"warning: page 5: page is unreachable from page 1",
+		}},
+		{"jump to missing page", func(b *Bundle) { b.Pages[2].JumperLogic = "jump(9) jump(5)" }, []string{
+			"error: page 3: jump() to missing page 9",
+			"warning: page 4: page is unreachable from page 1",
+		}},
+		{"dynamic jump", func(b *Bundle) { b.Pages[2].JumperLogic = "jump(4 + random(0, 1))" }, []string{
+			"warning: page 3: jump() target can't be checked statically",
+			"warning: page 4: page is unreachable from page 1",
+			"warning: page 5: page is unreachable from page 1",
+		}},
+		{"jumper without jump", func(b *Bundle) { b.Pages[2].JumperLogic = "addKnowledge(1)" }, []string{
+			"error: page 3: jumper logic never calls jump()",
+			"error: page 1: page never leads to an ending",
+			"error: page 2: page never leads to an ending",
+			"error: page 3: page never leads to an ending",
+			"warning: page 4: page is unreachable from page 1",
+			"warning: page 5: page is unreachable from page 1",
+		}},
+		{"missing nextPage", func(b *Bundle) { b.Pages[3].NextPage = 9 }, []string{
+			"error: page 4: nextPage 9 is missing",
+			"error: page 4: page never leads to an ending",
+		}},
+		{"loop without ending", func(b *Bundle) { b.Pages[3].NextPage = 4 }, []string{
+			"error: page 4: page never leads to an ending",
+		}},
+		{"unreachable page", func(b *Bundle) { b.Pages = append(b.Pages, Page{Id: 6, Text: "Lost"}) }, []string{
+			"warning: page 6: page is unreachable from page 1",
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := testBundle()
+			tc.change(b)
+			report := Validate(b)
+			var issues []string
+			for _, issue := range report.Issues {
+				issues = append(issues, issue.String())
+			}
+			if len(issues) != len(tc.issues) {
+				t.Fatalf("expected %d issues, got %q", len(tc.issues), issues)
+			}
+			for i, issue := range issues {
+				if strings.HasPrefix(issue, tc.issues[i]) == false {
+					t.Errorf("expected %q, got %q", tc.issues[i], issue)
+				}
+			}
+			hasErrors := false
+			for _, expected := range tc.issues {
+				hasErrors = hasErrors || strings.HasPrefix(expected, "error")
+			}
+			if report.HasErrors() != hasErrors {
+				t.Errorf("HasErrors is %v", report.HasErrors())
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package story
+
+import (
+	"encoding/json"
+
+	"github.com/revan730/gamedev-backend/db"
+	"github.com/revan730/gamedev-backend/types"
+)
+
+// Publish saves the draft story from storage as a new version,
+// nothing is published if draft has errors. userId is publisher,
+// 0 when version is published from CLI
+func Publish(d db.Store, userId int64, comment string) (*types.StoryVersion, *Report, error) {
+	b, err := Export(d)
+	if err != nil {
+		return nil, nil, err
+	}
+	report := Validate(b)
+	if report.HasErrors() {
+		return nil, report, ErrInvalidStory
+	}
+	content, err := json.Marshal(b)
+	if err != nil {
+		return nil, report, err
+	}
+	version := &types.StoryVersion{
+		Comment:     comment,
+		PublishedBy: userId,
+		Content:     string(content),
+	}
+	return version, report, d.CreateStoryVersion(version)
+}
+
+// DraftChanged returns true if draft story differs from
+// the latest published version or nothing is published yet
+func DraftChanged(d db.Store) (bool, error) {
+	latest, err := d.LatestStoryVersion()
+	if err != nil || latest == 0 {
+		return true, err
+	}
+	version, err := d.FindStoryVersion(latest)
+	if err != nil {
+		return true, err
+	}
+	b, err := Export(d)
+	if err != nil {
+		return true, err
+	}
+	content, err := json.Marshal(b)
+	if err != nil {
+		return true, err
+	}
+	return string(content) != version.Content, nil
+}
+
+// FromVersion returns story bundle of published version
+func FromVersion(version *types.StoryVersion) (*Bundle, error) {
+	b := &Bundle{}
+	err := json.Unmarshal([]byte(version.Content), b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
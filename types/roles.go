@@ -0,0 +1,44 @@
+package types
+
+// Roles of users
+const (
+	RolePlayer = "player"
+	// Edits story content
+	RoleWriter = "writer"
+	// Watches over players
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// Permissions granted by roles
+const (
+	// Edit story content and see its audit log
+	PermEditStory = "edit_story"
+	// Jump to any page of story in game
+	PermPreviewStory = "preview_story"
+	// Kick users and send announcements
+	PermModerate = "moderate"
+	// See analytics and online users
+	PermViewStats = "view_stats"
+	// Change roles of users
+	PermManageRoles = "manage_roles"
+)
+
+var rolePermissions = map[string][]string{
+	RolePlayer:    {},
+	RoleWriter:    {PermEditStory, PermPreviewStory, PermViewStats},
+	RoleModerator: {PermModerate, PermViewStats},
+	RoleAdmin: {PermEditStory, PermPreviewStory, PermModerate,
+		PermViewStats, PermManageRoles},
+}
+
+// IsRole returns true if role exists
+func IsRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// Can returns true if role grants permission
+func Can(role, permission string) bool {
+	return contains(rolePermissions[role], permission)
+}
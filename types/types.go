@@ -2,6 +2,7 @@ package types
 
 import (
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -30,6 +31,8 @@ type Answer struct {
 	Connections int    `json:"-" sql:"default:0"`
 	Praepostor  int    `json:"-" sql:"default:0"`
 	Flags       string `json:"-" sql:"default:''"`
+	// Lua expression, answer is shown only if it's true
+	Condition string `json:"-" sql:"default:''"`
 }
 
 type Page struct {
@@ -56,6 +59,11 @@ type User struct {
 	Connections int    `json:"connections" sql:"default:0"`
 	Praepostor  int    `json:"-" sql:"default:0"`
 	Flags       string `json:"-"`
+	Role        string `json:"-" sql:"default:'player'"`
+	// Published story version run is played on, 0 is the draft
+	StoryVersion int64 `json:"storyVersion" sql:"default:0,notnull"`
+	// Bumped on every save, to detect concurrent changes
+	Version int64 `json:"-" sql:"default:0,notnull"`
 }
 
 func (u User) Authenticate(password string) bool {
@@ -87,11 +95,159 @@ func (u *User) SetFlag(flag string) {
 	u.MergeFlags(flag)
 }
 
+// RemoveFlag unsets flag if it's set
+func (u *User) RemoveFlag(flag string) {
+	userFlags := strings.Split(u.Flags, " ")
+	kept := userFlags[:0]
+	for _, fl := range userFlags {
+		if fl != flag {
+			kept = append(kept, fl)
+		}
+	}
+	u.Flags = strings.Join(kept, " ")
+}
+
+// AddedFlags returns space separated flags which
+// are set in after but not in before
+func AddedFlags(before, after string) string {
+	beforeArr := strings.Split(before, " ")
+	var added []string
+	for _, fl := range strings.Split(after, " ") {
+		if fl != "" && contains(beforeArr, fl) == false {
+			added = append(added, fl)
+		}
+	}
+	return strings.Join(added, " ")
+}
+
 func (u User) IsFlagSet(flag string) bool {
 	flagsArr := strings.Split(u.Flags, " ")
 	return contains(flagsArr, flag)
 }
 
+// Stats holds values of user's stats, used
+// to record how they change
+type Stats struct {
+	Knowledge   int `json:"knowledge"`
+	Performance int `json:"performance"`
+	Sober       int `json:"soberness"`
+	Prestige    int `json:"prestige"`
+	Connections int `json:"connections"`
+	Praepostor  int `json:"praepostor"`
+}
+
+// Sub returns difference between two stat sets
+func (s Stats) Sub(o Stats) Stats {
+	return Stats{
+		Knowledge:   s.Knowledge - o.Knowledge,
+		Performance: s.Performance - o.Performance,
+		Sober:       s.Sober - o.Sober,
+		Prestige:    s.Prestige - o.Prestige,
+		Connections: s.Connections - o.Connections,
+		Praepostor:  s.Praepostor - o.Praepostor,
+	}
+}
+
+func (u User) Stats() Stats {
+	return Stats{
+		Knowledge:   u.Knowledge,
+		Performance: u.Performance,
+		Sober:       u.Sober,
+		Prestige:    u.Prestige,
+		Connections: u.Connections,
+		Praepostor:  u.Praepostor,
+	}
+}
+
+// AddStats adds provided values to user's stats
+func (u *User) AddStats(s Stats) {
+	u.Knowledge += s.Knowledge
+	u.Performance += s.Performance
+	u.Sober += s.Sober
+	u.Prestige += s.Prestige
+	u.Connections += s.Connections
+	u.Praepostor += s.Praepostor
+}
+
+// HistoryEntry records single transition between pages
+// made by user, so it can be rolled back
+type HistoryEntry struct {
+	Id           int64     `json:"-"`
+	UserId       int64     `json:"-" sql:",notnull"`
+	FromPage     int64     `json:"-"`
+	ToPage       int64     `json:"-"`
+	AnswerId     int64     `json:"-" sql:"default:0"`
+	Delta        Stats     `json:"-"`
+	FlagsAdded   string    `json:"-" sql:"default:''"`
+	FlagsRemoved string    `json:"-" sql:"default:''"`
+	Jumped       bool      `json:"-" sql:"default:false"`
+	CreatedAt    time.Time `json:"-" sql:"default:now()"`
+}
+
+// Revert rolls back changes made to user by transition
+func (h HistoryEntry) Revert(u *User) {
+	u.AddStats(Stats{}.Sub(h.Delta))
+	for _, fl := range strings.Split(h.FlagsAdded, " ") {
+		if fl != "" {
+			u.RemoveFlag(fl)
+		}
+	}
+	for _, fl := range strings.Split(h.FlagsRemoved, " ") {
+		if fl != "" {
+			u.SetFlag(fl)
+		}
+	}
+	u.CurrentPage = h.FromPage
+}
+
+// Kinds of story events
+const (
+	EventMove       = "move"
+	EventEnding     = "ending"
+	EventReset      = "reset"
+	EventDisconnect = "disconnect"
+)
+
+// StoryEvent is an entry of append-only playthrough log
+type StoryEvent struct {
+	Id          int64     `json:"-"`
+	UserId      int64     `json:"-" sql:",notnull"`
+	SessionId   string    `json:"-" sql:",notnull"`
+	Kind        string    `json:"-" sql:",notnull"`
+	PageId      int64     `json:"-" sql:"default:0"`
+	AnswerId    int64     `json:"-" sql:"default:0"`
+	StatsBefore Stats     `json:"-"`
+	StatsAfter  Stats     `json:"-"`
+	Flags       string    `json:"-" sql:"default:''"`
+	CreatedAt   time.Time `json:"-" sql:"default:now()"`
+	// Story version event happened on
+	StoryVersion int64 `json:"-" sql:"default:0,notnull"`
+}
+
+// AnswerStat shows how often answer is picked on its page
+type AnswerStat struct {
+	PageId   int64   `json:"pageId"`
+	AnswerId int64   `json:"answerId"`
+	Picks    int     `json:"picks"`
+	Rate     float64 `json:"rate" sql:"-"`
+}
+
+// PageDropOff shows how often players quit on page
+// instead of moving on
+type PageDropOff struct {
+	PageId int64   `json:"pageId"`
+	Moves  int     `json:"moves"`
+	Quits  int     `json:"quits"`
+	Rate   float64 `json:"rate" sql:"-"`
+}
+
+// EndingStat shows how often story ends on page
+type EndingStat struct {
+	PageId int64   `json:"pageId"`
+	Count  int     `json:"count"`
+	Share  float64 `json:"share" sql:"-"`
+}
+
 // Reset resets user's stats and current page to beggining
 func (u *User) Reset() {
 	u.Connections = 0
@@ -104,6 +260,93 @@ func (u *User) Reset() {
 	u.Flags = ""
 }
 
+// SaveSlot is a named snapshot of user's run
+type SaveSlot struct {
+	Id          int64     `json:"-"`
+	UserId      int64     `json:"-" sql:",notnull"`
+	Name        string    `json:"name" sql:",notnull"`
+	CurrentPage int64     `json:"-" sql:"default:1"`
+	Knowledge   int       `json:"knowledge" sql:"default:0"`
+	Performance int       `json:"performance" sql:"default:0"`
+	Sober       int       `json:"soberness" sql:"default:0"`
+	Prestige    int       `json:"prestige" sql:"default:0"`
+	Connections int       `json:"connections" sql:"default:0"`
+	Praepostor  int       `json:"-" sql:"default:0"`
+	Flags       string    `json:"-"`
+	CreatedAt   time.Time `json:"createdAt" sql:"default:now()"`
+	UpdatedAt   time.Time `json:"updatedAt" sql:"default:now()"`
+	// Story version of saved run
+	StoryVersion int64 `json:"storyVersion" sql:"default:0,notnull"`
+}
+
+// ToSlot makes save slot out of user's current run
+func (u User) ToSlot(name string) *SaveSlot {
+	now := time.Now()
+	return &SaveSlot{
+		UserId:       u.Id,
+		Name:         name,
+		CurrentPage:  u.CurrentPage,
+		Knowledge:    u.Knowledge,
+		Performance:  u.Performance,
+		Sober:        u.Sober,
+		Prestige:     u.Prestige,
+		Connections:  u.Connections,
+		Praepostor:   u.Praepostor,
+		Flags:        u.Flags,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+		StoryVersion: u.StoryVersion,
+	}
+}
+
+// LoadSlot replaces user's current run with one from save slot
+func (u *User) LoadSlot(slot *SaveSlot) {
+	u.CurrentPage = slot.CurrentPage
+	u.Knowledge = slot.Knowledge
+	u.Performance = slot.Performance
+	u.Sober = slot.Sober
+	u.Prestige = slot.Prestige
+	u.Connections = slot.Connections
+	u.Praepostor = slot.Praepostor
+	u.Flags = slot.Flags
+	u.StoryVersion = slot.StoryVersion
+}
+
+// Actions on story content recorded in audit log
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+)
+
+// AuditEntry records change of story content, who made it
+// and the record before and after the change
+type AuditEntry struct {
+	Id     int64  `json:"id"`
+	UserId int64  `json:"userId" sql:",notnull"`
+	Login  string `json:"login" sql:",notnull"`
+	Action string `json:"action" sql:",notnull"`
+	// Kind of record, e.g. "page" or "answer"
+	Kind     string `json:"kind" sql:",notnull"`
+	RecordId int64  `json:"recordId" sql:",notnull"`
+	// Record as JSON object, nil if it didn't exist
+	Before    map[string]interface{} `json:"before"`
+	After     map[string]interface{} `json:"after"`
+	CreatedAt time.Time              `json:"createdAt" sql:"default:now()"`
+}
+
+// StoryVersion is an immutable snapshot of story published
+// from the draft, runs of users are pinned to one of them
+type StoryVersion struct {
+	Id      int64  `json:"id"`
+	Comment string `json:"comment"`
+	// Id of user who published version, 0 if it was published from CLI
+	PublishedBy int64 `json:"publishedBy" sql:"default:0,notnull"`
+	// Story bundle in JSON
+	Content   string    `json:"-" sql:",notnull"`
+	CreatedAt time.Time `json:"createdAt" sql:"default:now()"`
+}
+
 type CredentialsMessage struct {
 	Login    string `json:"login"`
 	Password string `json:"password"`